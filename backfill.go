@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/ParticleMedia/fb_page_server/common"
+	"github.com/ParticleMedia/fb_page_server/remote"
+	"github.com/ParticleMedia/fb_page_server/server"
+	"github.com/golang/glog"
+	"os"
+	"os/signal"
+	"time"
+)
+
+// runBackfill recomputes the profiles of a dump after a model change, e.g.
+// `fb_page_server -conf=./conf/fb_page_server.yaml backfill -input=./dump/ -rate=200 -checkpoint=./backfill.ckpt`.
+// Run it again with the same checkpoint to resume after a crash.
+func runBackfill(args []string) error {
+	flagSet := flag.NewFlagSet("backfill", flag.ExitOnError)
+	input := flagSet.String("input", "", "json lines file of FBProfile, or a dir of them")
+	mongoCollection := flagSet.String("mongo_collection", "", "read the profiles from this collection of mongo.database instead of input")
+	concurrency := flagSet.Int("concurrency", 0, "profiles processed at the same time, worker_cnt if 0")
+	rate := flagSet.Float64("rate", 0, "max profiles per second, 0 for no limit")
+	checkpoint := flagSet.String("checkpoint", "", "checkpoint file to resume from and save progress to, empty to disable")
+	checkpointInterval := flagSet.Duration("checkpoint_interval", 30*time.Second, "interval of saving the checkpoint")
+	output := flagSet.String("output", "ups", "ups, or a json lines file to write the profiles to instead")
+	retry := flagSet.String("retry", "", "json lines file to append the failed profiles to, to backfill them again as input; "+
+		"if empty the checkpoint stays before the first failed profile")
+	flagSet.Parse(args)
+
+	initErr := InitGlobalResources()
+	if initErr != nil {
+		return initErr
+	}
+	defer remote.MongoDisconnect()
+
+	var flush func() error
+	if *output != "ups" {
+		writer, openErr := remote.NewFileProfileWriter(*output)
+		if openErr != nil {
+			return openErr
+		}
+		defer writer.Close()
+		remote.SetProfileWriter(writer)
+		flush = writer.Flush
+		for _, processor := range remote.EnabledProcessors() {
+			if processor.Config().Merge.Enable {
+				glog.Warningf("%s merges with the profile read from ups, not from %s", processor.Name(), *output)
+			}
+		}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+
+	opts := &server.BackfillOptions{
+		Input:              *input,
+		MongoCollection:    *mongoCollection,
+		Concurrency:        *concurrency,
+		Rate:               *rate,
+		Checkpoint:         *checkpoint,
+		CheckpointInterval: *checkpointInterval,
+		Retry:              *retry,
+	}
+	start := time.Now()
+	stats, backfillErr := server.Backfill(opts, common.FBConfig, signals, flush)
+	if stats != nil {
+		fmt.Printf("read: %d, processed: %d, failed: %d, cost: %s\n", stats.Read, stats.Processed, stats.Failed, time.Since(start))
+	}
+	return backfillErr
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/ParticleMedia/fb_page_server/common"
+	"github.com/ParticleMedia/fb_page_server/remote"
+	"os"
+)
+
+// runClassify prints the text category and channels of pages as json lines, e.g.
+// `fb_page_server classify -name="Golden State Warriors" -about="..." -no_cache -explain` or `classify -input=./pages.jsonl`.
+// Nothing is written to ups or mongo: the page caches are only read, by page id, so pages without -id or id
+// are always computed; with -no_cache mongo is not read either.
+func runClassify(args []string) error {
+	flagSet := flag.NewFlagSet("classify", flag.ExitOnError)
+	input := flagSet.String("input", "", "json lines file of FBPage, - for stdin")
+	id := flagSet.String("id", "", "page id, the page caches are read only for pages with an id")
+	name := flagSet.String("name", "", "page name")
+	about := flagSet.String("about", "", "page about")
+	description := flagSet.String("description", "", "page description")
+	category := flagSet.String("category", "", "page facebook category")
+	noCache := flagSet.Bool("no_cache", false, "do not read the mongo page caches")
+	explain := flagSet.Bool("explain", false, "print the keyword candidates, keywords and channels before filtering")
+	pretty := flagSet.Bool("pretty", false, "indent the json")
+	modelDir := flagSet.String("model_dir", "", "dir of the channel model files, /mnt/models/fb-page-server/channel if empty")
+	flagSet.Parse(args)
+
+	if len(*input) == 0 && len(*name) == 0 && len(*about) == 0 && len(*description) == 0 {
+		return errors.New("classify needs -input or -name/-about/-description")
+	}
+
+	confErr := common.LoadConfig(*configFile)
+	if confErr != nil {
+		return confErr
+	}
+	conf := common.FBConfig
+	if len(*modelDir) != 0 {
+		remote.SetChannelModelDir(*modelDir)
+	}
+	chnErr := remote.LoadChannels()
+	if chnErr != nil {
+		return chnErr
+	}
+	if *noCache {
+		remote.DisablePageCache()
+	} else {
+		mongoErr := remote.BuildMongoCollections(&conf.MongoConf)
+		if mongoErr != nil {
+			return mongoErr
+		}
+		defer remote.MongoDisconnect()
+		remote.ReadOnlyPageCache()
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	if *pretty {
+		encoder.SetIndent("", "  ")
+	}
+	ctx := context.Background()
+	if len(*input) == 0 {
+		page := &common.FBPage{
+			Id:          *id,
+			Name:        *name,
+			About:       *about,
+			Description: *description,
+			Category:    *category,
+		}
+		return encoder.Encode(remote.ClassifyPage(ctx, page, *explain, conf))
+	}
+
+	file := os.Stdin
+	if *input != "-" {
+		var openErr error
+		file, openErr = os.Open(*input)
+		if openErr != nil {
+			return openErr
+		}
+		defer file.Close()
+	}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo += 1
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var page common.FBPage
+		parseErr := json.Unmarshal(scanner.Bytes(), &page)
+		if parseErr != nil {
+			fmt.Fprintf(os.Stderr, "skip line %d: %+v\n", lineNo, parseErr)
+			continue
+		}
+		encodeErr := encoder.Encode(remote.ClassifyPage(ctx, &page, *explain, conf))
+		if encodeErr != nil {
+			return encodeErr
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/ParticleMedia/fb_page_server/internal/testutil/fake"
+	"github.com/golang/glog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+)
+
+// fake_remote serves stand-ins of the text category dnn and the keyword service on one address,
+// e.g. `go run ./cmd/fake_remote -addr=127.0.0.1:9111 -keyword_rules=./keyword_rules.json -error_rate=0.1`.
+// It is a separate binary so the fakes are not built into fb_page_server.
+var (
+	addr           = flag.String("addr", "127.0.0.1:9111", "http listen address")
+	tcatPath       = flag.String("tcat_path", "/api/v0/category_classification_dnn", "url path of text category")
+	tcatRecords    = flag.String("tcat_records", "", "jsonl of recorded text category responses keyed by page id or title")
+	tcatRules      = flag.String("tcat_rules", "", "json array of text category rules")
+	keywordPath    = flag.String("keyword_path", "/keyword", "url path of keyword")
+	keywordRecords = flag.String("keyword_records", "", "jsonl of recorded keyword responses keyed by page title")
+	keywordRules   = flag.String("keyword_rules", "", "json array of keyword rules")
+	dimension      = flag.Int("dimension", 0, "dimension of hashed vectors for pages matching no keyword rule")
+	latency        = flag.Duration("latency", 0, "latency added to every response")
+	jitter         = flag.Duration("jitter", 0, "random latency added on top of latency")
+	errorRate      = flag.Float64("error_rate", 0, "ratio of requests answered with error_code")
+	errorCode      = flag.Int("error_code", http.StatusInternalServerError, "http status of injected errors")
+)
+
+func main() {
+	flag.Parse()
+	serveErr := runFakeRemote()
+	glog.Flush()
+	if serveErr != nil {
+		fmt.Fprintf(os.Stderr, "fake_remote: %+v\n", serveErr)
+		os.Exit(1)
+	}
+}
+
+func runFakeRemote() error {
+	faults := fake.FaultConfig{
+		Latency:   *latency,
+		Jitter:    *jitter,
+		ErrorRate: *errorRate,
+		ErrorCode: *errorCode,
+	}
+	tcatServer, tcatErr := fake.LoadTextCategoryServer(*tcatRecords, *tcatRules)
+	if tcatErr != nil {
+		return tcatErr
+	}
+	tcatServer.SetFaults(faults)
+	keywordServer, keywordErr := fake.LoadKeywordServer(*keywordRecords, *keywordRules, *dimension)
+	if keywordErr != nil {
+		return keywordErr
+	}
+	keywordServer.SetFaults(faults)
+
+	mux := http.NewServeMux()
+	mux.Handle(*tcatPath, tcatServer)
+	mux.HandleFunc(strings.TrimSuffix(*tcatPath, "/")+"/batch", tcatServer.ServeBatch)
+	mux.Handle(*keywordPath, keywordServer)
+	httpServer := &http.Server{Addr: *addr, Handler: mux}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	go func() {
+		<-signals
+		httpServer.Close()
+	}()
+
+	glog.Infof("fake remote listen on %s, text category: %s (batch: %s/batch), keyword: %s", *addr, *tcatPath, strings.TrimSuffix(*tcatPath, "/"), *keywordPath)
+	serveErr := httpServer.ListenAndServe()
+	if serveErr == http.ErrServerClosed {
+		return nil
+	}
+	return serveErr
+}
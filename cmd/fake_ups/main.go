@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/ParticleMedia/fb_page_server/internal/testutil/fake"
+	"github.com/golang/glog"
+	"os"
+	"os/signal"
+)
+
+// fake_ups serves an in-memory UserProfileService for local runs, e.g. `go run ./cmd/fake_ups -dump=./ups.json`,
+// then point user_profile.addr at it and inspect http://127.0.0.1:8080/dump or POST /v1/get.
+// It is a separate binary so the fakes are not built into fb_page_server.
+var grpcAddr = flag.String("grpc_addr", "127.0.0.1:9999", "grpc listen address")
+var httpAddr = flag.String("http_addr", "127.0.0.1:8080", "http gateway listen address, empty to disable")
+var dumpPath = flag.String("dump", "", "json file to load profiles from and save them to, empty to keep in memory")
+
+func main() {
+	flag.Parse()
+	serveErr := runFakeUps()
+	glog.Flush()
+	if serveErr != nil {
+		fmt.Fprintf(os.Stderr, "fake_ups: %+v\n", serveErr)
+		os.Exit(1)
+	}
+}
+
+func runFakeUps() error {
+	ups, createErr := fake.NewUserProfileServer(*dumpPath)
+	if createErr != nil {
+		return createErr
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	return ups.Serve(ctx, *grpcAddr, *httpAddr)
+}
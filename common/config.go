@@ -1,8 +1,11 @@
 package common
 
 import (
+	"errors"
+	"fmt"
 	yaml "gopkg.in/yaml.v3"
 	"os"
+	"strings"
 	"sync"
 )
 
@@ -22,6 +25,13 @@ type KafkaConfig struct {
 	CommitInterval int64    `yaml:"commit_interval"`
 }
 
+// SourceConfig selects where messages come from: kafka, file (json lines), dir (spool of json lines files) or stdin.
+type SourceConfig struct {
+	Type         string `yaml:"type"`
+	Path         string `yaml:"path"`
+	PollInterval int64  `yaml:"poll_interval"`
+}
+
 type MongoConfig struct {
 	Addr       string   `yaml:"addr"`
 	ReplicaSet string   `yaml:"replica_set"`
@@ -30,18 +40,138 @@ type MongoConfig struct {
 	Collection []string `yaml:"collections"`
 }
 
+const (
+	NormalizeNone = "none"
+	NormalizeL1   = "l1"
+	NormalizeMax  = "max"
+)
+
+type AggregationConfig struct {
+	DecayHalfLife float64 `yaml:"decay_half_life"`
+	// down-weight the pages liked by many users like idf, by the page counts of the incremental user states
+	Popularity bool   `yaml:"popularity"`
+	TopK       int    `yaml:"top_k"`
+	Normalize  string `yaml:"normalize"`
+}
+
+func (conf *AggregationConfig) Validate(incremental bool) error {
+	switch conf.Normalize {
+	case "", NormalizeNone, NormalizeL1, NormalizeMax:
+	default:
+		return errors.New(fmt.Sprintf("unknown normalize: %s, supported: %s, %s, %s", conf.Normalize, NormalizeNone, NormalizeL1, NormalizeMax))
+	}
+	if conf.Popularity && !incremental {
+		return errors.New("popularity needs incremental user state")
+	}
+	return nil
+}
+
+// output.encoding of a processor, user_profile.format is the encoding of the processors without one
+const (
+	EncodingJson     = "json"
+	EncodingList     = "list"
+	EncodingRawBytes = "raw_bytes"
+	EncodingCompact  = "compact"
+)
+
+type OutputConfig struct {
+	Encoding string `yaml:"encoding"`
+	TopK     int    `yaml:"top_k"`
+}
+
+func (conf *OutputConfig) Validate() error {
+	switch conf.Encoding {
+	case "", EncodingJson, EncodingList, EncodingRawBytes, EncodingCompact:
+		return nil
+	default:
+		return errors.New(fmt.Sprintf("unknown encoding: %s, supported: %s, %s, %s, %s", conf.Encoding, EncodingJson, EncodingList, EncodingRawBytes, EncodingCompact))
+	}
+}
+
+// MergeConfig merges the new feature of a user into the value in ups. The read-merge-write is
+// serialized by a lock of this process only, so backfill and serve, or several serve instances,
+// must not merge the same profile at the same time, or one of the writes is lost.
+type MergeConfig struct {
+	Enable    bool    `yaml:"enable"`
+	OldWeight float64 `yaml:"old_weight"`
+	NewWeight float64 `yaml:"new_weight"`
+	MinScore  float64 `yaml:"min_score"`
+	// days, the old ups value is weighted by 0.5^(age/decay_half_life), 0 for no decay
+	DecayHalfLife float64 `yaml:"decay_half_life"`
+	// keeps the time of the last merge, ups has no timestamp of its own
+	Collection string `yaml:"collection"`
+}
+
+// HttpClientConfig is the transport of a remote service client, timeouts in ms, 0 for no limit.
+type HttpClientConfig struct {
+	Timeout             int64 `yaml:"timeout"`
+	ConnectTimeout      int64 `yaml:"connect_timeout"`
+	MaxIdleConnsPerHost int   `yaml:"max_idle_conns_per_host"`
+	MaxConnsPerHost     int   `yaml:"max_conns_per_host"`
+	// s
+	IdleConnTimeout  int64 `yaml:"idle_conn_timeout"`
+	DisableKeepAlive bool  `yaml:"disable_keep_alive"`
+}
+
 type TextCategoryConfig struct {
 	Uri         string `yaml:"uri"`
 	ContentType string `yaml:"content_type"`
-	Collection  string `yaml:"collection"`
-	Profile     string `yaml:"profile"`
+	// pages of a profile are classified batch_size per request if batch_uri is set and batch_size > 1
+	BatchUri    string            `yaml:"batch_uri"`
+	BatchSize   int               `yaml:"batch_size"`
+	Http        HttpClientConfig  `yaml:"http"`
+	Collection  string            `yaml:"collection"`
+	Profile     string            `yaml:"profile"`
+	Aggregation AggregationConfig `yaml:"aggregation"`
+	Output      OutputConfig      `yaml:"output"`
+	Merge       MergeConfig       `yaml:"merge"`
+}
+
+// LocalKeywordConfig scores the keyword candidates in process when the keyword service is down,
+// with keyword_df.txt and word.vector of the channel model dir. The scores are multiplied by ScoreRatio.
+type LocalKeywordConfig struct {
+	Enable      bool    `yaml:"enable"`
+	MaxKeywords int     `yaml:"max_keywords"`
+	ScoreRatio  float64 `yaml:"score_ratio"`
 }
 
 type ChannelConfig struct {
 	Uri         string `yaml:"uri"`
 	ContentType string `yaml:"content_type"`
-	Collection  string `yaml:"collection"`
-	Profile     string `yaml:"profile"`
+	// get (default) or post, get requests longer than max_get_length are posted
+	Method        string             `yaml:"method"`
+	MaxGetLength  int                `yaml:"max_get_length"`
+	Http          HttpClientConfig   `yaml:"http"`
+	Collection    string             `yaml:"collection"`
+	Profile       string             `yaml:"profile"`
+	CategoryScore float64            `yaml:"category_score"`
+	LocalFallback LocalKeywordConfig `yaml:"local_fallback"`
+	Aggregation   AggregationConfig  `yaml:"aggregation"`
+	Output        OutputConfig       `yaml:"output"`
+	Merge         MergeConfig        `yaml:"merge"`
+}
+
+type TopicModelConfig struct {
+	Uri         string            `yaml:"uri"`
+	ContentType string            `yaml:"content_type"`
+	Http        HttpClientConfig  `yaml:"http"`
+	Collection  string            `yaml:"collection"`
+	Profile     string            `yaml:"profile"`
+	Aggregation AggregationConfig `yaml:"aggregation"`
+	Output      OutputConfig      `yaml:"output"`
+	Merge       MergeConfig       `yaml:"merge"`
+}
+
+type IncrementalConfig struct {
+	Enable     bool   `yaml:"enable"`
+	Collection string `yaml:"collection"`
+	// page id -> count of the user states containing the page
+	PageRefCollection string `yaml:"page_ref_collection"`
+}
+
+type DeletionConfig struct {
+	Enable     bool `yaml:"enable"`
+	PurgePages bool `yaml:"purge_pages"`
 }
 
 type UserProfileConfig struct {
@@ -53,14 +183,81 @@ type UserProfileConfig struct {
 	DisableCache bool   `yaml:"disable_cache"`
 }
 
+// DefaultEncoding is the encoding of format, string for json as written before output.encoding.
+func (conf *UserProfileConfig) DefaultEncoding() (string, error) {
+	switch strings.ToLower(conf.Format) {
+	case "", "string", EncodingJson:
+		return EncodingJson, nil
+	case EncodingList:
+		return EncodingList, nil
+	case EncodingRawBytes:
+		return EncodingRawBytes, nil
+	default:
+		return "", errors.New(fmt.Sprintf("unknown user_profile.format: %s, supported: string, %s, %s, %s", conf.Format, EncodingJson, EncodingList, EncodingRawBytes))
+	}
+}
+
+// BreakerConfig opens the breaker of a remote dependency when, over the last window seconds with at least min_requests calls,
+// the rate of failed calls reaches error_rate or the rate of calls slower than slow_call ms reaches slow_rate.
+// After open_time seconds half_open_probes calls are let through, the breaker closes when all of them succeed.
+type BreakerConfig struct {
+	Enable         bool    `yaml:"enable"`
+	Window         int64   `yaml:"window"`
+	MinRequests    int64   `yaml:"min_requests"`
+	ErrorRate      float64 `yaml:"error_rate"`
+	SlowCall       int64   `yaml:"slow_call"`
+	SlowRate       float64 `yaml:"slow_rate"`
+	OpenTime       int64   `yaml:"open_time"`
+	HalfOpenProbes int64   `yaml:"half_open_probes"`
+}
+
+type BreakersConfig struct {
+	TextCategory BreakerConfig `yaml:"text_category"`
+	Keyword      BreakerConfig `yaml:"keyword"`
+	TopicModel   BreakerConfig `yaml:"topic_model"`
+	Mongo        BreakerConfig `yaml:"mongo"`
+	Ups          BreakerConfig `yaml:"user_profile"`
+}
+
+// RateLimitConfig limits the calls of all workers to a remote service to rate per second with bursts of burst,
+// and max_concurrency calls at the same time. 0 for no limit.
+type RateLimitConfig struct {
+	Rate           float64 `yaml:"rate"`
+	Burst          int     `yaml:"burst"`
+	MaxConcurrency int     `yaml:"max_concurrency"`
+}
+
+type RateLimitsConfig struct {
+	TextCategory RateLimitConfig `yaml:"text_category"`
+	Keyword      RateLimitConfig `yaml:"keyword"`
+	TopicModel   RateLimitConfig `yaml:"topic_model"`
+}
+
+// HealthConfig serves /health and /metrics on addr, empty to disable.
+type HealthConfig struct {
+	Addr string `yaml:"addr"`
+}
+
 type Config struct {
-	WorkerCnt int                `yaml:"worker_cnt"`
-	LogConf   LogConfig          `yaml:"log"`
-	KafkaConf KafkaConfig        `yaml:"kafka"`
-	MongoConf MongoConfig        `yaml:"mongo"`
-	TcatConf  TextCategoryConfig `yaml:"text_category"`
-	ChnConf   ChannelConfig      `yaml:"channel"`
-	UpsConf   UserProfileConfig  `yaml:"user_profile"`
+	WorkerCnt int `yaml:"worker_cnt"`
+	// ms, the deadline of every remote call of one message, 0 for none
+	ProfileTimeout int64 `yaml:"profile_timeout"`
+	// ms the messages in process have after a shutdown signal before their remote calls are cancelled, 0 to wait for them
+	ShutdownTimeout int64              `yaml:"shutdown_timeout"`
+	Processors      []string           `yaml:"processors"`
+	LogConf         LogConfig          `yaml:"log"`
+	KafkaConf       KafkaConfig        `yaml:"kafka"`
+	SourceConf      SourceConfig       `yaml:"source"`
+	MongoConf       MongoConfig        `yaml:"mongo"`
+	TcatConf        TextCategoryConfig `yaml:"text_category"`
+	ChnConf         ChannelConfig      `yaml:"channel"`
+	TpcmConf        TopicModelConfig   `yaml:"topic_model"`
+	IncrConf        IncrementalConfig  `yaml:"incremental"`
+	DeleteConf      DeletionConfig     `yaml:"deletion"`
+	UpsConf         UserProfileConfig  `yaml:"user_profile"`
+	BreakerConf     BreakersConfig     `yaml:"breaker"`
+	LimitConf       RateLimitsConfig   `yaml:"rate_limit"`
+	HealthConf      HealthConfig       `yaml:"health"`
 }
 
 func LoadConfig(confPath string) error {
@@ -71,7 +268,75 @@ func LoadConfig(confPath string) error {
 	defer filePtr.Close()
 
 	decoder := yaml.NewDecoder(filePtr)
-	FBConfig = &Config{}
-	err = decoder.Decode(FBConfig)
-	return err
+	conf := &Config{}
+	err = decoder.Decode(conf)
+	if err != nil {
+		return err
+	}
+	err = conf.Validate()
+	if err != nil {
+		return err
+	}
+	FBConfig = conf
+	return nil
+}
+
+// Validate rejects the settings which would otherwise be ignored silently.
+func (conf *Config) Validate() error {
+	for name, aggConf := range map[string]*AggregationConfig{
+		"text_category": &conf.TcatConf.Aggregation,
+		"channel":       &conf.ChnConf.Aggregation,
+		"topic_model":   &conf.TpcmConf.Aggregation,
+	} {
+		aggErr := aggConf.Validate(conf.IncrConf.Enable)
+		if aggErr != nil {
+			return errors.New(fmt.Sprintf("%s aggregation with error: %+v", name, aggErr))
+		}
+	}
+	defaultEncoding, formatErr := conf.UpsConf.DefaultEncoding()
+	if formatErr != nil {
+		return formatErr
+	}
+	for name, outputConf := range map[string]*OutputConfig{
+		"text_category": &conf.TcatConf.Output,
+		"channel":       &conf.ChnConf.Output,
+		"topic_model":   &conf.TpcmConf.Output,
+	} {
+		outputErr := outputConf.Validate()
+		if outputErr != nil {
+			return errors.New(fmt.Sprintf("%s output with error: %+v", name, outputErr))
+		}
+	}
+	for _, name := range conf.Processors {
+		if name == "topic_model" && len(conf.TpcmConf.Uri) == 0 {
+			return errors.New("topic_model processor needs topic_model.uri")
+		}
+	}
+	for name, c := range map[string]struct {
+		output *OutputConfig
+		merge  *MergeConfig
+	}{
+		"text_category": {&conf.TcatConf.Output, &conf.TcatConf.Merge},
+		"channel":       {&conf.ChnConf.Output, &conf.ChnConf.Merge},
+		"topic_model":   {&conf.TpcmConf.Output, &conf.TpcmConf.Merge},
+	} {
+		if !c.merge.Enable {
+			continue
+		}
+		if c.merge.OldWeight <= 0 || c.merge.NewWeight <= 0 {
+			return errors.New(fmt.Sprintf("%s merge needs positive old_weight and new_weight", name))
+		}
+		if c.merge.DecayHalfLife > 0 && len(c.merge.Collection) == 0 {
+			return errors.New(fmt.Sprintf("%s merge with decay_half_life needs a collection", name))
+		}
+		// list 只有name没有score, 无法与ups中的旧值合并
+		encoding := c.output.Encoding
+		if len(encoding) == 0 {
+			encoding = defaultEncoding
+		}
+		if encoding == EncodingList {
+			return errors.New(fmt.Sprintf("%s merge can not read back the list encoding", name))
+		}
+	}
+	return nil
 }
@@ -1,13 +1,208 @@
 package common
 
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const fbTimeLayout = "2006-01-02T15:04:05-0700"
+
+// UserIdMapper, when set, maps non-numeric user ids (e.g. facebook app-scoped ids) to ups uids.
+var UserIdMapper func(id string) (uint64, error)
+
 type FBProfile struct {
-	Id    int32    `json:"_id"`
+	Id    uint64   `json:"_id"`
 	Pages []FBPage `json:"likes"`
 }
 
+const (
+	FBEventLike        = "like"
+	FBEventUnlike      = "unlike"
+	FBEventDeauthorize = "deauthorize"
+)
+
+// FBEvent is a delta of FBProfile: one page liked or unliked by the user, or the user revoking consent.
+type FBEvent struct {
+	Id    uint64 `json:"_id"`
+	Event string `json:"event"`
+	Page  FBPage `json:"page"`
+}
+
 type FBPage struct {
-	Id       string `json:"id"`
-	Name     string `json:"name"`
-	About    string `json:"about"`
-	Category string `json:"category"`
-}
\ No newline at end of file
+	Id           string       `json:"id"`
+	Name         string       `json:"name"`
+	About        string       `json:"about"`
+	Description  string       `json:"description"`
+	Category     string       `json:"category"`
+	CategoryList []FBCategory `json:"category_list"`
+	FanCount     int64        `json:"fan_count"`
+	CreatedTime  string       `json:"created_time"`
+	Website      string       `json:"website"`
+	Location     *FBLocation  `json:"location"`
+}
+
+type FBCategory struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type FBLocation struct {
+	City      string  `json:"city"`
+	State     string  `json:"state"`
+	Country   string  `json:"country"`
+	Street    string  `json:"street"`
+	Zip       string  `json:"zip"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+func (profile *FBProfile) UnmarshalJSON(data []byte) error {
+	type fbProfileAlias FBProfile
+	aux := struct {
+		Id json.RawMessage `json:"_id"`
+		*fbProfileAlias
+	}{
+		fbProfileAlias: (*fbProfileAlias)(profile),
+	}
+	parseErr := json.Unmarshal(data, &aux)
+	if parseErr != nil {
+		return parseErr
+	}
+	id, idErr := ParseUserId(aux.Id)
+	if idErr != nil {
+		return idErr
+	}
+	profile.Id = id
+	return nil
+}
+
+func (profile *FBProfile) Validate() error {
+	if profile.Id == 0 {
+		return errors.New("invalid FBProfile with uid 0")
+	}
+	return nil
+}
+
+func (event *FBEvent) UnmarshalJSON(data []byte) error {
+	type fbEventAlias FBEvent
+	aux := struct {
+		Id json.RawMessage `json:"_id"`
+		*fbEventAlias
+	}{
+		fbEventAlias: (*fbEventAlias)(event),
+	}
+	parseErr := json.Unmarshal(data, &aux)
+	if parseErr != nil {
+		return parseErr
+	}
+	id, idErr := ParseUserId(aux.Id)
+	if idErr != nil {
+		return idErr
+	}
+	event.Id = id
+	return nil
+}
+
+func (event *FBEvent) Validate() error {
+	if event.Id == 0 {
+		return errors.New("invalid FBEvent with uid 0")
+	}
+	if event.Event == FBEventDeauthorize {
+		return nil
+	}
+	if event.Event != FBEventLike && event.Event != FBEventUnlike {
+		return errors.New(fmt.Sprintf("invalid FBEvent with event: %s", event.Event))
+	}
+	if len(event.Page.Id) == 0 {
+		return errors.New("invalid FBEvent with empty page id")
+	}
+	return nil
+}
+
+// IsEvent tells a FBEvent from a full FBProfile by the event field.
+func IsEvent(data []byte) bool {
+	var envelope struct {
+		Event string `json:"event"`
+	}
+	parseErr := json.Unmarshal(data, &envelope)
+	return parseErr == nil && len(envelope.Event) != 0
+}
+
+// ParseUserId accepts a json number or a numeric string, and falls back to UserIdMapper for other strings.
+func ParseUserId(raw json.RawMessage) (uint64, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return 0, nil
+	}
+
+	if raw[0] != '"' {
+		id, parseErr := strconv.ParseUint(string(raw), 10, 64)
+		if parseErr != nil {
+			return 0, errors.New(fmt.Sprintf("parse uid with error: %+v, uid: %s", parseErr, raw))
+		}
+		return id, nil
+	}
+
+	var str string
+	strErr := json.Unmarshal(raw, &str)
+	if strErr != nil {
+		return 0, strErr
+	}
+	id, parseErr := strconv.ParseUint(str, 10, 64)
+	if parseErr == nil {
+		return id, nil
+	}
+	if UserIdMapper == nil {
+		return 0, errors.New(fmt.Sprintf("parse uid with error: %+v, uid: %s", parseErr, str))
+	}
+	return UserIdMapper(str)
+}
+
+// Content joins about and description without line breaks, skipping the description when it repeats about.
+func (page *FBPage) Content() string {
+	about := strings.TrimSpace(strings.ReplaceAll(page.About, "\n", ""))
+	description := strings.TrimSpace(strings.ReplaceAll(page.Description, "\n", ""))
+	if len(description) == 0 || strings.Contains(about, description) {
+		return about
+	}
+	if len(about) == 0 || strings.Contains(description, about) {
+		return description
+	}
+	return about + " " + description
+}
+
+// Categories returns category and the names of category_list, deduplicated and in order.
+func (page *FBPage) Categories() []string {
+	categories := make([]string, 0, len(page.CategoryList)+1)
+	exist := make(map[string]bool)
+	appendCategory := func(category string) {
+		category = strings.TrimSpace(category)
+		if len(category) == 0 || exist[strings.ToLower(category)] {
+			return
+		}
+		exist[strings.ToLower(category)] = true
+		categories = append(categories, category)
+	}
+	appendCategory(page.Category)
+	for _, category := range page.CategoryList {
+		appendCategory(category.Name)
+	}
+	return categories
+}
+
+// LikedTime parses created_time, which graph api sets to the time the user liked the page.
+func (page *FBPage) LikedTime() (time.Time, error) {
+	if len(page.CreatedTime) == 0 {
+		return time.Time{}, errors.New("empty created_time")
+	}
+	likedTime, parseErr := time.Parse(fbTimeLayout, page.CreatedTime)
+	if parseErr != nil {
+		return time.Parse(time.RFC3339, page.CreatedTime)
+	}
+	return likedTime, nil
+}
@@ -0,0 +1,111 @@
+package common
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// TokenBucket allows rate events per second on average and bursts of up to burst events.
+// A bucket with rate <= 0 never blocks.
+type TokenBucket struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &TokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// reserve takes a token and returns how long the caller has to wait for it.
+func (b *TokenBucket) reserve(now time.Time) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens -= 1
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Wait blocks until a token is available.
+func (b *TokenBucket) Wait() {
+	if b == nil || b.rate <= 0 {
+		return
+	}
+	wait := b.reserve(time.Now())
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// Restore gives back a token taken by a caller which did not use it.
+func (b *TokenBucket) Restore() {
+	if b == nil || b.rate <= 0 {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.tokens += 1
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// WaitContext is Wait returning ctx.Err() if ctx is done first, the token is given back then.
+func (b *TokenBucket) WaitContext(ctx context.Context) error {
+	if ctxErr := ctx.Err(); ctxErr != nil || b == nil || b.rate <= 0 {
+		return ctxErr
+	}
+	wait := b.reserve(time.Now())
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		b.Restore()
+		return ctx.Err()
+	}
+}
+
+// TryTake takes a token if one is available now.
+func (b *TokenBucket) TryTake() bool {
+	if b == nil || b.rate <= 0 {
+		return true
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens -= 1
+	return true
+}
@@ -0,0 +1,27 @@
+package common
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestWaitContextGivesBackToken(t *testing.T) {
+	bucket := NewTokenBucket(1, 1)
+	if !bucket.TryTake() {
+		t.Fatal("the burst token is not available")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if waitErr := bucket.WaitContext(ctx); waitErr != context.DeadlineExceeded {
+		t.Fatalf("wait with error: %v, want %v", waitErr, context.DeadlineExceeded)
+	}
+
+	bucket.lock.Lock()
+	defer bucket.lock.Unlock()
+	// 取消的等待不占用令牌，否则这里是-1附近
+	if bucket.tokens < -0.5 {
+		t.Errorf("tokens: %v, the cancelled wait kept its token", bucket.tokens)
+	}
+}
@@ -0,0 +1,35 @@
+package common
+
+import (
+	"context"
+	"math/rand"
+)
+
+// Trace is the metadata of the message a context is processing, the log id is sent to the remote services.
+type Trace struct {
+	LogId int64
+	Uid   uint64
+	// where the message is from, e.g. topic/partition/offset
+	Origin string
+}
+
+type traceKey struct{}
+
+func WithTrace(ctx context.Context, trace *Trace) context.Context {
+	return context.WithValue(ctx, traceKey{}, trace)
+}
+
+// TraceFrom returns nil if ctx has no trace.
+func TraceFrom(ctx context.Context) *Trace {
+	trace, _ := ctx.Value(traceKey{}).(*Trace)
+	return trace
+}
+
+// LogId returns the log id of the trace of ctx, or a random one.
+func LogId(ctx context.Context) int64 {
+	trace := TraceFrom(ctx)
+	if trace == nil {
+		return rand.Int63()
+	}
+	return trace.LogId
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/ParticleMedia/fb_page_server/remote"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type evalOutput struct {
+	Candidate *remote.EvalReport `json:"candidate"`
+	Baseline  *remote.EvalReport `json:"baseline,omitempty"`
+	Changed   int                `json:"changed,omitempty"`
+}
+
+// runEval scores a channel model against labelled pages, optionally next to a baseline model, e.g.
+// `fb_page_server eval -input=./labelled.jsonl -model_dir=./new_model -baseline_model_dir=/mnt/models/fb-page-server/channel`.
+// Every line of input is {"id", "seg_title", "seg_content", "keyword": <keyword service response>, "channels": [...]}.
+func runEval(args []string) error {
+	flagSet := flag.NewFlagSet("eval", flag.ExitOnError)
+	input := flagSet.String("input", "", "json lines file of labelled pages")
+	modelDir := flagSet.String("model_dir", remote.DefaultChannelModelDir, "dir of the channel model to evaluate")
+	threshold := flagSet.Float64("threshold", -1, "score threshold of the model, the default if negative")
+	baselineDir := flagSet.String("baseline_model_dir", "", "dir of the baseline channel model to compare with")
+	baselineThreshold := flagSet.Float64("baseline_threshold", -1, "score threshold of the baseline, the default if negative")
+	kList := flagSet.String("k", "1,3,5,0", "comma separated K of the metrics, 0 for all channels")
+	confusionTop := flagSet.Int("confusion_top", 20, "channels printed in the confusion table")
+	showDiff := flagSet.Bool("show_diff", false, "print the pages predicted differently by the baseline")
+	jsonOutput := flagSet.Bool("json", false, "print the reports as json")
+	flagSet.Parse(args)
+
+	if len(*input) == 0 {
+		return errors.New("eval needs -input")
+	}
+	ks, kErr := parseKs(*kList)
+	if kErr != nil {
+		return kErr
+	}
+	pages, loadErr := remote.LoadLabelledPages(*input)
+	if loadErr != nil {
+		return loadErr
+	}
+
+	model, modelErr := loadEvalModel(*modelDir, *threshold)
+	if modelErr != nil {
+		return modelErr
+	}
+	output := &evalOutput{Candidate: model.Evaluate(pages, ks)}
+	if len(*baselineDir) != 0 {
+		baseline, baselineErr := loadEvalModel(*baselineDir, *baselineThreshold)
+		if baselineErr != nil {
+			return baselineErr
+		}
+		output.Baseline = baseline.Evaluate(pages, ks)
+		output.Changed = len(remote.ChangedPredictions(output.Candidate, output.Baseline))
+	}
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(output)
+	}
+	printEval(output, *confusionTop, *showDiff)
+	return nil
+}
+
+func parseKs(value string) ([]int, error) {
+	ks := make([]int, 0)
+	for _, item := range strings.Split(value, ",") {
+		if len(strings.TrimSpace(item)) == 0 {
+			continue
+		}
+		k, parseErr := strconv.Atoi(strings.TrimSpace(item))
+		if parseErr != nil {
+			return nil, errors.New(fmt.Sprintf("parse k %s with error: %+v", item, parseErr))
+		}
+		ks = append(ks, k)
+	}
+	return ks, nil
+}
+
+func loadEvalModel(dir string, threshold float64) (*remote.ChannelModel, error) {
+	model, loadErr := remote.LoadChannelModel(dir)
+	if loadErr != nil {
+		return nil, loadErr
+	}
+	if threshold >= 0 {
+		model.SetScoreThreshold(threshold)
+	}
+	return model, nil
+}
+
+func formatK(k int) string {
+	if k <= 0 {
+		return "all"
+	}
+	return strconv.Itoa(k)
+}
+
+func printEval(output *evalOutput, confusionTop int, showDiff bool) {
+	candidate, baseline := output.Candidate, output.Baseline
+	fmt.Printf("pages: %d, failed: %d\n\n", candidate.Pages, candidate.Failed)
+
+	if baseline == nil {
+		fmt.Printf("%-6s %10s %10s %10s\n", "K", "precision", "recall", "f1")
+		for _, metrics := range candidate.Metrics {
+			fmt.Printf("%-6s %10.4f %10.4f %10.4f\n", formatK(metrics.K), metrics.Precision, metrics.Recall, metrics.F1)
+		}
+	} else {
+		fmt.Printf("%-6s %21s %21s %21s\n", "K", "precision", "recall", "f1")
+		for i, metrics := range candidate.Metrics {
+			base := baseline.Metrics[i]
+			fmt.Printf("%-6s %10.4f %+10.4f %10.4f %+10.4f %10.4f %+10.4f\n", formatK(metrics.K),
+				metrics.Precision, metrics.Precision-base.Precision,
+				metrics.Recall, metrics.Recall-base.Recall,
+				metrics.F1, metrics.F1-base.F1)
+		}
+		fmt.Printf("\npages predicted differently from baseline: %d\n", output.Changed)
+	}
+
+	fmt.Printf("\n%-30s %6s %6s %6s  %s\n", "channel", "tp", "fp", "fn", "confused with")
+	for i, item := range candidate.Confusion {
+		if confusionTop > 0 && i >= confusionTop {
+			break
+		}
+		fmt.Printf("%-30s %6d %6d %6d  %s\n", item.Channel, item.TruePos, item.FalsePos, item.FalseNeg, formatConfused(item.ConfusedWith))
+	}
+
+	if showDiff && baseline != nil {
+		fmt.Printf("\n%-20s %-40s %-40s %s\n", "id", "baseline", "candidate", "labelled")
+		for _, i := range remote.ChangedPredictions(candidate, baseline) {
+			prediction, base := candidate.Predictions[i], baseline.Predictions[i]
+			fmt.Printf("%-20s %-40s %-40s %s\n", prediction.Id, strings.Join(base.Predicted, ","),
+				strings.Join(prediction.Predicted, ","), strings.Join(prediction.Labelled, ","))
+		}
+	}
+}
+
+// formatConfused prints the three channels most often predicted instead.
+func formatConfused(confused map[string]int) string {
+	names := make([]string, 0, len(confused))
+	for name := range confused {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if confused[names[i]] != confused[names[j]] {
+			return confused[names[i]] > confused[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	if len(names) > 3 {
+		names = names[:3]
+	}
+	items := make([]string, 0, len(names))
+	for _, name := range names {
+		items = append(items, fmt.Sprintf("%s(%d)", name, confused[name]))
+	}
+	return strings.Join(items, " ")
+}
@@ -1,9 +1,9 @@
 module github.com/ParticleMedia/fb_page_server
 
-go 1.12
+go 1.13
 
 require (
-	github.com/Shopify/sarama v1.26.1 // indirect
+	github.com/Shopify/sarama v1.26.1
 	github.com/bsm/sarama-cluster v2.1.15+incompatible
 	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b
 	github.com/golang/protobuf v1.4.2
@@ -12,7 +12,9 @@ require (
 	github.com/onsi/gomega v1.10.4 // indirect
 	github.com/rcrowley/go-metrics v0.0.0-20200313005456-10cdbea86bc0 // indirect
 	go.mongodb.org/mongo-driver v1.4.4
+	golang.org/x/text v0.3.3
 	google.golang.org/genproto v0.0.0-20200526211855-cb27e3aa2013
 	google.golang.org/grpc v1.35.0
+	google.golang.org/protobuf v1.25.0
 	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c
 )
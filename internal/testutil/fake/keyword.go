@@ -0,0 +1,181 @@
+package fake
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// KeywordRule returns its keywords and vector for pages whose title or content contains the pattern, case-insensitive.
+// The vector of a page matching several rules is the average of their vectors.
+type KeywordRule struct {
+	Pattern  string             `json:"pattern"`
+	Keywords map[string]float64 `json:"keywords"`
+	Vector   []float64          `json:"vector"`
+}
+
+// KeywordServer stands in for the keyword service: recorded responses by page title first, then rules.
+// Pages matching no rule get their candidates with candidate_score and a vector hashed from their words.
+type KeywordServer struct {
+	faultInjector
+	recordings     map[string]json.RawMessage
+	rules          []KeywordRule
+	Dimension      int
+	CandidateScore float64
+}
+
+type keywordRequest struct {
+	Url              string   `json:"url"`
+	SegTitle         string   `json:"seg_title"`
+	SegContent       string   `json:"seg_content"`
+	KwsCandidateNext []string `json:"kws_candidate_next"`
+}
+
+type keywordScore struct {
+	Keyword string  `json:"keyword"`
+	Score   float64 `json:"score"`
+}
+
+type keywordResponse struct {
+	Keywords []keywordScore `json:"keyword"`
+	Vector   []float64      `json:"vector"`
+}
+
+func NewKeywordServer(recordings map[string]json.RawMessage, rules []KeywordRule, dimension int) *KeywordServer {
+	if recordings == nil {
+		recordings = make(map[string]json.RawMessage)
+	}
+	return &KeywordServer{
+		recordings:     recordings,
+		rules:          rules,
+		Dimension:      dimension,
+		CandidateScore: 0.1,
+	}
+}
+
+func LoadKeywordServer(recordingPath string, rulePath string, dimension int) (*KeywordServer, error) {
+	recordings, recordErr := LoadRecordings(recordingPath)
+	if recordErr != nil {
+		return nil, recordErr
+	}
+	var rules []KeywordRule
+	ruleErr := loadRules(rulePath, &rules)
+	if ruleErr != nil {
+		return nil, ruleErr
+	}
+	return NewKeywordServer(recordings, rules, dimension), nil
+}
+
+func (s *KeywordServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.inject(w) {
+		return
+	}
+
+	// 线上服务用GET ?q=，也接受POST body
+	var body []byte
+	if r.Method == http.MethodPost {
+		data, readErr := ioutil.ReadAll(r.Body)
+		if readErr != nil {
+			http.Error(w, readErr.Error(), http.StatusBadRequest)
+			return
+		}
+		body = data
+	} else {
+		body = []byte(r.URL.Query().Get("q"))
+	}
+	var req keywordRequest
+	parseErr := json.Unmarshal(body, &req)
+	if parseErr != nil {
+		http.Error(w, parseErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	recorded, ok := s.recordings[req.SegTitle]
+	if ok && len(req.SegTitle) != 0 {
+		writeRaw(w, recorded)
+		return
+	}
+	writeJson(w, s.respond(&req))
+}
+
+func (s *KeywordServer) respond(req *keywordRequest) *keywordResponse {
+	text := strings.ToLower(req.SegTitle + " " + req.SegContent)
+	keywords := make(map[string]float64)
+	var vector []float64
+	matchCnt := 0
+	for _, rule := range s.rules {
+		if !strings.Contains(text, strings.ToLower(rule.Pattern)) {
+			continue
+		}
+		mergeMax(keywords, rule.Keywords)
+		if len(rule.Vector) != 0 {
+			if vector == nil {
+				vector = make([]float64, len(rule.Vector))
+			}
+			for i := 0; i < len(vector) && i < len(rule.Vector); i++ {
+				vector[i] += rule.Vector[i]
+			}
+			matchCnt += 1
+		}
+	}
+	for i := range vector {
+		vector[i] /= float64(matchCnt)
+	}
+
+	if len(keywords) == 0 {
+		for _, candidate := range req.KwsCandidateNext {
+			keywords[strings.ReplaceAll(candidate, "^^", " ")] = s.CandidateScore
+		}
+	}
+	if vector == nil {
+		vector = hashVector(text, s.Dimension)
+	}
+
+	resp := &keywordResponse{
+		Keywords: make([]keywordScore, 0, len(keywords)),
+		Vector:   vector,
+	}
+	for keyword, score := range keywords {
+		resp.Keywords = append(resp.Keywords, keywordScore{Keyword: keyword, Score: score})
+	}
+	sort.Slice(resp.Keywords, func(i, j int) bool {
+		if resp.Keywords[i].Score != resp.Keywords[j].Score {
+			return resp.Keywords[i].Score > resp.Keywords[j].Score
+		}
+		return resp.Keywords[i].Keyword < resp.Keywords[j].Keyword
+	})
+	return resp
+}
+
+// hashVector is a deterministic bag-of-words vector, so the same page always gets the same vector.
+func hashVector(text string, dimension int) []float64 {
+	vector := make([]float64, dimension)
+	if dimension == 0 {
+		return vector
+	}
+	for _, word := range strings.Fields(text) {
+		hash := fnv.New64a()
+		hash.Write([]byte(word))
+		sum := hash.Sum64()
+		sign := 1.0
+		if sum&1 == 1 {
+			sign = -1.0
+		}
+		vector[(sum>>1)%uint64(dimension)] += sign
+	}
+	norm := 0.0
+	for _, value := range vector {
+		norm += value * value
+	}
+	if norm > 0 {
+		norm = math.Sqrt(norm)
+		for i := range vector {
+			vector[i] /= norm
+		}
+	}
+	return vector
+}
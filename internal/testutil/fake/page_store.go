@@ -0,0 +1,103 @@
+package fake
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"sort"
+	"sync"
+)
+
+// PageStore is an in-memory remote.PageStore. Documents are kept as bson, so they round-trip like in mongo.
+type PageStore struct {
+	lock        sync.RWMutex
+	collections map[string]map[string]bson.Raw
+}
+
+func NewPageStore() *PageStore {
+	return &PageStore{
+		collections: make(map[string]map[string]bson.Raw),
+	}
+}
+
+func (s *PageStore) Find(ctx context.Context, collection string, key string) (bson.Raw, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	raw, ok := s.collections[collection][key]
+	if !ok {
+		return nil, mongo.ErrNoDocuments
+	}
+	return raw, nil
+}
+
+func (s *PageStore) Replace(ctx context.Context, collection string, key string, value interface{}) error {
+	data, encodeErr := bson.Marshal(value)
+	if encodeErr != nil {
+		return encodeErr
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	documents, ok := s.collections[collection]
+	if !ok {
+		documents = make(map[string]bson.Raw)
+		s.collections[collection] = documents
+	}
+	documents[key] = bson.Raw(data)
+	return nil
+}
+
+func (s *PageStore) Delete(ctx context.Context, collection string, key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.collections[collection], key)
+	return nil
+}
+
+func (s *PageStore) Incr(ctx context.Context, collection string, key string, field string, delta int64) (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	document := bson.M{"_id": key}
+	raw, ok := s.collections[collection][key]
+	if ok {
+		parseErr := bson.Unmarshal(raw, &document)
+		if parseErr != nil {
+			return 0, parseErr
+		}
+	}
+	value, _ := raw.Lookup(field).Int64OK()
+	value += delta
+	document[field] = value
+	data, encodeErr := bson.Marshal(document)
+	if encodeErr != nil {
+		return 0, encodeErr
+	}
+	if s.collections[collection] == nil {
+		s.collections[collection] = make(map[string]bson.Raw)
+	}
+	s.collections[collection][key] = bson.Raw(data)
+	return value, nil
+}
+
+func (s *PageStore) Count(ctx context.Context, collection string) (int64, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return int64(len(s.collections[collection])), nil
+}
+
+// Keys returns the sorted _id of every document in the collection.
+func (s *PageStore) Keys(collection string) []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	keys := make([]string, 0, len(s.collections[collection]))
+	for key := range s.collections[collection] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
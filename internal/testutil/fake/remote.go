@@ -0,0 +1,131 @@
+package fake
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang/glog"
+	"math/rand"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// FaultConfig injects latency and errors into a fake remote service.
+type FaultConfig struct {
+	Latency   time.Duration `json:"latency"`
+	Jitter    time.Duration `json:"jitter"`
+	ErrorRate float64       `json:"error_rate"`
+	ErrorCode int           `json:"error_code"`
+}
+
+// Recording is one line of a recorded responses file: the page key and the raw response of the real service.
+type Recording struct {
+	Key      string          `json:"key"`
+	Response json.RawMessage `json:"response"`
+}
+
+type faultInjector struct {
+	lock     sync.RWMutex
+	faults   FaultConfig
+	random   *rand.Rand
+	requests int64
+}
+
+// Requests counts the requests received, including those with an injected error.
+func (f *faultInjector) Requests() int64 {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return f.requests
+}
+
+func (f *faultInjector) SetFaults(faults FaultConfig) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.faults = faults
+}
+
+// inject sleeps for the configured latency, and writes an error response and returns true when an error is injected.
+func (f *faultInjector) inject(w http.ResponseWriter) bool {
+	f.lock.Lock()
+	f.requests += 1
+	faults := f.faults
+	if f.random == nil {
+		f.random = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	jitter := time.Duration(0)
+	if faults.Jitter > 0 {
+		jitter = time.Duration(f.random.Int63n(int64(faults.Jitter)))
+	}
+	failed := faults.ErrorRate > 0 && f.random.Float64() < faults.ErrorRate
+	f.lock.Unlock()
+
+	if faults.Latency+jitter > 0 {
+		time.Sleep(faults.Latency + jitter)
+	}
+	if failed {
+		code := faults.ErrorCode
+		if code == 0 {
+			code = http.StatusInternalServerError
+		}
+		http.Error(w, "injected error", code)
+		return true
+	}
+	return false
+}
+
+func LoadRecordings(path string) (map[string]json.RawMessage, error) {
+	recordings := make(map[string]json.RawMessage)
+	if len(path) == 0 {
+		return recordings, nil
+	}
+	file, openErr := os.Open(path)
+	if openErr != nil {
+		return nil, openErr
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var recording Recording
+		parseErr := json.Unmarshal(line, &recording)
+		if parseErr != nil {
+			return nil, errors.New(fmt.Sprintf("parse recording with error: %+v, line: %s", parseErr, line))
+		}
+		recordings[recording.Key] = recording.Response
+	}
+	glog.Infof("load %d recordings from %s", len(recordings), path)
+	return recordings, scanner.Err()
+}
+
+func loadRules(path string, rules interface{}) error {
+	if len(path) == 0 {
+		return nil
+	}
+	file, openErr := os.Open(path)
+	if openErr != nil {
+		return openErr
+	}
+	defer file.Close()
+	return json.NewDecoder(file).Decode(rules)
+}
+
+func writeJson(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	encodeErr := json.NewEncoder(w).Encode(value)
+	if encodeErr != nil {
+		glog.Warningf("fake remote write response with error: %+v", encodeErr)
+	}
+}
+
+func writeRaw(w http.ResponseWriter, data json.RawMessage) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
@@ -0,0 +1,161 @@
+package fake
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// TextCategoryRule returns its categories for pages whose title or content contains the pattern, case-insensitive.
+type TextCategoryRule struct {
+	Pattern    string             `json:"pattern"`
+	FirstCats  map[string]float64 `json:"first_cat"`
+	SecondCats map[string]float64 `json:"second_cat"`
+	ThirdCats  map[string]float64 `json:"third_cat"`
+}
+
+// TextCategoryServer stands in for the text category dnn: recorded responses by page id or title first, then rules.
+type TextCategoryServer struct {
+	faultInjector
+	recordings map[string]json.RawMessage
+	rules      []TextCategoryRule
+}
+
+type textCategoryRequest struct {
+	Id         string `json:"id"`
+	SegTitle   string `json:"seg_title"`
+	SegContent string `json:"seg_content"`
+	Category   string `json:"category"`
+}
+
+type textCategoryResponse struct {
+	Tcats textCategoryCats `json:"text_category"`
+}
+
+type textCategoryCats struct {
+	FirstCats  map[string]float64 `json:"first_cat"`
+	SecondCats map[string]float64 `json:"second_cat"`
+	ThirdCats  map[string]float64 `json:"third_cat"`
+}
+
+func NewTextCategoryServer(recordings map[string]json.RawMessage, rules []TextCategoryRule) *TextCategoryServer {
+	if recordings == nil {
+		recordings = make(map[string]json.RawMessage)
+	}
+	return &TextCategoryServer{
+		recordings: recordings,
+		rules:      rules,
+	}
+}
+
+func LoadTextCategoryServer(recordingPath string, rulePath string) (*TextCategoryServer, error) {
+	recordings, recordErr := LoadRecordings(recordingPath)
+	if recordErr != nil {
+		return nil, recordErr
+	}
+	var rules []TextCategoryRule
+	ruleErr := loadRules(rulePath, &rules)
+	if ruleErr != nil {
+		return nil, ruleErr
+	}
+	return NewTextCategoryServer(recordings, rules), nil
+}
+
+func (s *TextCategoryServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.inject(w) {
+		return
+	}
+
+	body, readErr := ioutil.ReadAll(r.Body)
+	if readErr != nil {
+		http.Error(w, readErr.Error(), http.StatusBadRequest)
+		return
+	}
+	var req textCategoryRequest
+	parseErr := json.Unmarshal(body, &req)
+	if parseErr != nil {
+		http.Error(w, parseErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writeRaw(w, s.respond(&req))
+}
+
+// textCategoryBatchRequest and textCategoryBatchResponse are of the batch endpoint, results in the order of the pages.
+type textCategoryBatchRequest struct {
+	Pages []textCategoryRequest `json:"pages"`
+}
+
+type textCategoryBatchResult struct {
+	Id    string          `json:"id"`
+	Tcats json.RawMessage `json:"text_category"`
+}
+
+type textCategoryBatchResponse struct {
+	Results []textCategoryBatchResult `json:"results"`
+}
+
+// ServeBatch answers several pages per request, e.g. mounted on /tcat/batch.
+func (s *TextCategoryServer) ServeBatch(w http.ResponseWriter, r *http.Request) {
+	if s.inject(w) {
+		return
+	}
+
+	body, readErr := ioutil.ReadAll(r.Body)
+	if readErr != nil {
+		http.Error(w, readErr.Error(), http.StatusBadRequest)
+		return
+	}
+	var req textCategoryBatchRequest
+	parseErr := json.Unmarshal(body, &req)
+	if parseErr != nil {
+		http.Error(w, parseErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := textCategoryBatchResponse{Results: make([]textCategoryBatchResult, 0, len(req.Pages))}
+	for i := range req.Pages {
+		var single map[string]json.RawMessage
+		// a recording is a single response, its text_category is the batch result
+		json.Unmarshal(s.respond(&req.Pages[i]), &single)
+		resp.Results = append(resp.Results, textCategoryBatchResult{Id: req.Pages[i].Id, Tcats: single["text_category"]})
+	}
+	writeJson(w, resp)
+}
+
+func (s *TextCategoryServer) respond(req *textCategoryRequest) json.RawMessage {
+	for _, key := range []string{req.Id, req.SegTitle} {
+		recorded, ok := s.recordings[key]
+		if ok && len(key) != 0 {
+			return recorded
+		}
+	}
+
+	resp := textCategoryResponse{
+		Tcats: textCategoryCats{
+			FirstCats:  make(map[string]float64),
+			SecondCats: make(map[string]float64),
+			ThirdCats:  make(map[string]float64),
+		},
+	}
+	text := strings.ToLower(req.SegTitle + " " + req.SegContent + " " + req.Category)
+	for _, rule := range s.rules {
+		if !strings.Contains(text, strings.ToLower(rule.Pattern)) {
+			continue
+		}
+		mergeMax(resp.Tcats.FirstCats, rule.FirstCats)
+		mergeMax(resp.Tcats.SecondCats, rule.SecondCats)
+		mergeMax(resp.Tcats.ThirdCats, rule.ThirdCats)
+	}
+	data, _ := json.Marshal(resp)
+	return data
+}
+
+func mergeMax(dst map[string]float64, src map[string]float64) {
+	for name, score := range src {
+		if score > dst[name] {
+			dst[name] = score
+		}
+	}
+}
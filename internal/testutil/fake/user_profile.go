@@ -0,0 +1,329 @@
+package fake
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	user_profile_pb "github.com/ParticleMedia/fb_page_server/proto"
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/grpc-ecosystem/grpc-gateway/runtime"
+	"google.golang.org/grpc"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	OpSet    = "set"
+	OpDelete = "delete"
+)
+
+// UserProfileRecord is one profile written to or deleted from the fake server.
+type UserProfileRecord struct {
+	Op      string                        `json:"op"`
+	Uid     uint64                        `json:"uid"`
+	Name    string                        `json:"name"`
+	Version uint32                        `json:"version"`
+	Value   *user_profile_pb.ProfileValue `json:"value,omitempty"`
+	Time    int64                         `json:"time"`
+}
+
+// UserProfileServer is an in-memory UserProfileService, optionally persisted as a json file.
+type UserProfileServer struct {
+	user_profile_pb.UnimplementedUserProfileServiceServer
+
+	lock     sync.RWMutex
+	profiles map[uint64]map[profileKey]*user_profile_pb.ProfileValue
+	records  []UserProfileRecord
+	dumpPath string
+}
+
+type profileKey struct {
+	name    string
+	version uint32
+}
+
+type dumpItem struct {
+	Uid     uint64          `json:"uid"`
+	Name    string          `json:"name"`
+	Version uint32          `json:"version"`
+	Value   json.RawMessage `json:"value"`
+}
+
+func NewUserProfileServer(dumpPath string) (*UserProfileServer, error) {
+	server := &UserProfileServer{
+		profiles: make(map[uint64]map[profileKey]*user_profile_pb.ProfileValue),
+		dumpPath: dumpPath,
+	}
+	if len(dumpPath) == 0 {
+		return server, nil
+	}
+
+	data, readErr := ioutil.ReadFile(dumpPath)
+	if os.IsNotExist(readErr) {
+		return server, nil
+	} else if readErr != nil {
+		return nil, readErr
+	}
+	var items []dumpItem
+	parseErr := json.Unmarshal(data, &items)
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	for _, item := range items {
+		value := &user_profile_pb.ProfileValue{}
+		valueErr := jsonpb.UnmarshalString(string(item.Value), value)
+		if valueErr != nil {
+			return nil, valueErr
+		}
+		server.set(item.Uid, profileKey{name: item.Name, version: item.Version}, value)
+	}
+	glog.Infof("fake ups load %d profiles from %s", len(items), dumpPath)
+	return server, nil
+}
+
+func (s *UserProfileServer) Get(ctx context.Context, req *user_profile_pb.GetRequest) (*user_profile_pb.GetResponse, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return &user_profile_pb.GetResponse{
+		ProfileList: s.get(req.Uid, req.ProfileList),
+	}, nil
+}
+
+func (s *UserProfileServer) BatchGet(ctx context.Context, req *user_profile_pb.BatchGetRequest) (*user_profile_pb.BatchGetResponse, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	profiles := make([]*user_profile_pb.UserProfile, 0, len(req.Uids))
+	for _, uid := range req.Uids {
+		profiles = append(profiles, &user_profile_pb.UserProfile{
+			Uid:         uid,
+			ProfileList: s.get(uid, req.ProfileList),
+		})
+	}
+	return &user_profile_pb.BatchGetResponse{
+		Profiles: profiles,
+	}, nil
+}
+
+func (s *UserProfileServer) Set(ctx context.Context, req *user_profile_pb.SetRequest) (*user_profile_pb.SetResponse, error) {
+	if req.Profile == nil {
+		return &user_profile_pb.SetResponse{Status: -1, ErrMsg: "empty profile"}, nil
+	}
+	return &user_profile_pb.SetResponse{}, s.setProfiles([]*user_profile_pb.UserProfile{req.Profile})
+}
+
+func (s *UserProfileServer) BatchSet(ctx context.Context, req *user_profile_pb.BatchSetRequest) (*user_profile_pb.BatchSetResponse, error) {
+	return &user_profile_pb.BatchSetResponse{}, s.setProfiles(req.Profiles)
+}
+
+func (s *UserProfileServer) Delete(ctx context.Context, req *user_profile_pb.DeleteRequest) (*user_profile_pb.DeleteResponse, error) {
+	return &user_profile_pb.DeleteResponse{}, s.deleteProfiles([]uint64{req.Uid}, req.ProfileList)
+}
+
+func (s *UserProfileServer) BatchDelete(ctx context.Context, req *user_profile_pb.BatchDeleteRequest) (*user_profile_pb.BatchDeleteResponse, error) {
+	return &user_profile_pb.BatchDeleteResponse{}, s.deleteProfiles(req.Uids, req.ProfileList)
+}
+
+// Value returns the current value of a profile, nil if it does not exist.
+func (s *UserProfileServer) Value(uid uint64, name string, version uint32) *user_profile_pb.ProfileValue {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.profiles[uid][profileKey{name: name, version: version}]
+}
+
+// Records returns every set and delete in the order they were received.
+func (s *UserProfileServer) Records() []UserProfileRecord {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	records := make([]UserProfileRecord, len(s.records))
+	copy(records, s.records)
+	return records
+}
+
+func (s *UserProfileServer) get(uid uint64, ids []*user_profile_pb.ProfileIdentity) []*user_profile_pb.ProfileItem {
+	items := make([]*user_profile_pb.ProfileItem, 0, len(ids))
+	for _, id := range ids {
+		value, ok := s.profiles[uid][profileKey{name: id.Name, version: id.Version}]
+		if !ok {
+			continue
+		}
+		items = append(items, &user_profile_pb.ProfileItem{
+			Id:    &user_profile_pb.ProfileIdentity{Name: id.Name, Version: id.Version},
+			Value: value,
+		})
+	}
+	return items
+}
+
+func (s *UserProfileServer) set(uid uint64, id profileKey, value *user_profile_pb.ProfileValue) {
+	values, ok := s.profiles[uid]
+	if !ok {
+		values = make(map[profileKey]*user_profile_pb.ProfileValue)
+		s.profiles[uid] = values
+	}
+	values[id] = value
+}
+
+func (s *UserProfileServer) setProfiles(profiles []*user_profile_pb.UserProfile) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, profile := range profiles {
+		for _, item := range profile.ProfileList {
+			if item.Id == nil || item.Value == nil {
+				return errors.New("profile item without id or value")
+			}
+			id := profileKey{name: item.Id.Name, version: item.Id.Version}
+			s.set(profile.Uid, id, item.Value)
+			s.records = append(s.records, UserProfileRecord{
+				Op:      OpSet,
+				Uid:     profile.Uid,
+				Name:    id.name,
+				Version: id.version,
+				Value:   item.Value,
+				Time:    time.Now().UnixNano(),
+			})
+			glog.V(2).Infof("fake ups set, uid: %d, profile: %s, value: %s", profile.Uid, id.name, item.Value.String())
+		}
+	}
+	return s.dump()
+}
+
+func (s *UserProfileServer) deleteProfiles(uids []uint64, ids []*user_profile_pb.ProfileIdentity) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, uid := range uids {
+		for _, id := range ids {
+			delete(s.profiles[uid], profileKey{name: id.Name, version: id.Version})
+			s.records = append(s.records, UserProfileRecord{
+				Op:      OpDelete,
+				Uid:     uid,
+				Name:    id.Name,
+				Version: id.Version,
+				Time:    time.Now().UnixNano(),
+			})
+			glog.V(2).Infof("fake ups delete, uid: %d, profile: %s", uid, id.Name)
+		}
+		if len(s.profiles[uid]) == 0 {
+			delete(s.profiles, uid)
+		}
+	}
+	return s.dump()
+}
+
+func (s *UserProfileServer) items() []dumpItem {
+	items := make([]dumpItem, 0, len(s.profiles))
+	marshaler := jsonpb.Marshaler{OrigName: true}
+	for uid, values := range s.profiles {
+		for id, value := range values {
+			data, _ := marshaler.MarshalToString(value)
+			items = append(items, dumpItem{Uid: uid, Name: id.name, Version: id.version, Value: json.RawMessage(data)})
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Uid != items[j].Uid {
+			return items[i].Uid < items[j].Uid
+		}
+		return items[i].Name < items[j].Name
+	})
+	return items
+}
+
+func (s *UserProfileServer) dump() error {
+	if len(s.dumpPath) == 0 {
+		return nil
+	}
+	data, encodeErr := json.MarshalIndent(s.items(), "", "  ")
+	if encodeErr != nil {
+		return encodeErr
+	}
+	return ioutil.WriteFile(s.dumpPath, data, 0644)
+}
+
+// ServeHTTP lists every profile, or the profiles of ?uid=, as json.
+func (s *UserProfileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.RLock()
+	items := s.items()
+	s.lock.RUnlock()
+
+	uidParam := r.URL.Query().Get("uid")
+	if len(uidParam) != 0 {
+		uid, parseErr := strconv.ParseUint(uidParam, 10, 64)
+		if parseErr != nil {
+			http.Error(w, parseErr.Error(), http.StatusBadRequest)
+			return
+		}
+		filtered := make([]dumpItem, 0)
+		for _, item := range items {
+			if item.Uid == uid {
+				filtered = append(filtered, item)
+			}
+		}
+		items = filtered
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(items)
+}
+
+// Serve runs the grpc service on grpcAddr and, if httpAddr is not empty, its http gateway plus /dump on httpAddr.
+// It returns when ctx is done.
+func (s *UserProfileServer) Serve(ctx context.Context, grpcAddr string, httpAddr string) error {
+	listener, listenErr := net.Listen("tcp", grpcAddr)
+	if listenErr != nil {
+		return listenErr
+	}
+	return s.ServeListener(ctx, listener, httpAddr)
+}
+
+// ServeListener is Serve on an existing listener, e.g. 127.0.0.1:0 to pick a free port.
+func (s *UserProfileServer) ServeListener(ctx context.Context, listener net.Listener, httpAddr string) error {
+	grpcServer := grpc.NewServer()
+	user_profile_pb.RegisterUserProfileServiceServer(grpcServer, s)
+	go func() {
+		<-ctx.Done()
+		grpcServer.GracefulStop()
+	}()
+
+	if len(httpAddr) != 0 {
+		conn, dialErr := grpc.DialContext(ctx, listener.Addr().String(), grpc.WithInsecure())
+		if dialErr != nil {
+			return dialErr
+		}
+		defer conn.Close()
+
+		gatewayMux := runtime.NewServeMux(runtime.WithMarshalerOption(runtime.MIMEWildcard, &runtime.JSONPb{OrigName: true}))
+		registerErr := user_profile_pb.RegisterUserProfileServiceHandler(ctx, gatewayMux, conn)
+		if registerErr != nil {
+			return registerErr
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/dump", s)
+		mux.Handle("/", gatewayMux)
+		httpServer := &http.Server{Addr: httpAddr, Handler: mux}
+		go func() {
+			<-ctx.Done()
+			httpServer.Close()
+		}()
+		go func() {
+			serveErr := httpServer.ListenAndServe()
+			if serveErr != nil && serveErr != http.ErrServerClosed {
+				glog.Warningf("fake ups http serve with error: %+v", serveErr)
+			}
+		}()
+		glog.Infof("fake ups http gateway listen on %s", httpAddr)
+	}
+
+	glog.Infof("fake ups grpc listen on %s", listener.Addr().String())
+	return grpcServer.Serve(listener)
+}
@@ -0,0 +1,68 @@
+package harness
+
+import (
+	"encoding/json"
+	"github.com/Shopify/sarama"
+	cluster "github.com/bsm/sarama-cluster"
+	"sync"
+)
+
+// consumer is a server.KafkaConsumer which delivers the given messages once, then a tombstone of every key, and closes.
+type consumer struct {
+	messages      chan *sarama.ConsumerMessage
+	errors        chan error
+	notifications chan *cluster.Notification
+
+	lock   sync.Mutex
+	marked int
+}
+
+func newConsumer(values []json.RawMessage, tombstones []string) *consumer {
+	c := &consumer{
+		messages:      make(chan *sarama.ConsumerMessage, len(values)+len(tombstones)),
+		errors:        make(chan error),
+		notifications: make(chan *cluster.Notification),
+	}
+	for offset, value := range values {
+		c.messages <- &sarama.ConsumerMessage{
+			Topic:  "e2e",
+			Offset: int64(offset),
+			Value:  []byte(value),
+		}
+	}
+	for i, key := range tombstones {
+		c.messages <- &sarama.ConsumerMessage{
+			Topic:  "e2e",
+			Offset: int64(len(values) + i),
+			Key:    []byte(key),
+		}
+	}
+	close(c.messages)
+	close(c.errors)
+	close(c.notifications)
+	return c
+}
+
+func (c *consumer) Messages() <-chan *sarama.ConsumerMessage {
+	return c.messages
+}
+
+func (c *consumer) Errors() <-chan error {
+	return c.errors
+}
+
+func (c *consumer) Notifications() <-chan *cluster.Notification {
+	return c.notifications
+}
+
+func (c *consumer) MarkOffset(msg *sarama.ConsumerMessage, metadata string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.marked += 1
+}
+
+func (c *consumer) Marked() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.marked
+}
@@ -0,0 +1,336 @@
+package harness
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ParticleMedia/fb_page_server/common"
+	"github.com/ParticleMedia/fb_page_server/internal/testutil/fake"
+	"github.com/ParticleMedia/fb_page_server/remote"
+	"github.com/ParticleMedia/fb_page_server/server"
+	"github.com/golang/protobuf/jsonpb"
+	"go.mongodb.org/mongo-driver/bson"
+	yaml "gopkg.in/yaml.v3"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// Case is one end-to-end fixture: the messages fed through the consumer, the fake classifiers and cached pages
+// they run against, and the exact ups writes and page store documents expected afterwards.
+type Case struct {
+	Name string `json:"name"`
+	// overrides of config.yaml, e.g. {"incremental": {"enable": true}}
+	Config           json.RawMessage                       `json:"config"`
+	TcatRules        []fake.TextCategoryRule               `json:"tcat_rules"`
+	KeywordRules     []fake.KeywordRule                    `json:"keyword_rules"`
+	KeywordDimension int                                   `json:"keyword_dimension"`
+	TcatFaults       fake.FaultConfig                      `json:"tcat_faults"`
+	KeywordFaults    fake.FaultConfig                      `json:"keyword_faults"`
+	Store            map[string]map[string]json.RawMessage `json:"store"`
+	Messages         []json.RawMessage                     `json:"messages"`
+	// kafka keys delivered as tombstones after the messages
+	Tombstones []string   `json:"tombstones"`
+	ExpectUps  []UpsWrite `json:"expect_ups"`
+	// messages which fail and must not be acked, so they are consumed again
+	ExpectUnacked int `json:"expect_unacked"`
+	// collection -> _id -> fields the document must have, null if the document must not exist
+	ExpectStore map[string]map[string]json.RawMessage `json:"expect_store"`
+	// text_category or keyword -> requests the fake service must receive, unchecked if absent
+	ExpectRequests map[string]int64 `json:"expect_requests"`
+}
+
+// UpsWrite is a set or delete received by the fake ups, value is the ProfileValue as json.
+type UpsWrite struct {
+	Op    string          `json:"op"`
+	Uid   uint64          `json:"uid"`
+	Name  string          `json:"name"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+type Result struct {
+	Name     string
+	Failures []string
+	Duration time.Duration
+	Ups      []UpsWrite
+}
+
+func (r *Result) Passed() bool {
+	return len(r.Failures) == 0
+}
+
+func (r *Result) failf(format string, args ...interface{}) {
+	r.Failures = append(r.Failures, fmt.Sprintf(format, args...))
+}
+
+// Harness runs cases against in-process fakes: a channel-fed consumer, an in-memory page store,
+// a fake ups on a local port and fake text category and keyword services.
+// The remote package keeps global state, so cases run one at a time.
+type Harness struct {
+	Dir string
+}
+
+// New returns a harness for dir, which holds config.yaml, the channel model under model/ and the cases under cases/.
+func New(dir string) *Harness {
+	return &Harness{Dir: dir}
+}
+
+func (h *Harness) LoadCases() ([]*Case, error) {
+	paths, globErr := filepath.Glob(filepath.Join(h.Dir, "cases", "*.json"))
+	if globErr != nil {
+		return nil, globErr
+	}
+	sort.Strings(paths)
+	cases := make([]*Case, 0, len(paths))
+	for _, path := range paths {
+		data, readErr := ioutil.ReadFile(path)
+		if readErr != nil {
+			return nil, readErr
+		}
+		var c Case
+		parseErr := json.Unmarshal(data, &c)
+		if parseErr != nil {
+			return nil, errors.New(fmt.Sprintf("parse case %s with error: %+v", path, parseErr))
+		}
+		if len(c.Name) == 0 {
+			c.Name = filepath.Base(path)
+		}
+		cases = append(cases, &c)
+	}
+	return cases, nil
+}
+
+func (h *Harness) loadConfig(c *Case) (*common.Config, error) {
+	data, readErr := ioutil.ReadFile(filepath.Join(h.Dir, "config.yaml"))
+	if readErr != nil {
+		return nil, readErr
+	}
+	conf := &common.Config{}
+	parseErr := yaml.Unmarshal(data, conf)
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	// json is yaml, only the fields present in the case are overridden
+	if len(c.Config) != 0 {
+		overrideErr := yaml.Unmarshal(c.Config, conf)
+		if overrideErr != nil {
+			return nil, overrideErr
+		}
+	}
+	return conf, conf.Validate()
+}
+
+func (h *Harness) Run(c *Case) *Result {
+	result := &Result{Name: c.Name}
+	start := time.Now()
+	defer func() {
+		result.Duration = time.Since(start)
+	}()
+
+	conf, confErr := h.loadConfig(c)
+	if confErr != nil {
+		result.failf("load config with error: %+v", confErr)
+		return result
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// fake ups on a free local port
+	ups, upsErr := fake.NewUserProfileServer("")
+	if upsErr != nil {
+		result.failf("create fake ups with error: %+v", upsErr)
+		return result
+	}
+	listener, listenErr := net.Listen("tcp", "127.0.0.1:0")
+	if listenErr != nil {
+		result.failf("listen fake ups with error: %+v", listenErr)
+		return result
+	}
+	serveDone := make(chan struct{})
+	go func() {
+		defer close(serveDone)
+		ups.ServeListener(ctx, listener, "")
+	}()
+	defer func() {
+		cancel()
+		<-serveDone
+	}()
+	conf.UpsConf.Addr = listener.Addr().String()
+
+	// fake classifiers
+	tcat := fake.NewTextCategoryServer(nil, c.TcatRules)
+	tcat.SetFaults(c.TcatFaults)
+	tcatMux := http.NewServeMux()
+	tcatMux.Handle("/", tcat)
+	tcatMux.HandleFunc("/batch", tcat.ServeBatch)
+	tcatServer := httptest.NewServer(tcatMux)
+	defer tcatServer.Close()
+	conf.TcatConf.Uri = tcatServer.URL
+	conf.TcatConf.BatchUri = tcatServer.URL + "/batch"
+	keyword := fake.NewKeywordServer(nil, c.KeywordRules, c.KeywordDimension)
+	keyword.SetFaults(c.KeywordFaults)
+	keywordServer := httptest.NewServer(keyword)
+	defer keywordServer.Close()
+	conf.ChnConf.Uri = keywordServer.URL
+
+	// in-memory page store with the cached pages of the case
+	store := fake.NewPageStore()
+	for collection, documents := range c.Store {
+		for key, document := range documents {
+			var value bson.D
+			parseErr := bson.UnmarshalExtJSON(document, false, &value)
+			if parseErr != nil {
+				result.failf("parse store document %s/%s with error: %+v", collection, key, parseErr)
+				return result
+			}
+			store.Replace(ctx, collection, key, value)
+		}
+	}
+	remote.SetPageStore(store)
+
+	remote.SetChannelModelDir(filepath.Join(h.Dir, "model"))
+	chnErr := remote.LoadChannels()
+	if chnErr != nil {
+		result.failf("load channel model with error: %+v", chnErr)
+		return result
+	}
+	encodingErr := remote.SetDefaultEncoding(&conf.UpsConf)
+	if encodingErr != nil {
+		result.failf("set default encoding with error: %+v", encodingErr)
+		return result
+	}
+	remote.InitBreakers(&conf.BreakerConf)
+	remote.InitLimiters(&conf.LimitConf)
+	processorErr := remote.InitProcessors(conf)
+	if processorErr != nil {
+		result.failf("init processors with error: %+v", processorErr)
+		return result
+	}
+
+	consumer := newConsumer(c.Messages, c.Tombstones)
+	server.Run(server.NewKafkaSource(consumer), nil, conf)
+	if want := len(c.Messages) + len(c.Tombstones) - c.ExpectUnacked; consumer.Marked() != want {
+		result.failf("marked %d of %d messages, want %d", consumer.Marked(), len(c.Messages)+len(c.Tombstones), want)
+	}
+
+	result.Ups = upsWrites(ups.Records())
+	h.checkUps(result, c.ExpectUps)
+	h.checkStore(result, store, c.ExpectStore)
+	requests := map[string]int64{
+		"text_category": tcat.Requests(),
+		"keyword":       keyword.Requests(),
+	}
+	for service, want := range c.ExpectRequests {
+		got, ok := requests[service]
+		if !ok {
+			result.failf("unknown service of expect_requests: %s", service)
+		} else if got != want {
+			result.failf("%s requests: got %d, want %d", service, got, want)
+		}
+	}
+	return result
+}
+
+// upsWrites orders the records by uid and profile, keeping the received order of each profile,
+// since processors of one message write concurrently.
+func upsWrites(records []fake.UserProfileRecord) []UpsWrite {
+	marshaler := jsonpb.Marshaler{OrigName: true}
+	writes := make([]UpsWrite, 0, len(records))
+	for _, record := range records {
+		write := UpsWrite{Op: record.Op, Uid: record.Uid, Name: record.Name}
+		if record.Value != nil {
+			data, _ := marshaler.MarshalToString(record.Value)
+			write.Value = json.RawMessage(data)
+		}
+		writes = append(writes, write)
+	}
+	sort.SliceStable(writes, func(i, j int) bool {
+		if writes[i].Uid != writes[j].Uid {
+			return writes[i].Uid < writes[j].Uid
+		}
+		return writes[i].Name < writes[j].Name
+	})
+	return writes
+}
+
+func (h *Harness) checkUps(result *Result, expected []UpsWrite) {
+	actual := result.Ups
+	if len(actual) != len(expected) {
+		result.failf("ups writes: got %d, want %d", len(actual), len(expected))
+	}
+	for i := 0; i < len(actual) || i < len(expected); i++ {
+		switch {
+		case i >= len(expected):
+			result.failf("ups write %d unexpected: %s", i, formatWrite(&actual[i]))
+		case i >= len(actual):
+			result.failf("ups write %d missing: %s", i, formatWrite(&expected[i]))
+		default:
+			got, want := &actual[i], &expected[i]
+			if got.Op != want.Op || got.Uid != want.Uid || got.Name != want.Name || !jsonEqual(got.Value, want.Value) {
+				result.failf("ups write %d: got %s, want %s", i, formatWrite(got), formatWrite(want))
+			}
+		}
+	}
+}
+
+func (h *Harness) checkStore(result *Result, store *fake.PageStore, expected map[string]map[string]json.RawMessage) {
+	for collection, documents := range expected {
+		for key, want := range documents {
+			raw, findErr := store.Find(context.Background(), collection, key)
+			if isNull(want) {
+				if findErr == nil {
+					result.failf("store %s/%s should not exist, got %s", collection, key, raw.String())
+				}
+				continue
+			}
+			if findErr != nil {
+				result.failf("store %s/%s: %+v", collection, key, findErr)
+				continue
+			}
+			data, encodeErr := bson.MarshalExtJSON(raw, false, false)
+			if encodeErr != nil {
+				result.failf("store %s/%s encode with error: %+v", collection, key, encodeErr)
+				continue
+			}
+			var gotFields, wantFields map[string]json.RawMessage
+			json.Unmarshal(data, &gotFields)
+			parseErr := json.Unmarshal(want, &wantFields)
+			if parseErr != nil {
+				result.failf("store %s/%s parse expected with error: %+v", collection, key, parseErr)
+				continue
+			}
+			for field, wantValue := range wantFields {
+				if !jsonEqual(gotFields[field], wantValue) {
+					result.failf("store %s/%s field %s: got %s, want %s", collection, key, field, gotFields[field], wantValue)
+				}
+			}
+		}
+	}
+}
+
+func formatWrite(write *UpsWrite) string {
+	data, _ := json.Marshal(write)
+	return string(data)
+}
+
+func isNull(data json.RawMessage) bool {
+	return len(data) == 0 || string(data) == "null"
+}
+
+func jsonEqual(x json.RawMessage, y json.RawMessage) bool {
+	if isNull(x) || isNull(y) {
+		return isNull(x) == isNull(y)
+	}
+	var xValue, yValue interface{}
+	if json.Unmarshal(x, &xValue) != nil || json.Unmarshal(y, &yValue) != nil {
+		return false
+	}
+	return reflect.DeepEqual(xValue, yValue)
+}
@@ -2,10 +2,12 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"github.com/ParticleMedia/fb_page_server/common"
 	"github.com/ParticleMedia/fb_page_server/remote"
 	"github.com/ParticleMedia/fb_page_server/server"
 	"github.com/golang/glog"
+	"os"
 )
 
 const (
@@ -13,6 +15,8 @@ const (
 )
 
 var configFile = flag.String("conf", defaultConfigPath, "path of config")
+var sourceType = flag.String("source", "", "override source.type: kafka, file, dir or stdin")
+var sourcePath = flag.String("source_path", "", "override source.path, the json lines file or the dir to watch")
 
 func InitGlobalResources() (error) {
 	confErr := common.LoadConfig(*configFile)
@@ -21,6 +25,12 @@ func InitGlobalResources() (error) {
 		return confErr
 	}
 	glog.Infof("load config success from file: %+v", *configFile)
+	if len(*sourceType) != 0 {
+		common.FBConfig.SourceConf.Type = *sourceType
+	}
+	if len(*sourcePath) != 0 {
+		common.FBConfig.SourceConf.Path = *sourcePath
+	}
 
 	server.InitClusterConfig(&common.FBConfig.KafkaConf)
 
@@ -38,9 +48,23 @@ func InitGlobalResources() (error) {
 	}
 	glog.Infof("connect success to mogodb: %s", common.FBConfig.MongoConf.Addr)
 
-	remote.SetValueType(&common.FBConfig.UpsConf)
+	encodingErr := remote.SetDefaultEncoding(&common.FBConfig.UpsConf)
+	if encodingErr != nil {
+		glog.Warningf("set default encoding with error: %+v", encodingErr)
+		return encodingErr
+	}
+	remote.InitBreakers(&common.FBConfig.BreakerConf)
+	remote.InitLimiters(&common.FBConfig.LimitConf)
+
+	processorErr := remote.InitProcessors(common.FBConfig)
+	if processorErr != nil {
+		glog.Warningf("init processors with error: %+v", processorErr)
+		return processorErr
+	}
+	for _, processor := range remote.EnabledProcessors() {
+		glog.Infof("enable processor: %s, profile: %s", processor.Name(), processor.Config().Profile)
+	}
 
-	common.Wg.Add(1)
 	return nil
 }
 
@@ -53,15 +77,39 @@ func ReleaseGlobalResources() {
 	}
 }
 
-func main()  {
-	flag.Parse()
-
+func runServer() {
 	initErr := InitGlobalResources()
 	if initErr != nil {
 		panic(initErr)
 	}
 
+	server.StartHealthServer(&common.FBConfig.HealthConf)
+	common.Wg.Add(1)
 	go server.Consume()
 
 	ReleaseGlobalResources()
 }
+
+func main()  {
+	flag.Parse()
+
+	command := flag.Arg(0)
+	var commandErr error
+	switch command {
+	case "", "serve":
+		runServer()
+	case "backfill":
+		commandErr = runBackfill(flag.Args()[1:])
+	case "classify":
+		commandErr = runClassify(flag.Args()[1:])
+	case "eval":
+		commandErr = runEval(flag.Args()[1:])
+	default:
+		commandErr = fmt.Errorf("unknown command: %s, supported: serve, backfill, classify, eval", command)
+	}
+	glog.Flush()
+	if commandErr != nil {
+		fmt.Fprintf(os.Stderr, "%s: %+v\n", command, commandErr)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,188 @@
+package remote
+
+import (
+	"context"
+	"github.com/ParticleMedia/fb_page_server/common"
+	"github.com/golang/glog"
+	"go.mongodb.org/mongo-driver/mongo"
+	"math"
+	"sort"
+	"time"
+)
+
+const minPopularityWeight = 0.05
+
+type PageFeature struct {
+	Page    *common.FBPage
+	Feature Feature
+}
+
+// aggregateFeatures computes the weighted average of every level, then truncates and normalizes it.
+// With a zero AggregationConfig every page has weight 1, which is the plain average.
+func aggregateFeatures(features []PageFeature, conf *common.AggregationConfig, popularity *pagePopularity) Feature {
+	now := time.Now()
+	totalWeight := 0.0
+	total := make(Feature)
+	for _, pageFeature := range features {
+		weight := pageWeight(pageFeature.Page, conf, popularity, now)
+		totalWeight += weight
+		for level, scores := range pageFeature.Feature {
+			totalScores, ok := total[level]
+			if !ok {
+				totalScores = make(map[string]float64)
+				total[level] = totalScores
+			}
+			for name, score := range scores {
+				totalScores[name] += weight * score
+			}
+		}
+	}
+	if totalWeight <= 0 {
+		return make(Feature)
+	}
+
+	for level, scores := range total {
+		for name, score := range scores {
+			scores[name] = score / totalWeight
+		}
+		scores = truncateScores(scores, conf.TopK)
+		normalizeScores(scores, conf.Normalize)
+		total[level] = scores
+	}
+	return total
+}
+
+func pageWeight(page *common.FBPage, conf *common.AggregationConfig, popularity *pagePopularity, now time.Time) float64 {
+	weight := 1.0
+	if page == nil {
+		return weight
+	}
+
+	// 按点赞时间指数衰减，半衰期单位为天
+	if conf.DecayHalfLife > 0 {
+		likedTime, timeErr := page.LikedTime()
+		if timeErr == nil && likedTime.Before(now) {
+			ageDays := now.Sub(likedTime).Hours() / 24
+			weight *= math.Pow(0.5, ageDays/conf.DecayHalfLife)
+		}
+	}
+
+	if conf.Popularity {
+		weight *= popularity.weight(page.Id)
+	}
+	return weight
+}
+
+// pagePopularity is how often pages appear across the user states, for the idf weight of the pages.
+// A nil pagePopularity weights every page 1.
+type pagePopularity struct {
+	// user states in total
+	users float64
+	// page id -> user states containing the page
+	pages map[string]int64
+}
+
+// loadPagePopularity reads the user counts of the pages kept with the incremental user states,
+// nil if the counts can not be read, so the pages are not weighted instead of failing the profile.
+func loadPagePopularity(ctx context.Context, pageIds []string, conf *common.Config) *pagePopularity {
+	if len(pageIds) == 0 {
+		return nil
+	}
+	users, countErr := pageStore.Count(ctx, conf.IncrConf.Collection)
+	if countErr != nil {
+		glog.Warningf("count user states with error: %+v", countErr)
+		return nil
+	}
+	popularity := &pagePopularity{
+		users: float64(users),
+		pages: make(map[string]int64, len(pageIds)),
+	}
+	for _, pageId := range pageIds {
+		raw, findErr := pageStore.Find(ctx, conf.IncrConf.PageRefCollection, pageId)
+		if findErr == mongo.ErrNoDocuments {
+			continue
+		} else if findErr != nil {
+			glog.Warningf("find page users with error: %+v, page: %s", findErr, pageId)
+			return nil
+		}
+		pageUsers, _ := raw.Lookup("users").Int64OK()
+		popularity.pages[pageId] = pageUsers
+	}
+	return popularity
+}
+
+// weight is log(users / (1 + page users)) / log(users) like idf, in [minPopularityWeight, 1].
+func (p *pagePopularity) weight(pageId string) float64 {
+	if p == nil || p.users <= 1 {
+		return 1
+	}
+	idf := math.Log(p.users / (1 + float64(p.pages[pageId])))
+	popularityWeight := idf / math.Log(p.users)
+	if popularityWeight < minPopularityWeight {
+		popularityWeight = minPopularityWeight
+	} else if popularityWeight > 1 {
+		popularityWeight = 1
+	}
+	return popularityWeight
+}
+
+// featurePageIds returns the ids of the pages of features, for loadPagePopularity.
+func featurePageIds(features []PageFeature) []string {
+	pageIds := make([]string, 0, len(features))
+	for _, pageFeature := range features {
+		if pageFeature.Page != nil {
+			pageIds = append(pageIds, pageFeature.Page.Id)
+		}
+	}
+	return pageIds
+}
+
+func truncateScores(scores map[string]float64, topK int) map[string]float64 {
+	if topK <= 0 || len(scores) <= topK {
+		return scores
+	}
+	names := sortedNames(scores)
+	truncated := make(map[string]float64, topK)
+	for _, name := range names[:topK] {
+		truncated[name] = scores[name]
+	}
+	return truncated
+}
+
+func normalizeScores(scores map[string]float64, normalize string) {
+	norm := 0.0
+	// 未知的normalize在加载配置时已被拒绝
+	switch normalize {
+	case common.NormalizeL1:
+		for _, score := range scores {
+			norm += math.Abs(score)
+		}
+	case common.NormalizeMax:
+		for _, score := range scores {
+			norm = math.Max(norm, math.Abs(score))
+		}
+	default:
+		return
+	}
+	if norm == 0 {
+		return
+	}
+	for name, score := range scores {
+		scores[name] = score / norm
+	}
+}
+
+// sortedNames sorts names by score desc, and by name for equal scores.
+func sortedNames(scores map[string]float64) []string {
+	names := make([]string, 0, len(scores))
+	for name := range scores {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if scores[names[i]] != scores[names[j]] {
+			return scores[names[i]] > scores[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
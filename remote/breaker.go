@@ -0,0 +1,321 @@
+package remote
+
+import (
+	"context"
+	"errors"
+	"github.com/ParticleMedia/fb_page_server/common"
+	"github.com/golang/glog"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	BreakerTextCategory = "text_category"
+	BreakerKeyword      = "keyword"
+	BreakerTopicModel   = "topic_model"
+	BreakerMongo        = "mongo"
+	BreakerUps          = "user_profile"
+)
+
+type BreakerState string
+
+const (
+	BreakerClosed   BreakerState = "closed"
+	BreakerOpen     BreakerState = "open"
+	BreakerHalfOpen BreakerState = "half_open"
+)
+
+// breakerBucket counts the calls of one second of the window.
+type breakerBucket struct {
+	second   int64
+	requests int64
+	failures int64
+	slow     int64
+}
+
+// Breaker stops calling a remote dependency while it fails, so the workers do not wait on every page.
+// A nil Breaker allows every call.
+type Breaker struct {
+	name string
+	conf common.BreakerConfig
+
+	lock     sync.Mutex
+	state    BreakerState
+	buckets  []breakerBucket
+	openedAt time.Time
+	// calls let through and succeeded in half open
+	probing   int64
+	succeeded int64
+
+	// totals since start, for the metrics
+	requests      int64
+	failures      int64
+	slow          int64
+	rejected      int64
+	opened        int64
+	lastChangedAt time.Time
+}
+
+type BreakerStats struct {
+	Name          string       `json:"name"`
+	State         BreakerState `json:"state"`
+	Requests      int64        `json:"requests"`
+	Failures      int64        `json:"failures"`
+	Slow          int64        `json:"slow"`
+	Rejected      int64        `json:"rejected"`
+	Opened        int64        `json:"opened"`
+	LastChangedAt int64        `json:"last_changed_at"`
+}
+
+func NewBreaker(name string, conf common.BreakerConfig) *Breaker {
+	if conf.Window <= 0 {
+		conf.Window = 60
+	}
+	if conf.OpenTime <= 0 {
+		conf.OpenTime = 30
+	}
+	if conf.HalfOpenProbes <= 0 {
+		conf.HalfOpenProbes = 1
+	}
+	return &Breaker{
+		name:          name,
+		conf:          conf,
+		state:         BreakerClosed,
+		buckets:       make([]breakerBucket, conf.Window),
+		lastChangedAt: time.Now(),
+	}
+}
+
+// Allow returns a RemoteError of kind RemoteBreakerOpen if the call should not be made,
+// otherwise the caller makes the call and reports it with Record.
+func (b *Breaker) Allow() error {
+	if b == nil {
+		return nil
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+	if b.state == BreakerOpen && now.Sub(b.openedAt) >= time.Duration(b.conf.OpenTime)*time.Second {
+		b.setState(BreakerHalfOpen, now)
+	}
+	switch b.state {
+	case BreakerOpen:
+		b.rejected += 1
+		return &RemoteError{Service: b.name, Kind: RemoteBreakerOpen, Err: errBreakerOpen}
+	case BreakerHalfOpen:
+		if b.probing >= b.conf.HalfOpenProbes {
+			b.rejected += 1
+			return &RemoteError{Service: b.name, Kind: RemoteBreakerOpen, Err: errBreakerOpen}
+		}
+		b.probing += 1
+	}
+	return nil
+}
+
+// Record reports a call let through by Allow, failed is decided by the caller, e.g. a missing mongo document is not a failure.
+func (b *Breaker) Record(failed bool, latency time.Duration) {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+	slow := b.conf.SlowCall > 0 && latency >= time.Duration(b.conf.SlowCall)*time.Millisecond
+	b.requests += 1
+	if failed {
+		b.failures += 1
+	}
+	if slow {
+		b.slow += 1
+	}
+
+	switch b.state {
+	case BreakerHalfOpen:
+		// 半开状态下任何一次探测失败都重新打开
+		if failed || slow {
+			b.open(now)
+			return
+		}
+		b.succeeded += 1
+		if b.succeeded >= b.conf.HalfOpenProbes {
+			b.setState(BreakerClosed, now)
+		}
+	case BreakerClosed:
+		bucket := b.bucket(now)
+		bucket.requests += 1
+		if failed {
+			bucket.failures += 1
+		}
+		if slow {
+			bucket.slow += 1
+		}
+		if b.shouldOpen(now) {
+			b.open(now)
+		}
+	}
+}
+
+// cancel gives back a call let through by Allow which is not made, so it is not counted as a half open probe.
+func (b *Breaker) cancel() {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.state == BreakerHalfOpen && b.probing > 0 {
+		b.probing -= 1
+	}
+}
+
+// finish records a call let through by Allow, or cancels it if ctx is cancelled meanwhile:
+// the caller gave up, neither the error nor the cost tells anything of the dependency.
+// A call still running at the deadline of ctx is a failure, the dependency was too slow.
+func (b *Breaker) finish(ctx context.Context, failed bool, cost time.Duration) {
+	ctxErr := ctx.Err()
+	if ctxErr == context.Canceled {
+		b.cancel()
+		return
+	}
+	b.Record(failed || ctxErr == context.DeadlineExceeded, cost)
+}
+
+// Call runs fn if the breaker allows it, failed tells which errors of fn count as failures.
+func (b *Breaker) Call(ctx context.Context, fn func() error, failed func(err error) bool) error {
+	allowErr := b.Allow()
+	if allowErr != nil {
+		return allowErr
+	}
+	start := time.Now()
+	err := fn()
+	b.finish(ctx, err != nil && failed(err), time.Since(start))
+	return err
+}
+
+func (b *Breaker) State() BreakerState {
+	if b == nil {
+		return BreakerClosed
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= time.Duration(b.conf.OpenTime)*time.Second {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+func (b *Breaker) Stats() BreakerStats {
+	state := b.State()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return BreakerStats{
+		Name:          b.name,
+		State:         state,
+		Requests:      b.requests,
+		Failures:      b.failures,
+		Slow:          b.slow,
+		Rejected:      b.rejected,
+		Opened:        b.opened,
+		LastChangedAt: b.lastChangedAt.Unix(),
+	}
+}
+
+func (b *Breaker) bucket(now time.Time) *breakerBucket {
+	second := now.Unix()
+	bucket := &b.buckets[second%int64(len(b.buckets))]
+	if bucket.second != second {
+		*bucket = breakerBucket{second: second}
+	}
+	return bucket
+}
+
+func (b *Breaker) shouldOpen(now time.Time) bool {
+	var requests, failures, slow int64
+	oldest := now.Unix() - int64(len(b.buckets))
+	for _, bucket := range b.buckets {
+		if bucket.second <= oldest {
+			continue
+		}
+		requests += bucket.requests
+		failures += bucket.failures
+		slow += bucket.slow
+	}
+	if requests == 0 || requests < b.conf.MinRequests {
+		return false
+	}
+	if b.conf.ErrorRate > 0 && float64(failures)/float64(requests) >= b.conf.ErrorRate {
+		return true
+	}
+	return b.conf.SlowRate > 0 && float64(slow)/float64(requests) >= b.conf.SlowRate
+}
+
+func (b *Breaker) open(now time.Time) {
+	b.openedAt = now
+	b.opened += 1
+	b.setState(BreakerOpen, now)
+}
+
+func (b *Breaker) setState(state BreakerState, now time.Time) {
+	glog.Warningf("breaker %s %s -> %s", b.name, b.state, state)
+	b.state = state
+	b.lastChangedAt = now
+	b.probing = 0
+	b.succeeded = 0
+	for i := range b.buckets {
+		b.buckets[i] = breakerBucket{}
+	}
+}
+
+var breakerLock sync.RWMutex
+var breakers = make(map[string]*Breaker)
+
+// InitBreakers replaces the breakers with the enabled ones of conf, the others allow every call.
+func InitBreakers(conf *common.BreakersConfig) {
+	newBreakers := make(map[string]*Breaker)
+	for name, breakerConf := range map[string]common.BreakerConfig{
+		BreakerTextCategory: conf.TextCategory,
+		BreakerKeyword:      conf.Keyword,
+		BreakerTopicModel:   conf.TopicModel,
+		BreakerMongo:        conf.Mongo,
+		BreakerUps:          conf.Ups,
+	} {
+		if breakerConf.Enable {
+			newBreakers[name] = NewBreaker(name, breakerConf)
+		}
+	}
+	breakerLock.Lock()
+	breakers = newBreakers
+	breakerLock.Unlock()
+}
+
+// GetBreaker returns nil if the breaker of name is not enabled.
+func GetBreaker(name string) *Breaker {
+	breakerLock.RLock()
+	defer breakerLock.RUnlock()
+	return breakers[name]
+}
+
+// AllBreakerStats returns the stats of the enabled breakers by name.
+func AllBreakerStats() []BreakerStats {
+	breakerLock.RLock()
+	defer breakerLock.RUnlock()
+	stats := make([]BreakerStats, 0, len(breakers))
+	for _, breaker := range breakers {
+		stats = append(stats, breaker.Stats())
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Name < stats[j].Name
+	})
+	return stats
+}
+
+// isRemoteFailure counts transport errors and retryable RemoteError, not the rejected requests or bad responses.
+func isRemoteFailure(err error) bool {
+	var remoteErr *RemoteError
+	if !errors.As(err, &remoteErr) {
+		return true
+	}
+	return remoteErr.Retryable()
+}
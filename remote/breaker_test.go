@@ -0,0 +1,110 @@
+package remote
+
+import (
+	"context"
+	"github.com/ParticleMedia/fb_page_server/common"
+	"testing"
+	"time"
+)
+
+// elapseOpenTime moves the opening of the breaker back by open_time instead of sleeping
+func elapseOpenTime(b *Breaker) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.openedAt = b.openedAt.Add(-time.Duration(b.conf.OpenTime) * time.Second)
+}
+
+func isBreakerOpen(err error) bool {
+	kind, ok := IsRemoteError(err)
+	return ok && kind == RemoteBreakerOpen
+}
+
+func TestBreakerStates(t *testing.T) {
+	b := NewBreaker("test", common.BreakerConfig{MinRequests: 4, ErrorRate: 0.5, OpenTime: 30, HalfOpenProbes: 2})
+
+	// closed: 1 failure of 3 calls is under min_requests
+	for _, failed := range []bool{false, true, false} {
+		if allowErr := b.Allow(); allowErr != nil {
+			t.Fatalf("closed breaker rejected: %+v", allowErr)
+		}
+		b.Record(failed, time.Millisecond)
+	}
+	if b.State() != BreakerClosed {
+		t.Fatalf("state: %s, want closed", b.State())
+	}
+	b.Allow()
+	b.Record(true, time.Millisecond)
+	if b.State() != BreakerOpen {
+		t.Fatalf("state after 2 failures of 4: %s, want open", b.State())
+	}
+	if allowErr := b.Allow(); !isBreakerOpen(allowErr) {
+		t.Errorf("open breaker allowed: %+v", allowErr)
+	}
+
+	// half open: half_open_probes calls at a time, the next one is rejected until they succeed
+	elapseOpenTime(b)
+	for i := 0; i < 2; i++ {
+		if allowErr := b.Allow(); allowErr != nil {
+			t.Fatalf("probe %d rejected: %+v", i, allowErr)
+		}
+	}
+	if b.State() != BreakerHalfOpen {
+		t.Fatalf("state: %s, want half_open", b.State())
+	}
+	if allowErr := b.Allow(); !isBreakerOpen(allowErr) {
+		t.Errorf("probe over half_open_probes allowed: %+v", allowErr)
+	}
+	b.Record(false, time.Millisecond)
+	if b.State() != BreakerHalfOpen {
+		t.Errorf("state after 1 of 2 probes: %s, want half_open", b.State())
+	}
+	b.Record(false, time.Millisecond)
+	if b.State() != BreakerClosed {
+		t.Errorf("state after 2 probes: %s, want closed", b.State())
+	}
+	if stats := b.Stats(); stats.Opened != 1 || stats.Rejected != 2 {
+		t.Errorf("stats: %+v, want opened 1, rejected 2", stats)
+	}
+}
+
+func TestBreakerHalfOpenProbeFails(t *testing.T) {
+	b := NewBreaker("test", common.BreakerConfig{MinRequests: 1, ErrorRate: 0.5, OpenTime: 30, HalfOpenProbes: 2})
+	b.Allow()
+	b.Record(true, time.Millisecond)
+	elapseOpenTime(b)
+
+	b.Allow()
+	b.Allow()
+	b.Record(false, time.Millisecond)
+	b.Record(true, time.Millisecond)
+	if b.State() != BreakerOpen {
+		t.Errorf("state after a failed probe: %s, want open", b.State())
+	}
+}
+
+func TestBreakerFinish(t *testing.T) {
+	b := NewBreaker("test", common.BreakerConfig{MinRequests: 1, ErrorRate: 0.5, OpenTime: 30, HalfOpenProbes: 1})
+	b.Allow()
+	b.Record(true, time.Millisecond)
+	elapseOpenTime(b)
+
+	// a cancelled probe is given back and not recorded
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b.Allow()
+	b.finish(ctx, true, time.Millisecond)
+	if allowErr := b.Allow(); allowErr != nil {
+		t.Fatalf("probe of a cancelled call not given back: %+v", allowErr)
+	}
+	if stats := b.Stats(); stats.Requests != 1 {
+		t.Errorf("cancelled call recorded, requests: %d", stats.Requests)
+	}
+
+	// a probe still running at the deadline is a failure, though the call returned no error of the service
+	deadlineCtx, deadlineCancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer deadlineCancel()
+	b.finish(deadlineCtx, false, time.Second)
+	if b.State() != BreakerOpen {
+		t.Errorf("state after a deadline overrun: %s, want open", b.State())
+	}
+}
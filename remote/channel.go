@@ -1,40 +1,24 @@
 package remote
 
 import (
-	"bufio"
 	"context"
 	"encoding/json"
-	"errors"
-	"fmt"
 	"github.com/ParticleMedia/fb_page_server/common"
 	"github.com/golang/glog"
 	"go.mongodb.org/mongo-driver/bson"
-	"io/ioutil"
 	"math"
-	"net/http"
-	"net/url"
-	"os"
-	"strconv"
+	"sort"
 	"strings"
-	"time"
 	"unicode"
 )
 
-var stopWordFilePath = "/mnt/models/fb-page-server/channel/stopWord.txt"
-var blackListFilePath = "/mnt/models/fb-page-server/channel/blacklist.txt"
-var channelVectorFilePath = "/mnt/models/fb-page-server/channel/channel.vector."
-var stopWords map[string]bool
-var blackList map[string]bool
-var channelVectorMap map[string][]float64
-var channelFormalFormMap map[string]string
-var channelIndexMap map[string]map[string]bool
 var entitySuffix = map[string]bool{"Inc.": true, "Corp.": true, "Corporation": true, "Award": true, "Awards": true}
-var scoreThreshold = 0.2
-var delimiters = []uint8{'?', ':', '!', '=', '(', ')', '[', ']', '{', '}', '\r', '\n', '\t', ' ', '"', '\'', '<', '>', ',', '.', '/', '\\', '+', '-', '*', '&', '|', '^', '%', ';'}
 
 type PageChn struct {
-	Id  string             `bson:"_id"`
-	Chn map[string]float64 `bson:"channels"`
+	Id   string             `bson:"_id"`
+	Chn  map[string]float64 `bson:"channels"`
+	// language detected on name and about
+	Lang string             `bson:"lang,omitempty"`
 }
 
 type ChannelBody struct {
@@ -74,255 +58,223 @@ func NewPageContext(segTitle string, segContent string, keywords []string, score
 	}
 }
 
-func LoadChannels() error {
-	stopWordFile, stopWordErr := os.Open(stopWordFilePath)
-	if stopWordErr != nil {
-		return stopWordErr
-	}
-	stopWords = make(map[string]bool)
-	scanner := bufio.NewScanner(stopWordFile)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if len(line) == 0 {
-			continue
-		}
-		line = strings.ToLower(line)
-		splits := strings.Split(line, "\t")
-		word := strings.TrimSpace(splits[0])
-		stopWords[word] = true
-	}
-	stopWordFile.Close()
+const channelLevel = "channels"
 
-	blackListFile, blackListErr := os.Open(blackListFilePath)
-	if blackListErr != nil {
-		return blackListErr
-	}
-	blackList = make(map[string]bool)
-	scanner = bufio.NewScanner(blackListFile)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if len(line) == 0 {
-			continue
-		}
-		line = strings.ToLower(line)
-		splits := strings.Split(line, "\t")
-		//有空格，无大写
-		channel := strings.TrimSpace(splits[0])
-		blackList[channel] = true
-	}
-	blackListFile.Close()
-
-	id := 0
-	dimension := -1
-	channelVectorMap = make(map[string][]float64)
-	channelFormalFormMap = make(map[string]string)
-	channelIndexMap = make(map[string]map[string]bool)
-	for {
-		channelVectorFile, channelVectorErr := os.Open(channelVectorFilePath + strconv.Itoa(id))
-		if channelVectorErr != nil {
-			break
-		}
-		scanner = bufio.NewScanner(channelVectorFile)
-		for scanner.Scan() {
-			line := scanner.Text()
-			if len(line) == 0 {
-				continue
-			}
-			splits := strings.Split(line, "\t")
-			channel := splits[0]
-			vector := make([]float64, 0, len(splits) - 1)
-			for i := 1; i < len(splits); i++ {
-				floatValue, floatErr := strconv.ParseFloat(splits[i],64)
-				if floatErr != nil {
-					return errors.New(fmt.Sprintf("parse to vector fail, line: %s", line))
-				}
-				vector = append(vector, floatValue)
-			}
-			if dimension < 0 {
-				dimension = len(vector)
-			} else if dimension != len(vector){
-				return errors.New(fmt.Sprintf("dimention not same in channel vector files, line: %s", line))
-			}
-			_, ok := channelVectorMap[channel]
-			if !ok {
-				//有空格，有大写
-				channelVectorMap[channel] = vector
-				//key有空格，无大写；value有空格，有大写
-				channelFormalFormMap[strings.ToLower(channel)] = channel
-			}
-			words := strings.Split(channel, " ")
-			for _, word := range words {
-				word = strings.ToLower(word)
-				_, stop := stopWords[word]
-				if !stop {
-					channels, exist := channelIndexMap[word]
-					if !exist {
-						channels = make(map[string]bool)
-					}
-					channels[strings.ToLower(channel)] = true
-					//key单个词，无大写；value有空格，无大写
-					channelIndexMap[word] = channels
-				}
-			}
-		}
-		id += 1
-		channelVectorFile.Close()
-	}
-	return nil
+type channelProcessor struct {
+	conf *common.Config
 }
 
-func ProcessChannel(profile *common.FBProfile, conf *common.Config) error {
-	pageCnt := 0
-	totalChannelScores := make(map[string]float64)
-	for _, page := range profile.Pages {
-		result, chnErr := getChannel(&page, conf)
-		if chnErr != nil || result == nil || len(result) == 0 {
-			continue
-		}
-		pageCnt += 1
-		for chn, score := range result {
-			_, ok := totalChannelScores[chn]
-			if ok {
-				totalChannelScores[chn] += score
-			} else {
-				totalChannelScores[chn] = score
-			}
-		}
-	}
-
-	if len(totalChannelScores) == 0 {
-		return nil
-	}
+func init() {
+	RegisterProcessor("channel", func(conf *common.Config) Processor {
+		return &channelProcessor{conf: conf}
+	})
+}
 
-	for chn, score := range totalChannelScores {
-		totalChannelScores[chn] = score / float64(pageCnt)
-	}
+func (p *channelProcessor) Name() string {
+	return "channel"
+}
 
-	value, encodeErr := json.Marshal(totalChannelScores)
-	if encodeErr != nil {
-		return encodeErr
+func (p *channelProcessor) Config() *ProcessorConfig {
+	return &ProcessorConfig{
+		Profile:     p.conf.ChnConf.Profile,
+		Collection:  p.conf.ChnConf.Collection,
+		Aggregation: &p.conf.ChnConf.Aggregation,
+		Output:      &p.conf.ChnConf.Output,
+		Merge:       &p.conf.ChnConf.Merge,
 	}
+}
 
-	glog.Infof("ready to write to ups, profile: %s, key: %d, value: %s", conf.ChnConf.Profile, profile.Id, string(value))
-	WriteToUps(uint64(profile.Id), string(value), conf.ChnConf.Profile, &conf.UpsConf)
-	return nil
+func (p *channelProcessor) Levels() []string {
+	return []string{channelLevel}
 }
 
-func getChannel(page *common.FBPage, conf *common.Config) (map[string]float64, error) {
-	channelScores := make(map[string]float64)
-	pageChn, getErr := getChannelFromMongo(page.Id, conf)
-	if getErr == nil && pageChn != nil && pageChn.Chn != nil && len(pageChn.Chn) != 0{
-		return pageChn.Chn, nil
+func (p *channelProcessor) Compute(ctx context.Context, page *common.FBPage) (Feature, error) {
+	result, chnErr := getChannel(ctx, page, p.conf)
+	if chnErr != nil || len(result) == 0 {
+		return nil, chnErr
 	}
+	return Feature{channelLevel: result}, nil
+}
 
-	segTitle := page.Name
-	segContent := strings.ReplaceAll(page.About, "\n", "")
-	kwsCandidateNext := getKwsCandidate(segTitle, segContent)
-
-	bodyMap := map[string]interface{}{
-		"url":                "",
-		"seg_title":          segTitle,
-		"seg_content":        segContent,
-		//有空格，有大写
-		"kws_candidate_next": kwsCandidateNext,
-	}
-	body, encodeErr := json.Marshal(bodyMap)
+func (p *channelProcessor) Encode(feature Feature) (string, error) {
+	value, encodeErr := json.Marshal(feature[channelLevel])
 	if encodeErr != nil {
-		return nil, encodeErr
-	}
-
-	resp, respErr := http.Get(conf.ChnConf.Uri + "?q=" + url.QueryEscape(string(body)))
-	if respErr != nil {
-		return nil, respErr
-	}
-
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		glog.Infof("channel resp code: %d", resp.StatusCode)
-		return nil, nil
-	}
-
-	respBody, readErr := ioutil.ReadAll(resp.Body)
-	if readErr != nil {
-		return nil, readErr
+		return "", encodeErr
 	}
+	return string(value), nil
+}
 
-	respMap := make(map[string]interface{})
-	parseErr := json.Unmarshal(respBody, &respMap)
+func (p *channelProcessor) Decode(value string) (Feature, error) {
+	channelScores := make(map[string]float64)
+	parseErr := json.Unmarshal([]byte(value), &channelScores)
 	if parseErr != nil {
 		return nil, parseErr
 	}
+	return Feature{channelLevel: channelScores}, nil
+}
 
-	keywordScoreArray, keywordScoreOk := respMap["keyword"]
-	vectorArray, vectorOk := respMap["vector"]
-	if !keywordScoreOk || !vectorOk {
-		return nil, errors.New(fmt.Sprintf("parse keyword response with error, has keyword score: %+v, has vector: %+v", keywordScoreOk, vectorOk))
+func getChannel(ctx context.Context, page *common.FBPage, conf *common.Config) (map[string]float64, error) {
+	return getChannelExplained(ctx, page, conf, nil)
+}
+
+// getChannelExplained is getChannel which also fills explain, unless nil, from the keyword response
+// (or the local fallback) the channels are computed from.
+func getChannelExplained(ctx context.Context, page *common.FBPage, conf *common.Config, explain *ChannelExplain) (map[string]float64, error) {
+	pageChn, getErr := getChannelFromMongo(ctx, page.Id, conf)
+	if getErr == nil && pageChn != nil && pageChn.Chn != nil && len(pageChn.Chn) != 0{
+		if explain != nil {
+			explain.KeywordSource = "cache"
+		}
+		return pageChn.Chn, nil
 	}
-	keywords := make([]string, 0, len(keywordScoreArray.([]interface{})))
-	scores := make([]float64, 0, len(keywordScoreArray.([]interface{})))
-	for _, keywordScore := range keywordScoreArray.([]interface{}) {
-		//有空格，有大写
-		keyword, keywordOk := keywordScore.(map[string]interface{})["keyword"]
-		score, scoreOk := keywordScore.(map[string]interface{})["score"]
-		if keywordOk && scoreOk && len(keyword.(string)) > 0 && !strings.Contains(keyword.(string), "http") && score.(float64) > 0 {
-			//无空格，有大写
-			keywords = append(keywords, strings.ReplaceAll(keyword.(string), " ", "^^"))
-			scores = append(scores, score.(float64))
+
+	lang := pageLanguage(page)
+	channelScores, kwErr := getChannelFromKeyword(ctx, page, lang, conf, explain)
+	if kwErr != nil || channelScores == nil {
+		if explain != nil {
+			explain.keywordErr = kwErr
+		}
+		// keyword服务不可用时先用本地关键词兜底，再用facebook category兜底，都不写入mongo
+		localScores := getChannelFromLocalKeyword(page, lang, conf, explain)
+		if len(localScores) != 0 {
+			return localScores, nil
+		}
+		categoryScores := getChannelFromCategory(page, conf)
+		if len(categoryScores) != 0 {
+			return categoryScores, nil
 		}
+		return nil, kwErr
 	}
-	//无空格，有大写
-	keywords, scores = dedupKeywords(keywords, scores)
-	vector := make([]float64, 0, len(vectorArray.([]interface{})))
-	for _, value := range vectorArray.([]interface{}) {
-		vector = append(vector, value.(float64))
-	}
-	pageContext := NewPageContext(segTitle, segContent, keywords, scores, vector)
-	pageContext.channels, pageContext.scChannels = rankChannels(pageContext)
-	pageContext.channels, pageContext.scChannels = filterChannels(pageContext)
-	for i := 0; i < len(pageContext.channels); i++ {
-		channelScores[pageContext.channels[i]] = pageContext.scChannels[i]
+	if len(channelScores) == 0 {
+		channelScores = getChannelFromCategory(page, conf)
 	}
+
 	pageChn = &PageChn{
 		Id: page.Id,
 		Chn: channelScores,
+		Lang: lang,
 	}
-	setErr := setChannelToMongo(pageChn.Id, pageChn, conf)
+	setErr := setChannelToMongo(ctx, pageChn.Id, pageChn, conf)
 	if setErr != nil {
-		glog.Warning("set chn to mongo with error: %v, value: %+v", setErr, *pageChn)
+		glog.Warningf("set chn to mongo with error: %v, value: %+v", setErr, *pageChn)
 	}
 
 	return channelScores, nil
 }
 
-func getKwsCandidate(title string, content string) []string {
-	keywords := make(map[string]bool)
-	if len(title) > 0 {
-		words := strings.Split(strings.ReplaceAll(title, "\\s+", " "), " ")
-		for keyword, _ := range countKws(words) {
-			keywords[keyword] = true
-		}
-		for keyword, _ := range countBws(words) {
-			keywords[keyword] = true
-		}
-		for keyword, _ := range countTws(words) {
-			keywords[keyword] = true
+func pageLanguage(page *common.FBPage) string {
+	return DetectLanguage(page.Name + " " + page.About)
+}
+
+func getChannelFromKeyword(ctx context.Context, page *common.FBPage, lang string, conf *common.Config, explain *ChannelExplain) (map[string]float64, error) {
+	pageContext, kwErr := getKeywordPageContext(ctx, page, conf)
+	if kwErr != nil {
+		return nil, kwErr
+	}
+	channels, scores := channelModel.classifyLanguageChannels(lang, pageContext)
+	if explain != nil {
+		explain.KeywordSource = "service"
+		explain.fill(pageContext, channels, scores)
+	}
+	channelScores := make(map[string]float64)
+	for i := 0; i < len(channels); i++ {
+		channelScores[channels[i]] = scores[i]
+	}
+	return channelScores, nil
+}
+
+// getKeywordPageContext asks the keyword service for the keywords and vector of the page, rankChannels takes the result.
+func getKeywordPageContext(ctx context.Context, page *common.FBPage, conf *common.Config) (*PageContext, error) {
+	segTitle := page.Name
+	segContent := page.Content()
+	req := &KeywordRequest{
+		Url:              "",
+		SegTitle:         segTitle,
+		SegContent:       segContent,
+		KwsCandidateNext: getKwsCandidate(segTitle, segContent, page.Categories()),
+	}
+	client := GetKeywordClient(&conf.ChnConf, channelModel.Dimension())
+	resp, respErr := client.Extract(ctx, req)
+	if respErr != nil {
+		return nil, respErr
+	}
+	return resp.pageContext(segTitle, segContent), nil
+}
+
+// parseKeywordResponse builds the context of rankChannels from a recorded keyword service response,
+// checked to have vectors of dimension unless it is 0.
+func parseKeywordResponse(segTitle string, segContent string, respBody []byte, dimension int) (*PageContext, error) {
+	resp, decodeErr := DecodeKeywordResponse(respBody)
+	if decodeErr != nil {
+		return nil, decodeErr
+	}
+	validateErr := resp.Validate(dimension)
+	if validateErr != nil {
+		return nil, validateErr
+	}
+	return resp.pageContext(segTitle, segContent), nil
+}
+
+func getChannelFromCategory(page *common.FBPage, conf *common.Config) map[string]float64 {
+	channelScores := make(map[string]float64)
+	for _, category := range page.Categories() {
+		chns, ok := channelModel.categoryChannelMap[strings.ToLower(category)]
+		if !ok {
+			continue
 		}
-		for keyword, _ := range countQws(words) {
-			keywords[keyword] = true
+		for chn, score := range chns {
+			if score <= 0 {
+				score = conf.ChnConf.CategoryScore
+			}
+			// 无空格，有大写，与filterChannels的输出保持一致
+			chn = strings.ReplaceAll(chn, " ", "^^")
+			if score > channelScores[chn] {
+				channelScores[chn] = score
+			}
 		}
 	}
-	if len(content) > 0 {
-		words := strings.Split(strings.ReplaceAll(content, "\\s+", " "), " ")
-		for keyword, _ := range countKws(words) {
-			keywords[keyword] = true
+	return channelScores
+}
+
+func getCategoryKwsCandidate(categories []string) []string {
+	keywords := make([]string, 0, len(categories))
+	for _, category := range categories {
+		// e.g. "Musician/Band", "Food & Beverage"
+		for _, part := range strings.Split(category, "/") {
+			words := tokenWords(Tokenize(part), false)
+			if len(words) != 0 {
+				keywords = append(keywords, strings.Join(words, "^^"))
+			}
 		}
-		for keyword, _ := range countBws(words) {
-			keywords[keyword] = true
+	}
+	return keywords
+}
+
+func getKwsCandidate(title string, content string, categories []string) []string {
+	keywords := make(map[string]bool)
+	for _, keyword := range getCategoryKwsCandidate(categories) {
+		keywords[keyword] = true
+	}
+	for _, text := range []string{title, content} {
+		if len(text) == 0 {
+			continue
 		}
-		for keyword, _ := range countTws(words) {
-			keywords[keyword] = true
+		for _, words := range phraseWords(Tokenize(text)) {
+			for keyword, _ := range countKws(words) {
+				keywords[keyword] = true
+			}
+			for keyword, _ := range countBws(words) {
+				keywords[keyword] = true
+			}
+			for keyword, _ := range countTws(words) {
+				keywords[keyword] = true
+			}
+			for keyword, _ := range countQws(words) {
+				keywords[keyword] = true
+			}
 		}
-		for keyword, _ := range countQws(words) {
+		// 中日文没有空格，候选词是2到4个字
+		for _, keyword := range cjkCandidates(text) {
 			keywords[keyword] = true
 		}
 	}
@@ -349,27 +301,27 @@ func dedupKeywords(keywords []string, scores []float64) ([]string, []float64) {
 	return keywords_new, scores_new
 }
 
-func rankChannels(pageContext *PageContext) ([]string, []float64) {
+func (m *ChannelModel) rankChannels(pageContext *PageContext) ([]string, []float64) {
 	channels := make(map[string]bool)
 	channelScores := make(map[string]float64)
 
 	text := pageContext.segTitle
 	if len(text) > 0 {
-		words := strings.Split(strings.ReplaceAll(text, "\\s+", " "), " ")
+		words := tokenWords(Tokenize(text), true)
 		pageContext.titleSize = len(words)
-		// 单个词，有大写
+		// 单个词，无大写
 		pageContext.titleKws = countKws(words)
-		// 无空格，有大写
+		// 无空格，无大写
 		pageContext.titleBws = countBws(words)
 	}
 
 	text = pageContext.segContent
 	if len(text) > 0 {
-		words := strings.Split(strings.ReplaceAll(text, "\\s+", " "), " ")
+		words := tokenWords(Tokenize(text), true)
 		pageContext.contentSize = len(words)
-		// 单个词，有大写
+		// 单个词，无大写
 		pageContext.contentKws = countKws(words)
-		// 无空格，有大写
+		// 无空格，无大写
 		pageContext.contentBws = countBws(words)
 	}
 
@@ -377,14 +329,14 @@ func rankChannels(pageContext *PageContext) ([]string, []float64) {
 	for _, keyword := range pageContext.keywords {
 		// case 1: keyword是channel
 		//有空格，无大写
-		keyword = strings.ToLower(strings.ReplaceAll(keyword, "^^", " "))
-		_, ok := channelFormalFormMap[keyword]
+		keyword = NormalizeText(strings.ReplaceAll(keyword, "^^", " "))
+		_, ok := m.channelFormalFormMap[keyword]
 		if ok {
 			//有空格，有大写
-			keyword = channelFormalFormMap[keyword]
+			keyword = m.channelFormalFormMap[keyword]
 			_, exist := channels[keyword]
 			if !exist {
-				channelVector := channelVectorMap[keyword]
+				channelVector := m.channelVectorMap[keyword]
 				sim := simVector(channelVector, pageContext.vector)
 				channelScores[keyword] = sim
 				channels[keyword] = true
@@ -392,10 +344,10 @@ func rankChannels(pageContext *PageContext) ([]string, []float64) {
 		}
 
 		// case 2: keyword分词后有数字则不继续
-		words := strings.Split(keyword, " ")
+		tokens := Tokenize(keyword)
 		containsNumber := false
-		for _, word := range words {
-			if isNumber(word) {
+		for _, token := range tokens {
+			if token.Kind == TokenNumber {
 				containsNumber = true
 				break
 			}
@@ -405,24 +357,24 @@ func rankChannels(pageContext *PageContext) ([]string, []float64) {
 		}
 
 		// case 3: keyword与channel共有某分词，且该分词是该channel的后缀，且page信息里包含该channel的除entity外的所有分词
-		for offset := 0; offset < len(words); offset++ {
+		for offset := 0; offset < len(tokens); offset++ {
 			//单个词，无大写
-			word := strings.ToLower(words[offset])
+			word := tokens[offset].Norm
 			// 有空格，无大写
-			chns, ok := channelIndexMap[word]
+			chns, ok := m.channelIndexMap[word]
 			if ok {
 				for chn := range chns {
 					// 有空格，有大写
-					chn = channelFormalFormMap[chn]
+					chn = m.channelFormalFormMap[chn]
 					// 有空格，有大写
 					chnEntityRemoved := removeEntity(chn)
-					if strings.HasSuffix(strings.ToLower(chnEntityRemoved), word) {
+					if lastTokenNorm(chnEntityRemoved) == word {
 						if !areAllWordsAppearInPage(chnEntityRemoved, pageContext) {
 							continue
 						}
 						_, exist := channels[chn]
 						if !exist {
-							channelVector := channelVectorMap[chn]
+							channelVector := m.channelVectorMap[chn]
 							sim := simVector(channelVector, pageContext.vector)
 							channelScores[chn] = sim
 							channels[chn] = true
@@ -436,7 +388,41 @@ func rankChannels(pageContext *PageContext) ([]string, []float64) {
 	return sortMap(channelScores)
 }
 
-func filterChannels(pageContext *PageContext) ([]string, []float64) {
+// classifyChannels ranks and filters the channels of the page, output in the channel names of DefaultLanguage.
+func (m *ChannelModel) classifyChannels(pageContext *PageContext) ([]string, []float64) {
+	pageContext.channels, pageContext.scChannels = m.rankChannels(pageContext)
+	channels, scores := m.filterChannels(pageContext)
+	if len(m.canonicalNameMap) == 0 {
+		return channels, scores
+	}
+	exist := make(map[string]bool)
+	canonicalChannels := make([]string, 0, len(channels))
+	canonicalScores := make([]float64, 0, len(scores))
+	for i, chn := range channels {
+		// 多个本地化channel对应同一个channel时保留分数高的
+		chn = m.canonicalChannel(chn)
+		if exist[chn] {
+			continue
+		}
+		exist[chn] = true
+		canonicalChannels = append(canonicalChannels, chn)
+		canonicalScores = append(canonicalScores, scores[i])
+	}
+	return canonicalChannels, canonicalScores
+}
+
+// classifyLanguageChannels classifies with the model of lang, and with m if that finds no channel,
+// as the keyword service may return english keywords and a language model may cover part of the channels.
+func (m *ChannelModel) classifyLanguageChannels(lang string, pageContext *PageContext) ([]string, []float64) {
+	languageModel := m.forLanguage(lang)
+	channels, scores := languageModel.classifyChannels(pageContext)
+	if len(channels) == 0 && languageModel != m {
+		channels, scores = m.classifyChannels(pageContext)
+	}
+	return channels, scores
+}
+
+func (m *ChannelModel) filterChannels(pageContext *PageContext) ([]string, []float64) {
 	channels := make(map[string]bool)
 	channelSorted := make([]string, 0, len(pageContext.channels))
 	scoresSorted := make([]float64, 0, len(pageContext.scChannels))
@@ -445,7 +431,7 @@ func filterChannels(pageContext *PageContext) ([]string, []float64) {
 		//有空格，有大写
 		chn := pageContext.channels[i]
 		score := pageContext.scChannels[i]
-		if score <= scoreThreshold {
+		if score <= m.ScoreThreshold {
 			break
 		}
 
@@ -458,8 +444,8 @@ func filterChannels(pageContext *PageContext) ([]string, []float64) {
 
 		//case3: 过滤掉黑名单中的channel
 		//有空格，无大写
-		chnLowerCase := strings.ToLower(chn)
-		_, ok := blackList[chnLowerCase]
+		chnLowerCase := NormalizeText(chn)
+		_, ok := m.blackList[chnLowerCase]
 		if ok {
 			continue
 		}
@@ -494,7 +480,7 @@ func filterChannels(pageContext *PageContext) ([]string, []float64) {
 func countKws(words []string) map[string]int64 {
 	kws := make(map[string]int64)
 	for _, word := range words {
-		if len(word) >= 2 {
+		if isTermWord(word) {
 			count, exist := kws[word]
 			if !exist {
 				count = 0
@@ -508,7 +494,7 @@ func countKws(words []string) map[string]int64 {
 func countBws(words []string) map[string]int64 {
 	bws := make(map[string]int64)
 	for i := 0; i < len(words) - 1; i++ {
-		if len(words[i]) >= 2 && len(words[i + 1]) >= 2 {
+		if isTermWord(words[i]) && isTermWord(words[i + 1]) {
 			phrase := words[i] + "^^" + words[i + 1]
 			count, exist := bws[phrase]
 			if !exist {
@@ -523,7 +509,7 @@ func countBws(words []string) map[string]int64 {
 func countTws(words []string) map[string]int64 {
 	tws := make(map[string]int64)
 	for i := 0; i < len(words) - 2; i++ {
-		if len(words[i]) >= 2 && len(words[i + 1]) >= 2 && len(words[i + 2]) >= 2 {
+		if isTermWord(words[i]) && isTermWord(words[i + 1]) && isTermWord(words[i + 2]) {
 			phrase := words[i] + "^^" + words[i + 1] + "^^" + words[i + 2]
 			count, exist := tws[phrase]
 			if !exist {
@@ -538,7 +524,7 @@ func countTws(words []string) map[string]int64 {
 func countQws(words []string) map[string]int64 {
 	qws := make(map[string]int64)
 	for i := 0; i < len(words) - 3; i++ {
-		if len(words[i]) >= 2 && len(words[i + 1]) >= 2 && len(words[i + 2]) >= 2 && len(words[i + 3]) >= 2 {
+		if isTermWord(words[i]) && isTermWord(words[i + 1]) && isTermWord(words[i + 2]) && isTermWord(words[i + 3]) {
 			phrase := words[i] + "^^" + words[i + 1] + "^^" + words[i + 2] + "^^" + words[i + 3]
 			count, exist := qws[phrase]
 			if !exist {
@@ -552,7 +538,8 @@ func countQws(words []string) map[string]int64 {
 
 func simVector(x []float64, y []float64) float64 {
 	score := 0.0
-	if len(x) > 0 && len(y) > 0 {
+	// 维度不同的向量不可比
+	if len(x) > 0 && len(y) > 0 && len(x) == len(y) {
 		d_0 := 0.0
 		d_1 := 0.0
 		dimension := len(x)
@@ -613,21 +600,27 @@ func areAllWordsAppearInPage(input string, pageContext *PageContext) bool {
 	if len(input) == 0 || pageContext == nil {
 		return false
 	}
-	words := strings.Split(input, " ")
-	for _, word := range words {
-		if getTitleTermFrequency(word, pageContext) == 0 && getContentTermFrequency(word, pageContext) == 0 && getTitleTermFrequency(strings.ToLower(word), pageContext) == 0 && getContentTermFrequency(strings.ToLower(word), pageContext) == 0 {
+	for _, word := range tokenWords(Tokenize(input), true) {
+		if getTitleTermFrequency(word, pageContext) == 0 && getContentTermFrequency(word, pageContext) == 0 {
 			return false
 		}
 	}
 	return true
 }
 
+func lastTokenNorm(input string) string {
+	words := tokenWords(Tokenize(input), true)
+	if len(words) == 0 {
+		return ""
+	}
+	return words[len(words) - 1]
+}
+
 func areAllWordsAppearInPageContent(input string, pageContext *PageContext) bool {
 	if len(input) == 0 || pageContext == nil {
 		return false
 	}
-	words := strings.Split(input, " ")
-	for _, word := range words {
+	for _, word := range tokenWords(Tokenize(input), true) {
 		if getContentTermFrequency(word, pageContext) == 0 {
 			return false
 		}
@@ -659,142 +652,58 @@ func getContentTermFrequency(term string, pageContext *PageContext) int64 {
 	return frequencyInKws + frequencyInBws
 }
 
-// 按value降序
+// 按value降序，value相同时按key升序，保证结果稳定
 func sortMap(paramMap map[string]float64) ([]string, []float64) {
 	keys := make([]string, 0, len(paramMap))
 	values := make([]float64, 0, len(paramMap))
 	for key, _ := range paramMap {
 		keys = append(keys, key)
 	}
-	for i := 0; i < len(keys); i++ {
-		for j := i + 1; j < len(keys); j++ {
-			if paramMap[keys[i]] < paramMap[keys[j]] {
-				keys[i], keys[j] = keys[j], keys[i]
-			}
+	sort.Slice(keys, func(i, j int) bool {
+		if paramMap[keys[i]] != paramMap[keys[j]] {
+			return paramMap[keys[i]] > paramMap[keys[j]]
 		}
-	}
+		return keys[i] < keys[j]
+	})
 	for _, key := range keys {
 		values = append(values, paramMap[key])
 	}
 	return keys, values
 }
 
+// containWholeString is whether the words of str1 appear in a row in str0, without case and accents.
 func containWholeString(str0 string, str1 string) bool {
 	if len(str0) == 0 {
 		return false
 	}
-	if len(str1) == 0 {
+	words1 := tokenWords(Tokenize(str1), true)
+	if len(words1) == 0 {
 		return true
 	}
-	result := containWholeLowerString(strings.ToLower(str0), strings.ToLower(str1))
-	return result
-}
-
-func containWholeLowerString(str0 string, str1 string) bool {
-	if len(str0) == 0 {
-		return false
-	} else if len(str1) == 0 {
-		return true
-	} else {
-		offset := 0
-		for {
-			newOffset := strings.Index(str0[offset :], str1)
-			if newOffset < 0 {
-				break
-			}
-			offset += newOffset
-			leftIsBoundary := offset == 0
-			if !leftIsBoundary {
-				c := str0[offset - 1]
-				leftIsBoundary = isDelimiter(c)
-				if !leftIsBoundary {
-					c = str1[0]
-					leftIsBoundary = isDelimiter(c)
-				}
-			}
-			if !leftIsBoundary {
-				offset++
-			} else {
-				rightOffset := offset + len(str1) - 1
-				rightIsBoundary := rightOffset + 1 == len(str0)
-				if !rightIsBoundary {
-					c := str0[rightOffset + 1]
-					rightIsBoundary = isDelimiter(c)
-					if !rightIsBoundary {
-						c = str1[len(str1) - 1]
-						rightIsBoundary = isDelimiter(c)
-					}
-				}
-				if rightIsBoundary {
-					return true
-				}
-				offset++
-			}
-			if offset >= len(str0) {
+	words0 := tokenWords(Tokenize(str0), true)
+	for offset := 0; offset + len(words1) <= len(words0); offset++ {
+		matched := true
+		for i, word := range words1 {
+			if words0[offset + i] != word {
+				matched = false
 				break
 			}
 		}
-		return false
-	}
-}
-
-func isDelimiter(c uint8) bool {
-	if isSpaceChar(c) {
-		return true
-	} else if c == '^' {
-		return true
-	} else {
-		for _, d := range delimiters {
-			if c == d {
-				return true
-			}
+		if matched {
+			return true
 		}
-		return false
-	}
-}
-
-func isSpaceChar(c uint8) bool {
-	return c == 12 || c == 13 || c == 14
-}
-
-func setChannelToMongo(key string, value *PageChn, conf *common.Config) error {
-	timeout := time.Duration(conf.MongoConf.Timeout) * time.Millisecond
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-
-	_, insertErr := collectionMap[conf.ChnConf.Collection].InsertOne(ctx, *value)
-	if insertErr != nil {
-		// replace when exist
-		replaceErr := replaceChannelToMongo(key, value, conf)
-		return replaceErr
 	}
-	return nil
+	return false
 }
 
-func replaceChannelToMongo(key string, value *PageChn, conf *common.Config) error {
-	timeout := time.Duration(conf.MongoConf.Timeout) * time.Millisecond
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-
-	filter := bson.M{"_id": key}
-	_, replaceErr := collectionMap[conf.ChnConf.Collection].ReplaceOne(ctx, filter, *value)
-	return replaceErr
+func setChannelToMongo(ctx context.Context, key string, value *PageChn, conf *common.Config) error {
+	return pageStore.Replace(ctx, conf.ChnConf.Collection, key, *value)
 }
 
-func getChannelFromMongo(key string, conf *common.Config) (*PageChn, error) {
-	timeout := time.Duration(conf.MongoConf.Timeout) * time.Millisecond
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-
-	filter := bson.M{"_id": key}
-	result := collectionMap[conf.ChnConf.Collection].FindOne(ctx, filter)
-	if result.Err() != nil {
-		return nil, result.Err()
-	}
-
-	raw, decodeErr := result.DecodeBytes()
-	if decodeErr != nil {
-		return nil, decodeErr
+func getChannelFromMongo(ctx context.Context, key string, conf *common.Config) (*PageChn, error) {
+	raw, findErr := pageStore.Find(ctx, conf.ChnConf.Collection, key)
+	if findErr != nil {
+		return nil, findErr
 	}
 
 	var value PageChn
@@ -0,0 +1,232 @@
+package remote
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// LabelledPage is one line of an evaluation set: the page text, the recorded keyword service response
+// and the channels a human expects.
+type LabelledPage struct {
+	Id string `json:"id"`
+	// detected on the title and content if empty
+	Lang       string          `json:"lang,omitempty"`
+	SegTitle   string          `json:"seg_title"`
+	SegContent string          `json:"seg_content"`
+	Keyword    json.RawMessage `json:"keyword"`
+	Channels   []string        `json:"channels"`
+}
+
+// LoadLabelledPages reads a json lines evaluation set, a page without id is given its line number.
+func LoadLabelledPages(path string) ([]LabelledPage, error) {
+	file, openErr := os.Open(path)
+	if openErr != nil {
+		return nil, openErr
+	}
+	defer file.Close()
+
+	pages := make([]LabelledPage, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo += 1
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var page LabelledPage
+		parseErr := json.Unmarshal(scanner.Bytes(), &page)
+		if parseErr != nil {
+			return nil, errors.New(fmt.Sprintf("parse line %d with error: %+v", lineNo, parseErr))
+		}
+		if len(page.Id) == 0 {
+			page.Id = strconv.Itoa(lineNo)
+		}
+		pages = append(pages, page)
+	}
+	return pages, scanner.Err()
+}
+
+// PredictChannels runs rankChannels and filterChannels of the model of lang, the channels are in output form, e.g. Italian^^Food.
+// A malformed recorded response is returned as an error.
+func (m *ChannelModel) PredictChannels(lang string, segTitle string, segContent string, keywordResp []byte) ([]string, []float64, error) {
+	pageContext, parseErr := parseKeywordResponse(segTitle, segContent, keywordResp, m.dimension)
+	if parseErr != nil {
+		return nil, nil, parseErr
+	}
+	if len(lang) == 0 {
+		lang = DetectLanguage(segTitle + " " + segContent)
+	}
+	channels, scores := m.classifyLanguageChannels(lang, pageContext)
+	return channels, scores, nil
+}
+
+// normalizeChannel compares predicted and labelled channels without case or ^^.
+func normalizeChannel(channel string) string {
+	return strings.ToLower(strings.TrimSpace(strings.ReplaceAll(channel, "^^", " ")))
+}
+
+// EvalMetrics are micro averaged: precision is hits over predicted channels in the top K, recall hits over labelled channels.
+type EvalMetrics struct {
+	K         int     `json:"k"`
+	Precision float64 `json:"precision"`
+	Recall    float64 `json:"recall"`
+	F1        float64 `json:"f1"`
+}
+
+// ChannelConfusion counts one channel over the full filtered predictions,
+// ConfusedWith is what was predicted on the pages where the channel was missed.
+type ChannelConfusion struct {
+	Channel      string         `json:"channel"`
+	TruePos      int            `json:"tp"`
+	FalsePos     int            `json:"fp"`
+	FalseNeg     int            `json:"fn"`
+	ConfusedWith map[string]int `json:"confused_with,omitempty"`
+}
+
+type PagePrediction struct {
+	Id        string   `json:"id"`
+	Labelled  []string `json:"labelled"`
+	Predicted []string `json:"predicted"`
+	Error     string   `json:"error,omitempty"`
+}
+
+type EvalReport struct {
+	Pages       int                 `json:"pages"`
+	Failed      int                 `json:"failed"`
+	Metrics     []EvalMetrics       `json:"metrics"`
+	Confusion   []*ChannelConfusion `json:"confusion"`
+	Predictions []PagePrediction    `json:"-"`
+}
+
+// Evaluate predicts every page with the model and scores the predictions at each K, K <= 0 means all predictions.
+func (m *ChannelModel) Evaluate(pages []LabelledPage, ks []int) *EvalReport {
+	report := &EvalReport{Pages: len(pages)}
+	for _, page := range pages {
+		prediction := PagePrediction{Id: page.Id, Labelled: page.Channels}
+		channels, _, predictErr := m.PredictChannels(page.Lang, page.SegTitle, page.SegContent, page.Keyword)
+		if predictErr != nil {
+			prediction.Error = predictErr.Error()
+			report.Failed += 1
+		}
+		prediction.Predicted = channels
+		report.Predictions = append(report.Predictions, prediction)
+	}
+
+	for _, k := range ks {
+		report.Metrics = append(report.Metrics, metricsAt(report.Predictions, k))
+	}
+	report.Confusion = confusion(report.Predictions)
+	return report
+}
+
+// ChangedPredictions returns the indexes of the pages predicted differently by the two reports of the same pages.
+func ChangedPredictions(candidate *EvalReport, baseline *EvalReport) []int {
+	changed := make([]int, 0)
+	for i := range candidate.Predictions {
+		if strings.Join(candidate.Predictions[i].Predicted, ",") != strings.Join(baseline.Predictions[i].Predicted, ",") {
+			changed = append(changed, i)
+		}
+	}
+	return changed
+}
+
+func metricsAt(predictions []PagePrediction, k int) EvalMetrics {
+	hits, predicted, labelled := 0, 0, 0
+	for _, prediction := range predictions {
+		gold := make(map[string]bool)
+		for _, channel := range prediction.Labelled {
+			gold[normalizeChannel(channel)] = true
+		}
+		top := prediction.Predicted
+		if k > 0 && len(top) > k {
+			top = top[:k]
+		}
+		for _, channel := range top {
+			if gold[normalizeChannel(channel)] {
+				hits += 1
+			}
+		}
+		predicted += len(top)
+		labelled += len(gold)
+	}
+
+	metrics := EvalMetrics{K: k}
+	if predicted > 0 {
+		metrics.Precision = float64(hits) / float64(predicted)
+	}
+	if labelled > 0 {
+		metrics.Recall = float64(hits) / float64(labelled)
+	}
+	if metrics.Precision+metrics.Recall > 0 {
+		metrics.F1 = 2 * metrics.Precision * metrics.Recall / (metrics.Precision + metrics.Recall)
+	}
+	return metrics
+}
+
+func confusion(predictions []PagePrediction) []*ChannelConfusion {
+	channels := make(map[string]*ChannelConfusion)
+	get := func(channel string) *ChannelConfusion {
+		item, ok := channels[channel]
+		if !ok {
+			item = &ChannelConfusion{Channel: channel}
+			channels[channel] = item
+		}
+		return item
+	}
+
+	for _, prediction := range predictions {
+		gold := make(map[string]bool)
+		for _, channel := range prediction.Labelled {
+			gold[normalizeChannel(channel)] = true
+		}
+		predicted := make(map[string]bool)
+		for _, channel := range prediction.Predicted {
+			predicted[normalizeChannel(channel)] = true
+		}
+		for channel := range predicted {
+			if gold[channel] {
+				get(channel).TruePos += 1
+			} else {
+				get(channel).FalsePos += 1
+			}
+		}
+		for channel := range gold {
+			if predicted[channel] {
+				continue
+			}
+			item := get(channel)
+			item.FalseNeg += 1
+			for other := range predicted {
+				if gold[other] {
+					continue
+				}
+				if item.ConfusedWith == nil {
+					item.ConfusedWith = make(map[string]int)
+				}
+				item.ConfusedWith[other] += 1
+			}
+		}
+	}
+
+	result := make([]*ChannelConfusion, 0, len(channels))
+	for _, item := range channels {
+		result = append(result, item)
+	}
+	// 按出现次数降序
+	sort.Slice(result, func(i, j int) bool {
+		supportI := result[i].TruePos + result[i].FalseNeg + result[i].FalsePos
+		supportJ := result[j].TruePos + result[j].FalseNeg + result[j].FalsePos
+		if supportI != supportJ {
+			return supportI > supportJ
+		}
+		return result[i].Channel < result[j].Channel
+	})
+	return result
+}
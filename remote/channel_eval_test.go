@@ -0,0 +1,63 @@
+package remote
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+// TestEvaluate scores testdata/eval/pages.jsonl: 5 labelled channels on 4 pages, the last page has a malformed
+// keyword response. The baseline with a higher threshold loses Cooking on the second page.
+func TestEvaluate(t *testing.T) {
+	pages, loadErr := LoadLabelledPages("../testdata/eval/pages.jsonl")
+	if loadErr != nil {
+		t.Fatalf("load pages with error: %+v", loadErr)
+	}
+	candidate, modelErr := LoadChannelModel("../testdata/e2e/model")
+	if modelErr != nil {
+		t.Fatalf("load channel model with error: %+v", modelErr)
+	}
+	baseline, baselineErr := LoadChannelModel("../testdata/e2e/model")
+	if baselineErr != nil {
+		t.Fatalf("load channel model with error: %+v", baselineErr)
+	}
+	baseline.SetScoreThreshold(0.85)
+
+	ks := []int{1, 0}
+	report := candidate.Evaluate(pages, ks)
+	baseReport := baseline.Evaluate(pages, ks)
+	if report.Pages != 4 || report.Failed != 1 || report.Predictions[3].Error == "" {
+		t.Errorf("pages: %d, failed: %d, want 4 and 1, the last with an error", report.Pages, report.Failed)
+	}
+
+	for _, c := range []struct {
+		name   string
+		report *EvalReport
+		want   []EvalMetrics
+	}{
+		// @1: 3 hits of 3 predicted, 5 labelled; @all: 4 hits of 4
+		{"candidate", report, []EvalMetrics{{K: 1, Precision: 1, Recall: 0.6, F1: 0.75}, {K: 0, Precision: 1, Recall: 0.8, F1: 8.0 / 9}}},
+		// @all: 3 hits of 3
+		{"baseline", baseReport, []EvalMetrics{{K: 1, Precision: 1, Recall: 0.6, F1: 0.75}, {K: 0, Precision: 1, Recall: 0.6, F1: 0.75}}},
+	} {
+		if len(c.report.Metrics) != len(c.want) {
+			t.Errorf("%s metrics: %+v", c.name, c.report.Metrics)
+			continue
+		}
+		for i, want := range c.want {
+			got := c.report.Metrics[i]
+			if got.K != want.K || math.Abs(got.Precision-want.Precision) > 1e-9 ||
+				math.Abs(got.Recall-want.Recall) > 1e-9 || math.Abs(got.F1-want.F1) > 1e-9 {
+				t.Errorf("%s metrics: %+v, want %+v", c.name, got, want)
+			}
+		}
+	}
+
+	if changed := ChangedPredictions(report, baseReport); !reflect.DeepEqual(changed, []int{1}) {
+		t.Errorf("changed predictions: %v, want [1]", changed)
+	}
+	basketball := report.Confusion[0]
+	if basketball.Channel != "basketball" || basketball.TruePos != 1 || basketball.FalseNeg != 1 {
+		t.Errorf("confusion: %+v, want basketball first with 1 tp and 1 fn", *basketball)
+	}
+}
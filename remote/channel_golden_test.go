@@ -0,0 +1,267 @@
+package remote
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// goldenCase is one fixture of a channel rule, Expect is the output recorded by the last update, null until then.
+type goldenCase struct {
+	Name   string          `json:"name"`
+	Rule   string          `json:"rule"`
+	Input  json.RawMessage `json:"input"`
+	Expect json.RawMessage `json:"expect"`
+}
+
+type goldenRule func(m *ChannelModel, input json.RawMessage) (interface{}, error)
+
+var goldenRules = map[string]goldenRule{
+	"channels":      goldenChannels,
+	"contain":       goldenContain,
+	"remove_entity": goldenRemoveEntity,
+	"kws_candidate": goldenKwsCandidate,
+	"is_number":     goldenIsNumber,
+	"tokenize":      goldenTokenize,
+	"language":      goldenLanguage,
+}
+
+type goldenScore struct {
+	Channel string  `json:"channel"`
+	Score   float64 `json:"score"`
+}
+
+type goldenChannelsOutput struct {
+	// only if not DefaultLanguage
+	Lang string `json:"lang,omitempty"`
+	// rankChannels, before filterChannels
+	Ranked   []goldenScore `json:"ranked"`
+	Channels []goldenScore `json:"channels"`
+}
+
+// 保留6位小数，避免浮点误差导致golden不稳定
+func roundScore(score float64) float64 {
+	return math.Round(score*1e6) / 1e6
+}
+
+func goldenScores(channels []string, scores []float64) []goldenScore {
+	result := make([]goldenScore, 0, len(channels))
+	for i := range channels {
+		result = append(result, goldenScore{Channel: channels[i], Score: roundScore(scores[i])})
+	}
+	return result
+}
+
+// input: {"seg_title", "seg_content", "keyword": <keyword service response>}
+func goldenChannels(m *ChannelModel, input json.RawMessage) (interface{}, error) {
+	var page LabelledPage
+	parseErr := json.Unmarshal(input, &page)
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	pageContext, contextErr := parseKeywordResponse(page.SegTitle, page.SegContent, page.Keyword, m.dimension)
+	if contextErr != nil {
+		return nil, contextErr
+	}
+	lang := page.Lang
+	if len(lang) == 0 {
+		lang = DetectLanguage(page.SegTitle + " " + page.SegContent)
+	}
+	channels, scores := m.classifyLanguageChannels(lang, pageContext)
+	output := &goldenChannelsOutput{
+		Ranked:   goldenScores(pageContext.channels, pageContext.scChannels),
+		Channels: goldenScores(channels, scores),
+	}
+	if lang != DefaultLanguage {
+		output.Lang = lang
+	}
+	return output, nil
+}
+
+// input: ["outer string", "inner string"], containWholeString of both orders
+func goldenContain(m *ChannelModel, input json.RawMessage) (interface{}, error) {
+	var pair []string
+	parseErr := json.Unmarshal(input, &pair)
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	if len(pair) != 2 {
+		return nil, errors.New(fmt.Sprintf("contain input needs 2 strings, got %d", len(pair)))
+	}
+	return []bool{containWholeString(pair[0], pair[1]), containWholeString(pair[1], pair[0])}, nil
+}
+
+func goldenRemoveEntity(m *ChannelModel, input json.RawMessage) (interface{}, error) {
+	var channel string
+	parseErr := json.Unmarshal(input, &channel)
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	return removeEntity(channel), nil
+}
+
+// input: {"title", "content", "categories"}, the output is sorted
+func goldenKwsCandidate(m *ChannelModel, input json.RawMessage) (interface{}, error) {
+	var page struct {
+		Title      string   `json:"title"`
+		Content    string   `json:"content"`
+		Categories []string `json:"categories"`
+	}
+	parseErr := json.Unmarshal(input, &page)
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	keywords := getKwsCandidate(page.Title, page.Content, page.Categories)
+	sort.Strings(keywords)
+	return keywords, nil
+}
+
+func goldenIsNumber(m *ChannelModel, input json.RawMessage) (interface{}, error) {
+	var word string
+	parseErr := json.Unmarshal(input, &word)
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	return isNumber(word), nil
+}
+
+var tokenKindNames = map[TokenKind]string{TokenWord: "word", TokenNumber: "number", TokenHashtag: "hashtag", TokenUrl: "url", TokenCJK: "cjk"}
+
+// output: [text, norm, kind] of every token
+func goldenTokenize(m *ChannelModel, input json.RawMessage) (interface{}, error) {
+	var text string
+	parseErr := json.Unmarshal(input, &text)
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	result := make([][]string, 0)
+	for _, token := range Tokenize(text) {
+		result = append(result, []string{token.Text, token.Norm, tokenKindNames[token.Kind]})
+	}
+	return result, nil
+}
+
+func goldenLanguage(m *ChannelModel, input json.RawMessage) (interface{}, error) {
+	var text string
+	parseErr := json.Unmarshal(input, &text)
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	return DetectLanguage(text), nil
+}
+
+func sameJson(x json.RawMessage, y json.RawMessage) bool {
+	var xValue, yValue interface{}
+	if json.Unmarshal(x, &xValue) != nil || json.Unmarshal(y, &yValue) != nil {
+		return false
+	}
+	return reflect.DeepEqual(xValue, yValue)
+}
+
+var updateGolden = flag.Bool("update", false, "write the outputs as the expects of the golden cases, review them with git diff")
+
+// TestChannelGolden checks the channel rules against the outputs recorded in testdata/golden/cases,
+// e.g. `go test ./remote -run 'TestChannelGolden/channels.json/entity'`.
+// After a rule change is intended, `-update` records the new outputs of the cases which run.
+func TestChannelGolden(t *testing.T) {
+	dir := "../testdata/golden"
+	model, modelErr := LoadChannelModel(filepath.Join(dir, "model"))
+	if modelErr != nil {
+		t.Fatalf("load channel model with error: %+v", modelErr)
+	}
+	paths, globErr := filepath.Glob(filepath.Join(dir, "cases", "*.json"))
+	if globErr != nil {
+		t.Fatal(globErr)
+	}
+	if len(paths) == 0 {
+		t.Fatalf("no case found in %s", filepath.Join(dir, "cases"))
+	}
+	for _, path := range paths {
+		path := path
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			runGoldenFile(t, model, path)
+		})
+	}
+}
+
+// runGoldenFile runs the cases of a fixture file (a json array of GoldenCase),
+// with -update the outputs are written back as the new expects instead of compared.
+func runGoldenFile(t *testing.T, m *ChannelModel, path string) {
+	data, readErr := ioutil.ReadFile(path)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	cases := make([]goldenCase, 0)
+	parseErr := json.Unmarshal(data, &cases)
+	if parseErr != nil {
+		t.Fatalf("parse golden file %s with error: %+v", path, parseErr)
+	}
+
+	changed := false
+	for i := range cases {
+		c := &cases[i]
+		t.Run(c.Name, func(t *testing.T) {
+			rule, ok := goldenRules[c.Rule]
+			if !ok {
+				t.Fatalf("unknown rule: %s", c.Rule)
+			}
+			output, ruleErr := rule(m, c.Input)
+			if ruleErr != nil {
+				// 错误也是规则的输出，e.g. 非法的keyword响应
+				output = map[string]string{"error": ruleErr.Error()}
+			}
+			actual, encodeErr := json.Marshal(output)
+			if encodeErr != nil {
+				t.Fatal(encodeErr)
+			}
+
+			if sameJson(c.Expect, actual) {
+				return
+			}
+			if *updateGolden {
+				t.Logf("update expect %s -> %s", string(c.Expect), string(actual))
+				c.Expect = actual
+				changed = true
+				return
+			}
+			t.Errorf("expect %s, got %s", string(c.Expect), string(actual))
+		})
+	}
+
+	if changed {
+		writeErr := writeGoldenFile(path, cases)
+		if writeErr != nil {
+			t.Fatal(writeErr)
+		}
+	}
+}
+
+// writeGoldenFile writes one case per line, so an update shows as a diff of the changed cases.
+func writeGoldenFile(path string, cases []goldenCase) error {
+	buffer := &bytes.Buffer{}
+	encoder := json.NewEncoder(buffer)
+	encoder.SetEscapeHTML(false)
+	buffer.WriteString("[\n")
+	for i := range cases {
+		buffer.WriteString("  ")
+		encodeErr := encoder.Encode(&cases[i])
+		if encodeErr != nil {
+			return encodeErr
+		}
+		// Encode ends with a newline
+		if i < len(cases)-1 {
+			buffer.Truncate(buffer.Len() - 1)
+			buffer.WriteString(",\n")
+		}
+	}
+	buffer.WriteString("]\n")
+	return ioutil.WriteFile(path, buffer.Bytes(), 0644)
+}
@@ -0,0 +1,344 @@
+package remote
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/golang/glog"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const DefaultChannelModelDir = "/mnt/models/fb-page-server/channel"
+const defaultScoreThreshold = 0.2
+
+// ChannelModel is what rankChannels and filterChannels run with, loaded from one model dir.
+// The files in the root of the dir are of DefaultLanguage, a sub dir named by a language code, e.g. es/ or zh/,
+// holds the same files for that language.
+type ChannelModel struct {
+	Language             string
+	stopWords            map[string]bool
+	blackList            map[string]bool
+	channelVectorMap     map[string][]float64
+	channelFormalFormMap map[string]string
+	channelIndexMap      map[string]map[string]bool
+	categoryChannelMap   map[string]map[string]float64
+	dimension            int
+	// localized channel name -> channel name of DefaultLanguage, from channel_name.txt
+	canonicalNameMap map[string]string
+	// nil without keyword_df.txt and word.vector
+	localKeyword *LocalKeywordModel
+	// models of the other languages, only in the model of DefaultLanguage
+	languages map[string]*ChannelModel
+	// channels scored at or below the threshold are filtered
+	ScoreThreshold float64
+}
+
+var channelModelDir = DefaultChannelModelDir
+
+// channelModel is used by the channel processor
+var channelModel *ChannelModel
+
+// SetChannelModelDir loads the channel model files from dir instead of /mnt/models, call it before LoadChannels.
+func SetChannelModelDir(dir string) {
+	channelModelDir = dir
+}
+
+func LoadChannels() error {
+	model, loadErr := LoadChannelModel(channelModelDir)
+	if loadErr != nil {
+		return loadErr
+	}
+	channelModel = model
+	return nil
+}
+
+// LoadChannelModel reads stopWord.txt, blacklist.txt, channel.vector.N and the optional category_channel.txt of dir,
+// then the models of the language sub dirs.
+func LoadChannelModel(dir string) (*ChannelModel, error) {
+	m, loadErr := loadLanguageModel(dir, DefaultLanguage)
+	if loadErr != nil {
+		return nil, loadErr
+	}
+	categoryErr := m.loadCategoryChannels(filepath.Join(dir, "category_channel.txt"))
+	if categoryErr != nil {
+		return nil, categoryErr
+	}
+
+	m.languages = make(map[string]*ChannelModel)
+	infos, listErr := ioutil.ReadDir(dir)
+	if listErr != nil {
+		return nil, listErr
+	}
+	for _, info := range infos {
+		lang := info.Name()
+		if !info.IsDir() || !isLanguageCode(lang) || lang == DefaultLanguage {
+			continue
+		}
+		languageModel, languageErr := loadLanguageModel(filepath.Join(dir, lang), lang)
+		if languageErr != nil {
+			return nil, errors.New(fmt.Sprintf("load %s channel model with error: %+v", lang, languageErr))
+		}
+		// keyword服务返回的向量与所有语言的channel向量比较
+		if languageModel.dimension != m.dimension {
+			return nil, errors.New(fmt.Sprintf("%s channel vector dimension %d is not %d", lang, languageModel.dimension, m.dimension))
+		}
+		for localized, canonical := range languageModel.canonicalNameMap {
+			formal, ok := m.channelFormalFormMap[NormalizeText(canonical)]
+			if !ok {
+				glog.Warningf("unknown channel in %s channel name file: %s", lang, canonical)
+				continue
+			}
+			languageModel.canonicalNameMap[localized] = formal
+		}
+		m.languages[lang] = languageModel
+		glog.Infof("load %s channel model, channels: %d", lang, len(languageModel.channelVectorMap))
+	}
+	return m, nil
+}
+
+func isLanguageCode(name string) bool {
+	if len(name) != 2 {
+		return false
+	}
+	for _, r := range name {
+		if r < 'a' || r > 'z' {
+			return false
+		}
+	}
+	return true
+}
+
+// forLanguage returns the model of lang, or m if lang has no model.
+func (m *ChannelModel) forLanguage(lang string) *ChannelModel {
+	languageModel, ok := m.languages[lang]
+	if !ok {
+		return m
+	}
+	return languageModel
+}
+
+// Languages returns the languages with a model, DefaultLanguage first.
+func (m *ChannelModel) Languages() []string {
+	languages := make([]string, 0, len(m.languages))
+	for lang := range m.languages {
+		languages = append(languages, lang)
+	}
+	sort.Strings(languages)
+	return append([]string{DefaultLanguage}, languages...)
+}
+
+// Dimension is the dimension of the channel vectors, the keyword service vectors are checked against it.
+func (m *ChannelModel) Dimension() int {
+	if m == nil {
+		return 0
+	}
+	return m.dimension
+}
+
+// SetScoreThreshold sets the threshold of the models of all languages.
+func (m *ChannelModel) SetScoreThreshold(threshold float64) {
+	m.ScoreThreshold = threshold
+	for _, languageModel := range m.languages {
+		languageModel.ScoreThreshold = threshold
+	}
+}
+
+// canonicalChannel returns the channel name of DefaultLanguage of a localized channel, in output form.
+func (m *ChannelModel) canonicalChannel(chn string) string {
+	canonical, ok := m.canonicalNameMap[NormalizeText(strings.ReplaceAll(chn, "^^", " "))]
+	if !ok {
+		return chn
+	}
+	return strings.ReplaceAll(canonical, " ", "^^")
+}
+
+func loadLanguageModel(dir string, lang string) (*ChannelModel, error) {
+	m := &ChannelModel{
+		Language:       lang,
+		ScoreThreshold: defaultScoreThreshold,
+	}
+	stopWordFilePath := filepath.Join(dir, "stopWord.txt")
+	blackListFilePath := filepath.Join(dir, "blacklist.txt")
+	channelVectorFilePath := filepath.Join(dir, "channel.vector.")
+
+	stopWordFile, stopWordErr := os.Open(stopWordFilePath)
+	if stopWordErr != nil {
+		return nil, stopWordErr
+	}
+	m.stopWords = make(map[string]bool)
+	scanner := bufio.NewScanner(stopWordFile)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(line) == 0 {
+			continue
+		}
+		splits := strings.Split(line, "\t")
+		word := NormalizeText(strings.TrimSpace(splits[0]))
+		m.stopWords[word] = true
+	}
+	stopWordFile.Close()
+
+	blackListFile, blackListErr := os.Open(blackListFilePath)
+	if blackListErr != nil {
+		return nil, blackListErr
+	}
+	m.blackList = make(map[string]bool)
+	scanner = bufio.NewScanner(blackListFile)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(line) == 0 {
+			continue
+		}
+		splits := strings.Split(line, "\t")
+		//有空格，无大写
+		channel := NormalizeText(strings.TrimSpace(splits[0]))
+		m.blackList[channel] = true
+	}
+	blackListFile.Close()
+
+	id := 0
+	dimension := -1
+	m.channelVectorMap = make(map[string][]float64)
+	m.channelFormalFormMap = make(map[string]string)
+	m.channelIndexMap = make(map[string]map[string]bool)
+	for {
+		channelVectorFile, channelVectorErr := os.Open(channelVectorFilePath + strconv.Itoa(id))
+		if channelVectorErr != nil {
+			break
+		}
+		scanner = bufio.NewScanner(channelVectorFile)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if len(line) == 0 {
+				continue
+			}
+			splits := strings.Split(line, "\t")
+			channel := splits[0]
+			vector := make([]float64, 0, len(splits)-1)
+			for i := 1; i < len(splits); i++ {
+				floatValue, floatErr := strconv.ParseFloat(splits[i], 64)
+				if floatErr != nil {
+					return nil, errors.New(fmt.Sprintf("parse to vector fail, line: %s", line))
+				}
+				vector = append(vector, floatValue)
+			}
+			if dimension < 0 {
+				dimension = len(vector)
+			} else if dimension != len(vector) {
+				return nil, errors.New(fmt.Sprintf("dimention not same in channel vector files, line: %s", line))
+			}
+			_, ok := m.channelVectorMap[channel]
+			if !ok {
+				//有空格，有大写
+				m.channelVectorMap[channel] = vector
+				//key有空格，无大写；value有空格，有大写
+				m.channelFormalFormMap[NormalizeText(channel)] = channel
+			}
+			for _, word := range tokenWords(Tokenize(channel), true) {
+				_, stop := m.stopWords[word]
+				if !stop {
+					channels, exist := m.channelIndexMap[word]
+					if !exist {
+						channels = make(map[string]bool)
+					}
+					channels[NormalizeText(channel)] = true
+					//key单个词，无大写；value有空格，无大写
+					m.channelIndexMap[word] = channels
+				}
+			}
+		}
+		id += 1
+		channelVectorFile.Close()
+	}
+
+	if dimension < 0 {
+		return nil, errors.New(fmt.Sprintf("no channel vector file in %s", dir))
+	}
+	localKeyword, localErr := loadLocalKeywordModel(dir, dimension)
+	if localErr != nil {
+		return nil, localErr
+	}
+	m.localKeyword = localKeyword
+	m.dimension = dimension
+	return m, m.loadCanonicalNames(filepath.Join(dir, "channel_name.txt"))
+}
+
+// channel_name.txt: localized channel \t channel of DefaultLanguage, the channels are output in DefaultLanguage
+func (m *ChannelModel) loadCanonicalNames(channelNameFilePath string) error {
+	m.canonicalNameMap = make(map[string]string)
+	channelNameFile, channelNameErr := os.Open(channelNameFilePath)
+	if channelNameErr != nil {
+		if os.IsNotExist(channelNameErr) {
+			return nil
+		}
+		return channelNameErr
+	}
+	defer channelNameFile.Close()
+
+	scanner := bufio.NewScanner(channelNameFile)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(line) == 0 {
+			continue
+		}
+		splits := strings.Split(line, "\t")
+		if len(splits) < 2 {
+			return errors.New(fmt.Sprintf("parse channel name fail, line: %s", line))
+		}
+		m.canonicalNameMap[NormalizeText(strings.TrimSpace(splits[0]))] = strings.TrimSpace(splits[1])
+	}
+	return scanner.Err()
+}
+
+// category_channel.txt: facebook category \t channel [\t score]
+func (m *ChannelModel) loadCategoryChannels(categoryChannelFilePath string) error {
+	m.categoryChannelMap = make(map[string]map[string]float64)
+	categoryChannelFile, categoryChannelErr := os.Open(categoryChannelFilePath)
+	if categoryChannelErr != nil {
+		if os.IsNotExist(categoryChannelErr) {
+			glog.Warningf("category channel file not found: %s, category fallback disabled", categoryChannelFilePath)
+			return nil
+		}
+		return categoryChannelErr
+	}
+	defer categoryChannelFile.Close()
+
+	scanner := bufio.NewScanner(categoryChannelFile)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(line) == 0 {
+			continue
+		}
+		splits := strings.Split(line, "\t")
+		if len(splits) < 2 {
+			return errors.New(fmt.Sprintf("parse category channel fail, line: %s", line))
+		}
+		category := strings.ToLower(strings.TrimSpace(splits[0]))
+		//有空格，有大写
+		channel, ok := m.channelFormalFormMap[NormalizeText(strings.TrimSpace(splits[1]))]
+		if !ok {
+			glog.Warningf("unknown channel in category channel file, line: %s", line)
+			continue
+		}
+		score := 0.0
+		if len(splits) > 2 {
+			floatValue, floatErr := strconv.ParseFloat(strings.TrimSpace(splits[2]), 64)
+			if floatErr != nil {
+				return errors.New(fmt.Sprintf("parse category channel score fail, line: %s", line))
+			}
+			score = floatValue
+		}
+		channels, exist := m.categoryChannelMap[category]
+		if !exist {
+			channels = make(map[string]float64)
+			m.categoryChannelMap[category] = channels
+		}
+		channels[channel] = score
+	}
+	return scanner.Err()
+}
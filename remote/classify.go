@@ -0,0 +1,91 @@
+package remote
+
+import (
+	"context"
+	"github.com/ParticleMedia/fb_page_server/common"
+	"sort"
+)
+
+// PageClassification is what the pipeline computes for one page, with the intermediate channel results if explained.
+type PageClassification struct {
+	Id           string             `json:"id"`
+	Name         string             `json:"name"`
+	Language     string             `json:"language"`
+	TextCategory *TextCategory      `json:"text_category,omitempty"`
+	Channels     map[string]float64 `json:"channels,omitempty"`
+	Explain      *ChannelExplain    `json:"explain,omitempty"`
+	Errors       []string           `json:"errors,omitempty"`
+}
+
+// ChannelExplain shows how the channels of a page are chosen: the candidates sent to the keyword service,
+// the keywords it (or the local fallback) returns, the channels before and after filterChannels, and the facebook category fallback.
+type ChannelExplain struct {
+	KwsCandidate []string `json:"kws_candidate"`
+	// service, local if the keyword service failed and the local fallback is used, or cache if the page cache is hit
+	KeywordSource    string             `json:"keyword_source,omitempty"`
+	Keywords         []string           `json:"keywords"`
+	KeywordScores    []float64          `json:"keyword_scores"`
+	RankedChannels   []string           `json:"ranked_channels"`
+	RankedScores     []float64          `json:"ranked_scores"`
+	FilteredChannels []string           `json:"filtered_channels"`
+	FilteredScores   []float64          `json:"filtered_scores"`
+	CategoryChannels map[string]float64 `json:"category_channels"`
+	// error of the keyword service, reported in PageClassification.Errors
+	keywordErr error
+}
+
+func newChannelExplain(page *common.FBPage, conf *common.Config) *ChannelExplain {
+	candidates := getKwsCandidate(page.Name, page.Content(), page.Categories())
+	sort.Strings(candidates)
+	return &ChannelExplain{
+		KwsCandidate:     candidates,
+		CategoryChannels: getChannelFromCategory(page, conf),
+	}
+}
+
+// fill takes the keywords and ranked channels of pageContext, after classifyChannels, and the filtered channels.
+func (e *ChannelExplain) fill(pageContext *PageContext, channels []string, scores []float64) {
+	e.Keywords = pageContext.keywords
+	e.KeywordScores = pageContext.scores
+	e.RankedChannels = pageContext.channels
+	e.RankedScores = pageContext.scChannels
+	e.FilteredChannels = channels
+	e.FilteredScores = scores
+}
+
+// ClassifyPage returns the text category and channels of page the same way the processors compute them,
+// including the page cache unless DisablePageCache is called; ReadOnlyPageCache keeps it from being written.
+func ClassifyPage(ctx context.Context, page *common.FBPage, explain bool, conf *common.Config) *PageClassification {
+	result := &PageClassification{
+		Id:       page.Id,
+		Name:     page.Name,
+		Language: pageLanguage(page),
+	}
+
+	tcat, tcatErr := getTextCategory(ctx, page, conf)
+	if tcatErr != nil {
+		result.Errors = append(result.Errors, "text_category: "+tcatErr.Error())
+	} else {
+		result.TextCategory = &tcat.Tcats
+	}
+
+	var explanation *ChannelExplain
+	if explain {
+		explanation = newChannelExplain(page, conf)
+	}
+	// explain来自得出结果的同一次keyword请求
+	channels, chnErr := getChannelExplained(ctx, page, conf, explanation)
+	if chnErr != nil {
+		result.Errors = append(result.Errors, "channel: "+chnErr.Error())
+	} else {
+		result.Channels = channels
+	}
+
+	if explanation != nil {
+		if explanation.keywordErr != nil {
+			result.Errors = append(result.Errors, "keyword: "+explanation.keywordErr.Error())
+		}
+		result.Explain = explanation
+	}
+	return result
+}
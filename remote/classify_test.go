@@ -0,0 +1,79 @@
+package remote
+
+import (
+	"context"
+	"github.com/ParticleMedia/fb_page_server/common"
+	"github.com/ParticleMedia/fb_page_server/internal/testutil/fake"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestClassifyPagesWithoutId classifies two different ad-hoc pages through a read-only cache:
+// neither may see the other's result or a row cached under _id "", and nothing is written.
+func TestClassifyPagesWithoutId(t *testing.T) {
+	tcat := fake.NewTextCategoryServer(nil, []fake.TextCategoryRule{
+		{Pattern: "basketball", FirstCats: map[string]float64{"Sports": 0.9}},
+		{Pattern: "pizzeria", FirstCats: map[string]float64{"Food": 0.6}},
+	})
+	tcatServer := httptest.NewServer(tcat)
+	defer tcatServer.Close()
+	keyword := fake.NewKeywordServer(nil, []fake.KeywordRule{
+		{Pattern: "basketball", Keywords: map[string]float64{"Basketball": 0.9}, Vector: []float64{1, 0, 0}},
+		{Pattern: "pizzeria", Keywords: map[string]float64{"Italian Food": 0.8}, Vector: []float64{0, 0.8, 0.6}},
+	}, 3)
+	keywordServer := httptest.NewServer(keyword)
+	defer keywordServer.Close()
+
+	conf := &common.Config{}
+	conf.TcatConf.Uri = tcatServer.URL
+	conf.TcatConf.Collection = "page_tcat"
+	conf.ChnConf.Uri = keywordServer.URL
+	conf.ChnConf.Collection = "page_chn"
+	conf.ChnConf.CategoryScore = 0.5
+
+	SetChannelModelDir("../testdata/e2e/model")
+	if loadErr := LoadChannels(); loadErr != nil {
+		t.Fatalf("load channel model with error: %+v", loadErr)
+	}
+	ctx := context.Background()
+	store := fake.NewPageStore()
+	// a junk row left by an older classify
+	store.Replace(ctx, "page_tcat", "", PageTcat{Id: "", Tcat: map[string]map[string]float64{firstCatLevel: {"Music": 1}}})
+	oldStore := pageStore
+	defer SetPageStore(oldStore)
+	SetPageStore(store)
+	ReadOnlyPageCache()
+
+	basketball := ClassifyPage(ctx, &common.FBPage{Name: "Lakers Basketball"}, false, conf)
+	pizzeria := ClassifyPage(ctx, &common.FBPage{Name: "Mario Pizzeria"}, false, conf)
+
+	for _, c := range []struct {
+		result   *PageClassification
+		category string
+		channel  string
+	}{
+		{basketball, "Sports", "Basketball"},
+		{pizzeria, "Food", "Italian^^Food"},
+	} {
+		if len(c.result.Errors) != 0 {
+			t.Errorf("%s with errors: %v", c.result.Name, c.result.Errors)
+			continue
+		}
+		firstCats := c.result.TextCategory.FirstCats
+		if len(firstCats) != 1 || firstCats[c.category] == 0 {
+			t.Errorf("%s first_cat: %v, want only %s", c.result.Name, firstCats, c.category)
+		}
+		if len(c.result.Channels) != 1 || c.result.Channels[c.channel] == 0 {
+			t.Errorf("%s channels: %v, want only %s", c.result.Name, c.result.Channels, c.channel)
+		}
+	}
+	if keys := store.Keys("page_tcat"); len(keys) != 1 {
+		t.Errorf("page_tcat written: %v", keys)
+	}
+	if keys := store.Keys("page_chn"); len(keys) != 0 {
+		t.Errorf("page_chn written: %v", keys)
+	}
+	if tcat.Requests() != 2 || keyword.Requests() != 2 {
+		t.Errorf("requests: text_category %d, keyword %d, want 2 each", tcat.Requests(), keyword.Requests())
+	}
+}
@@ -0,0 +1,97 @@
+package remote
+
+import (
+	"context"
+	"github.com/ParticleMedia/fb_page_server/common"
+	"github.com/golang/glog"
+	"go.mongodb.org/mongo-driver/mongo"
+	"strconv"
+)
+
+// DeleteProfiles removes the ups profiles of the given processors, e.g. when no page of the user can be classified.
+func DeleteProfiles(ctx context.Context, key uint64, processors []Processor, conf *common.Config) error {
+	if !conf.DeleteConf.Enable || len(processors) == 0 {
+		return nil
+	}
+	profiles := make([]string, 0, len(processors))
+	for _, processor := range processors {
+		profiles = append(profiles, processor.Config().Profile)
+	}
+	glog.Infof("ready to delete from ups, profiles: %v, key: %d", profiles, key)
+	delErr := deleteProfiles(ctx, key, profiles, conf)
+	if delErr != nil {
+		return delErr
+	}
+	for _, processor := range processors {
+		mergeErr := deleteMergeTime(ctx, processor.Config().Profile, key, processor.Config().Merge)
+		if mergeErr != nil {
+			return mergeErr
+		}
+	}
+	return nil
+}
+
+// DeleteUser handles a deauthorized user: deletes every ups profile with its merge time, the user state and, if configured,
+// the page caches that no other user refers to.
+func DeleteUser(ctx context.Context, key uint64, conf *common.Config) error {
+	if !conf.DeleteConf.Enable {
+		return nil
+	}
+
+	unlock := lockUser(key)
+	defer unlock()
+
+	delErr := DeleteProfiles(ctx, key, EnabledProcessors(), conf)
+	if delErr != nil {
+		return delErr
+	}
+
+	if !conf.IncrConf.Enable {
+		if conf.DeleteConf.PurgePages {
+			glog.Warningf("purge pages needs incremental user state, skipped, key: %d", key)
+		}
+		return nil
+	}
+
+	state, getErr := getUserStateFromMongo(ctx, key, conf)
+	if getErr == mongo.ErrNoDocuments {
+		return nil
+	} else if getErr != nil {
+		return getErr
+	}
+
+	stateErr := deleteUserStateFromMongo(ctx, key, conf)
+	if stateErr != nil && stateErr != mongo.ErrNoDocuments {
+		return stateErr
+	}
+
+	unreferenced := updatePageRefs(ctx, state.pageIds(), nil, conf)
+	if conf.DeleteConf.PurgePages {
+		purgePages(ctx, unreferenced, conf)
+	}
+	return nil
+}
+
+// purgePages deletes the caches and the user count of pages no user state contains.
+func purgePages(ctx context.Context, pageIds []string, conf *common.Config) {
+	for _, pageId := range pageIds {
+		for _, processor := range EnabledProcessors() {
+			purgeErr := deletePageFromMongo(ctx, pageId, processor.Config().Collection, conf)
+			if purgeErr != nil && purgeErr != mongo.ErrNoDocuments {
+				glog.Warningf("purge %s page cache with error: %+v, page: %s", processor.Name(), purgeErr, pageId)
+			}
+		}
+		refErr := deletePageFromMongo(ctx, pageId, conf.IncrConf.PageRefCollection, conf)
+		if refErr != nil && refErr != mongo.ErrNoDocuments {
+			glog.Warningf("purge page users count with error: %+v, page: %s", refErr, pageId)
+		}
+	}
+}
+
+func deleteUserStateFromMongo(ctx context.Context, key uint64, conf *common.Config) error {
+	return pageStore.Delete(ctx, conf.IncrConf.Collection, strconv.FormatUint(key, 10))
+}
+
+func deletePageFromMongo(ctx context.Context, key string, collection string, conf *common.Config) error {
+	return pageStore.Delete(ctx, collection, key)
+}
@@ -0,0 +1,209 @@
+package remote
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ParticleMedia/fb_page_server/common"
+	user_profile_pb "github.com/ParticleMedia/fb_page_server/proto"
+	"google.golang.org/protobuf/encoding/protowire"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// names of multi-level features are written as level#name
+const levelSeparator = "#"
+
+// compact 的 name 中的分隔符转义
+var (
+	compactEscaper   = strings.NewReplacer("%", "%25", ",", "%2C", ":", "%3A")
+	compactUnescaper = strings.NewReplacer("%25", "%", "%2C", ",", "%3A", ":")
+)
+
+var defaultEncoding = common.EncodingJson
+
+// SetDefaultEncoding keeps user_profile.format working for processors without output.encoding.
+func SetDefaultEncoding(conf *common.UserProfileConfig) error {
+	encoding, formatErr := conf.DefaultEncoding()
+	if formatErr != nil {
+		return formatErr
+	}
+	defaultEncoding = encoding
+	return nil
+}
+
+func outputEncoding(conf *common.OutputConfig) string {
+	if len(conf.Encoding) == 0 {
+		return defaultEncoding
+	}
+	return conf.Encoding
+}
+
+// encodeFeature returns the value in the format WriteToUps takes, and the ups type of the value.
+func encodeFeature(processor Processor, feature Feature) (string, user_profile_pb.ProfileValueType, error) {
+	conf := processor.Config().Output
+	switch outputEncoding(conf) {
+	case common.EncodingJson:
+		value, encodeErr := processor.Encode(feature)
+		return value, user_profile_pb.ProfileValueType_STRING, encodeErr
+	case common.EncodingList:
+		// 按score降序的前top_k个name
+		names := sortedNames(flattenFeature(feature, processor.Levels()))
+		if conf.TopK > 0 && len(names) > conf.TopK {
+			names = names[:conf.TopK]
+		}
+		value, encodeErr := json.Marshal(names)
+		return string(value), user_profile_pb.ProfileValueType_LIST, encodeErr
+	case common.EncodingRawBytes:
+		value := base64.StdEncoding.EncodeToString(marshalScoreMap(flattenFeature(feature, processor.Levels())))
+		return value, user_profile_pb.ProfileValueType_RAW_BYTES, nil
+	case common.EncodingCompact:
+		// name:score,name:score 按score降序, name 中的 % , : 被转义
+		scores := flattenFeature(feature, processor.Levels())
+		items := make([]string, 0, len(scores))
+		for _, name := range sortedNames(scores) {
+			items = append(items, compactEscaper.Replace(name)+":"+strconv.FormatFloat(scores[name], 'g', 6, 64))
+		}
+		return strings.Join(items, ","), user_profile_pb.ProfileValueType_STRING, nil
+	default:
+		return "", user_profile_pb.ProfileValueType_UNKNOW, errors.New(fmt.Sprintf("unsupported output encoding: %s", conf.Encoding))
+	}
+}
+
+// decodeFeature is the reverse of encodeFeature, except for list which keeps no score.
+func decodeFeature(processor Processor, value string) (Feature, error) {
+	conf := processor.Config().Output
+	switch outputEncoding(conf) {
+	case common.EncodingJson:
+		return processor.Decode(value)
+	case common.EncodingRawBytes:
+		data, decodeErr := base64.StdEncoding.DecodeString(value)
+		if decodeErr != nil {
+			return nil, decodeErr
+		}
+		scores, parseErr := unmarshalScoreMap(data)
+		if parseErr != nil {
+			return nil, parseErr
+		}
+		return unflattenFeature(scores, processor.Levels()), nil
+	case common.EncodingCompact:
+		scores := make(map[string]float64)
+		for _, item := range strings.Split(value, ",") {
+			if len(item) == 0 {
+				continue
+			}
+			index := strings.LastIndex(item, ":")
+			if index < 0 {
+				return nil, errors.New(fmt.Sprintf("parse compact item fail, item: %s", item))
+			}
+			score, parseErr := strconv.ParseFloat(item[index+1:], 64)
+			if parseErr != nil {
+				return nil, parseErr
+			}
+			scores[compactUnescaper.Replace(item[:index])] = score
+		}
+		return unflattenFeature(scores, processor.Levels()), nil
+	default:
+		return nil, errors.New(fmt.Sprintf("can not decode output encoding: %s", outputEncoding(conf)))
+	}
+}
+
+func flattenFeature(feature Feature, levels []string) map[string]float64 {
+	if len(levels) == 1 {
+		return feature[levels[0]]
+	}
+	flatten := make(map[string]float64)
+	for level, scores := range feature {
+		for name, score := range scores {
+			flatten[level+levelSeparator+name] = score
+		}
+	}
+	return flatten
+}
+
+func unflattenFeature(scores map[string]float64, levels []string) Feature {
+	if len(levels) == 1 {
+		return Feature{levels[0]: scores}
+	}
+	feature := make(Feature)
+	for name, score := range scores {
+		index := strings.Index(name, levelSeparator)
+		if index < 0 {
+			continue
+		}
+		level := name[:index]
+		if feature[level] == nil {
+			feature[level] = make(map[string]float64)
+		}
+		feature[level][name[index+len(levelSeparator):]] = score
+	}
+	return feature
+}
+
+// marshalScoreMap encodes scores as the protobuf message `message ScoreMap { map<string, double> scores = 1; }`,
+// with entries ordered by score desc so the output is stable.
+func marshalScoreMap(scores map[string]float64) []byte {
+	var data []byte
+	for _, name := range sortedNames(scores) {
+		var entry []byte
+		entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+		entry = protowire.AppendString(entry, name)
+		entry = protowire.AppendTag(entry, 2, protowire.Fixed64Type)
+		entry = protowire.AppendFixed64(entry, math.Float64bits(scores[name]))
+
+		data = protowire.AppendTag(data, 1, protowire.BytesType)
+		data = protowire.AppendBytes(data, entry)
+	}
+	return data
+}
+
+func unmarshalScoreMap(data []byte) (map[string]float64, error) {
+	scores := make(map[string]float64)
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		data = data[n:]
+		if num != 1 || typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			data = data[n:]
+			continue
+		}
+		entry, n := protowire.ConsumeBytes(data)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		name, score := "", 0.0
+		for len(entry) > 0 {
+			entryNum, entryTyp, m := protowire.ConsumeTag(entry)
+			if m < 0 {
+				return nil, protowire.ParseError(m)
+			}
+			entry = entry[m:]
+			switch {
+			case entryNum == 1 && entryTyp == protowire.BytesType:
+				name, m = protowire.ConsumeString(entry)
+			case entryNum == 2 && entryTyp == protowire.Fixed64Type:
+				var bits uint64
+				bits, m = protowire.ConsumeFixed64(entry)
+				score = math.Float64frombits(bits)
+			default:
+				m = protowire.ConsumeFieldValue(entryNum, entryTyp, entry)
+			}
+			if m < 0 {
+				return nil, protowire.ParseError(m)
+			}
+			entry = entry[m:]
+		}
+		scores[name] = score
+	}
+	return scores, nil
+}
@@ -0,0 +1,93 @@
+package remote
+
+import (
+	"github.com/ParticleMedia/fb_page_server/common"
+	"testing"
+)
+
+// sameFeature compares features ignoring empty levels, which not every encoding keeps
+func sameFeature(a, b Feature) bool {
+	for _, pair := range [][2]Feature{{a, b}, {b, a}} {
+		for level, scores := range pair[0] {
+			if len(scores) != len(pair[1][level]) {
+				return false
+			}
+			for name, score := range scores {
+				other, ok := pair[1][level][name]
+				if !ok || other != score {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+func TestEncodingRoundtrip(t *testing.T) {
+	conf := &common.Config{}
+	processors := []Processor{&textCategoryProcessor{conf: conf}, &channelProcessor{conf: conf}}
+	features := map[string][]Feature{
+		"text_category": {
+			{},
+			{firstCatLevel: {}, secondCatLevel: {}, thirdCatLevel: {}},
+			{firstCatLevel: {"Sports": 0.9, "Music": 0.25}, secondCatLevel: {"Sports_Basketball": 0.5}},
+			{firstCatLevel: {"美食": 0.8, "Café": 0.125}, thirdCatLevel: {"a,b:c%2C#d": 0.5}},
+		},
+		"channel": {
+			{channelLevel: {}},
+			{channelLevel: {"Basketball": 0.9, "Italian^^Food": 0.75}},
+			{channelLevel: {"日本料理": 0.5, "Crème brûlée": 0.375, "x:1,y:2": 1, "100%": 0.5}},
+		},
+	}
+	for _, encoding := range []string{common.EncodingJson, common.EncodingRawBytes, common.EncodingCompact} {
+		conf.TcatConf.Output.Encoding = encoding
+		conf.ChnConf.Output.Encoding = encoding
+		for _, processor := range processors {
+			for _, feature := range features[processor.Name()] {
+				value, _, encodeErr := encodeFeature(processor, feature)
+				if encodeErr != nil {
+					t.Errorf("%s encode %s %v with error: %+v", encoding, processor.Name(), feature, encodeErr)
+					continue
+				}
+				decoded, decodeErr := decodeFeature(processor, value)
+				if decodeErr != nil {
+					t.Errorf("%s decode %s %q with error: %+v", encoding, processor.Name(), value, decodeErr)
+					continue
+				}
+				if !sameFeature(feature, decoded) {
+					t.Errorf("%s roundtrip of %s: %v, got %v from %q", encoding, processor.Name(), feature, decoded, value)
+				}
+			}
+		}
+	}
+}
+
+func TestEncodingListNotDecodable(t *testing.T) {
+	conf := &common.Config{}
+	conf.ChnConf.Output = common.OutputConfig{Encoding: common.EncodingList, TopK: 1}
+	processor := &channelProcessor{conf: conf}
+	value, _, encodeErr := encodeFeature(processor, Feature{channelLevel: {"Basketball": 0.9, "日本料理": 0.5}})
+	if encodeErr != nil || value != `["Basketball"]` {
+		t.Errorf("list: %s, error: %+v", value, encodeErr)
+	}
+	if _, decodeErr := decodeFeature(processor, value); decodeErr == nil {
+		t.Errorf("list decoded without error")
+	}
+}
+
+func TestSetDefaultEncoding(t *testing.T) {
+	defer func() { defaultEncoding = common.EncodingJson }()
+	for format, want := range map[string]string{
+		"":          common.EncodingJson,
+		"string":    common.EncodingJson,
+		"list":      common.EncodingList,
+		"RAW_BYTES": common.EncodingRawBytes,
+	} {
+		if setErr := SetDefaultEncoding(&common.UserProfileConfig{Format: format}); setErr != nil || defaultEncoding != want {
+			t.Errorf("format %q: %s, error: %+v, want %s", format, defaultEncoding, setErr, want)
+		}
+	}
+	if setErr := SetDefaultEncoding(&common.UserProfileConfig{Format: "protobuf"}); setErr == nil {
+		t.Errorf("unknown format accepted")
+	}
+}
@@ -0,0 +1,143 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ParticleMedia/fb_page_server/common"
+	"github.com/golang/glog"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const maxErrorBodySnippet = 256
+
+type RemoteErrorKind string
+
+const (
+	RemoteTimeout RemoteErrorKind = "timeout"
+	// the connection failed, e.g. refused or reset
+	RemoteUnavailable RemoteErrorKind = "unavailable"
+	RemoteServerError RemoteErrorKind = "server_error"
+	// 429
+	RemoteThrottled RemoteErrorKind = "throttled"
+	// other 4xx, the request itself is wrong and retrying does not help
+	RemoteRejected    RemoteErrorKind = "rejected"
+	RemoteBadResponse RemoteErrorKind = "bad_response"
+	// not called as the breaker of the service is open
+	RemoteBreakerOpen RemoteErrorKind = "breaker_open"
+)
+
+var errBreakerOpen = errors.New("circuit breaker is open")
+
+// RemoteError classifies a failed call to a remote service, Status is the http status if a response is received.
+type RemoteError struct {
+	Service string
+	Kind    RemoteErrorKind
+	Status  int
+	Err     error
+}
+
+func (e *RemoteError) Error() string {
+	if e.Status != 0 {
+		return fmt.Sprintf("%s resp code: %d", e.Service, e.Status)
+	}
+	return fmt.Sprintf("%s %s: %v", e.Service, e.Kind, e.Err)
+}
+
+func (e *RemoteError) Unwrap() error {
+	return e.Err
+}
+
+// Retryable is true for the errors which may succeed on a later call.
+func (e *RemoteError) Retryable() bool {
+	switch e.Kind {
+	case RemoteTimeout, RemoteUnavailable, RemoteServerError, RemoteThrottled:
+		return true
+	}
+	return false
+}
+
+// IsRemoteError returns the kind of err if it is a RemoteError.
+func IsRemoteError(err error) (RemoteErrorKind, bool) {
+	var remoteErr *RemoteError
+	if errors.As(err, &remoteErr) {
+		return remoteErr.Kind, true
+	}
+	return "", false
+}
+
+const logIdHeader = "X-Log-Id"
+
+// newRequest binds the request to ctx, and sends the log id of the trace of ctx so the services can log it.
+func newRequest(ctx context.Context, method string, uri string, contentType string, body []byte) (*http.Request, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, reqErr := http.NewRequestWithContext(ctx, method, uri, reader)
+	if reqErr != nil {
+		return nil, reqErr
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set(logIdHeader, strconv.FormatInt(common.LogId(ctx), 10))
+	return req, nil
+}
+
+// newHttpClient builds a client with its own transport, so the connections of one service are not limited by another.
+func newHttpClient(conf *common.HttpClientConfig) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   time.Duration(conf.ConnectTimeout) * time.Millisecond,
+		KeepAlive: 30 * time.Second,
+	}
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         dialer.DialContext,
+		MaxIdleConns:        conf.MaxIdleConnsPerHost,
+		MaxIdleConnsPerHost: conf.MaxIdleConnsPerHost,
+		MaxConnsPerHost:     conf.MaxConnsPerHost,
+		IdleConnTimeout:     time.Duration(conf.IdleConnTimeout) * time.Second,
+		DisableKeepAlives:   conf.DisableKeepAlive,
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   time.Duration(conf.Timeout) * time.Millisecond,
+	}
+}
+
+func requestError(service string, err error) *RemoteError {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return &RemoteError{Service: service, Kind: RemoteTimeout, Err: err}
+	}
+	return &RemoteError{Service: service, Kind: RemoteUnavailable, Err: err}
+}
+
+// statusError reads a snippet of the body of a non-200 response for the log, and drains the rest so the connection is reused.
+func statusError(service string, resp *http.Response) *RemoteError {
+	snippet, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBodySnippet))
+	io.Copy(ioutil.Discard, resp.Body)
+
+	kind := RemoteRejected
+	if resp.StatusCode == http.StatusTooManyRequests {
+		kind = RemoteThrottled
+	} else if resp.StatusCode >= 500 {
+		kind = RemoteServerError
+	} else if resp.StatusCode < 400 {
+		kind = RemoteBadResponse
+	}
+	glog.Warningf("%s resp code: %d, kind: %s, body: %q", service, resp.StatusCode, kind, snippet)
+	return &RemoteError{
+		Service: service,
+		Kind:    kind,
+		Status:  resp.StatusCode,
+		Err:     errors.New(string(snippet)),
+	}
+}
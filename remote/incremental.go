@@ -0,0 +1,345 @@
+package remote
+
+import (
+	"context"
+	"errors"
+	"github.com/ParticleMedia/fb_page_server/common"
+	"github.com/golang/glog"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const userLockCnt = 64
+
+// serialize read-modify-write of the same uid inside one instance, kafka partitions by uid across instances
+var userLocks [userLockCnt]sync.Mutex
+
+// UserState keeps the running sums of every processor, so like/unlike events can update ups without the full like list.
+type UserState struct {
+	Id string `bson:"_id"`
+	// page id -> processor -> what the page added to the sums
+	Pages map[string]map[string]*PageState `bson:"page_states"`
+	// processor -> weighted score sums, stored as a list since channel names may contain '.'
+	Sums map[string][]StateScore `bson:"sums"`
+	// processor -> total weight, equal to the page count without decay and popularity weighting
+	Weights    map[string]float64 `bson:"weights"`
+	UpdateTime int64              `bson:"update_time"`
+}
+
+// PageState is the weight and feature a liked page was added with, unlike subtracts exactly these
+// instead of computing the page again, whose cache may have changed or be unavailable.
+type PageState struct {
+	Weight float64      `bson:"weight"`
+	Scores []StateScore `bson:"scores"`
+}
+
+type StateScore struct {
+	Level string  `bson:"level"`
+	Name  string  `bson:"name"`
+	Score float64 `bson:"score"`
+}
+
+func NewUserState(key uint64) *UserState {
+	return &UserState{
+		Id:      strconv.FormatUint(key, 10),
+		Pages:   make(map[string]map[string]*PageState),
+		Sums:    make(map[string][]StateScore),
+		Weights: make(map[string]float64),
+	}
+}
+
+func lockUser(key uint64) func() {
+	lock := &userLocks[key%userLockCnt]
+	lock.Lock()
+	return lock.Unlock
+}
+
+// ProcessEvent applies a like/unlike event on the stored sums and writes the new average to ups.
+func ProcessEvent(ctx context.Context, event *common.FBEvent, conf *common.Config) error {
+	if !conf.IncrConf.Enable {
+		return errors.New("incremental is not enabled")
+	}
+
+	// 远程计算不持有锁，只有读写state和ups时持有
+	features := make(map[string]Feature)
+	var popularity *pagePopularity
+	if event.Event == common.FBEventLike {
+		if usePopularity() {
+			popularity = loadPagePopularity(ctx, []string{event.Page.Id}, conf)
+		}
+		for _, processor := range EnabledProcessors() {
+			feature, computeErr := processor.Compute(ctx, &event.Page)
+			if computeErr != nil {
+				glog.Warningf("compute %s of liked page %s with error: %+v, key: %d", processor.Name(), event.Page.Id, computeErr, event.Id)
+				continue
+			}
+			features[processor.Name()] = feature
+		}
+	}
+
+	unlock := lockUser(event.Id)
+	defer unlock()
+
+	state, getErr := getUserStateFromMongo(ctx, event.Id, conf)
+	if getErr == mongo.ErrNoDocuments {
+		state = NewUserState(event.Id)
+	} else if getErr != nil {
+		return getErr
+	}
+	likedPages := state.pageIds()
+
+	now := time.Now()
+	updated := make([]Processor, 0, len(EnabledProcessors()))
+	for _, processor := range EnabledProcessors() {
+		var changed bool
+		switch event.Event {
+		case common.FBEventLike:
+			weight := pageWeight(&event.Page, processor.Config().Aggregation, popularity, now)
+			changed = state.like(processor.Name(), event.Page.Id, weight, features[processor.Name()])
+		case common.FBEventUnlike:
+			changed = state.unlike(processor.Name(), event.Page.Id)
+		}
+		if changed {
+			updated = append(updated, processor)
+		}
+	}
+	if len(updated) == 0 {
+		return nil
+	}
+
+	setErr := setUserStateToMongo(ctx, state, conf)
+	if setErr != nil {
+		return setErr
+	}
+	updatePageRefs(ctx, likedPages, state.pageIds(), conf)
+
+	for _, processor := range updated {
+		features := state.meanFeatures(processor.Name())
+		var writeErr error
+		if len(features) == 0 {
+			// 最后一个有结果的page被unlike
+			writeErr = DeleteProfiles(ctx, event.Id, []Processor{processor}, conf)
+		} else {
+			writeErr = WriteFeatures(ctx, processor, event.Id, features, conf)
+		}
+		if writeErr != nil {
+			glog.Warningf("process %s event with error: %+v, key: %d", processor.Name(), writeErr, event.Id)
+		}
+	}
+	return nil
+}
+
+// RebuildUserState replaces the stored sums with the features computed from a full FBProfile.
+func RebuildUserState(ctx context.Context, key uint64, features map[string][]PageFeature, conf *common.Config) error {
+	if !conf.IncrConf.Enable {
+		return nil
+	}
+
+	var popularity *pagePopularity
+	if usePopularity() {
+		pageIds := make([]string, 0)
+		for _, pageFeatures := range features {
+			pageIds = append(pageIds, featurePageIds(pageFeatures)...)
+		}
+		popularity = loadPagePopularity(ctx, pageIds, conf)
+	}
+
+	now := time.Now()
+	state := NewUserState(key)
+	for _, processor := range EnabledProcessors() {
+		for _, pageFeature := range features[processor.Name()] {
+			weight := pageWeight(pageFeature.Page, processor.Config().Aggregation, popularity, now)
+			state.like(processor.Name(), pageFeature.Page.Id, weight, pageFeature.Feature)
+		}
+	}
+
+	unlock := lockUser(key)
+	defer unlock()
+	oldState, getErr := getUserStateFromMongo(ctx, key, conf)
+	if getErr == mongo.ErrNoDocuments {
+		oldState = NewUserState(key)
+	} else if getErr != nil {
+		return getErr
+	}
+	setErr := setUserStateToMongo(ctx, state, conf)
+	if setErr != nil {
+		return setErr
+	}
+	updatePageRefs(ctx, oldState.pageIds(), state.pageIds(), conf)
+	return nil
+}
+
+// like adds the feature of a page not in the state yet, and returns false if nothing is changed.
+func (state *UserState) like(processor string, pageId string, weight float64, feature Feature) bool {
+	if weight <= 0 || feature.IsEmpty() {
+		return false
+	}
+	if _, exist := state.Pages[pageId][processor]; exist {
+		return false
+	}
+	scores := make([]StateScore, 0)
+	for level, levelScores := range feature {
+		for name, score := range levelScores {
+			scores = append(scores, StateScore{Level: level, Name: name, Score: score})
+		}
+	}
+	state.add(processor, weight, scores)
+
+	pageStates, ok := state.Pages[pageId]
+	if !ok {
+		pageStates = make(map[string]*PageState)
+		state.Pages[pageId] = pageStates
+	}
+	pageStates[processor] = &PageState{Weight: weight, Scores: scores}
+	return true
+}
+
+// unlike subtracts what the page was added with, and returns false if the page is not in the state.
+func (state *UserState) unlike(processor string, pageId string) bool {
+	pageState, exist := state.Pages[pageId][processor]
+	if !exist {
+		return false
+	}
+	state.add(processor, -pageState.Weight, pageState.Scores)
+
+	delete(state.Pages[pageId], processor)
+	if len(state.Pages[pageId]) == 0 {
+		delete(state.Pages, pageId)
+	}
+	return true
+}
+
+func (state *UserState) add(processor string, weight float64, scores []StateScore) {
+	sums := make(Feature)
+	for _, score := range state.Sums[processor] {
+		if sums[score.Level] == nil {
+			sums[score.Level] = make(map[string]float64)
+		}
+		sums[score.Level][score.Name] = score.Score
+	}
+	for _, score := range scores {
+		if sums[score.Level] == nil {
+			sums[score.Level] = make(map[string]float64)
+		}
+		sums[score.Level][score.Name] += weight * score.Score
+	}
+
+	stateScores := make([]StateScore, 0)
+	for level, levelScores := range sums {
+		for name, score := range levelScores {
+			// 去掉unlike后剩下的浮点误差
+			if score > 1e-9 {
+				stateScores = append(stateScores, StateScore{Level: level, Name: name, Score: score})
+			}
+		}
+	}
+	state.Sums[processor] = stateScores
+
+	state.Weights[processor] += weight
+	if state.Weights[processor] <= 1e-9 || len(stateScores) == 0 {
+		delete(state.Weights, processor)
+		delete(state.Sums, processor)
+	}
+}
+
+// usePopularity is true if an enabled processor weights the pages by popularity.
+func usePopularity() bool {
+	for _, processor := range EnabledProcessors() {
+		if processor.Config().Aggregation.Popularity {
+			return true
+		}
+	}
+	return false
+}
+
+func (state *UserState) pageIds() map[string]bool {
+	pageIds := make(map[string]bool, len(state.Pages))
+	for pageId := range state.Pages {
+		pageIds[pageId] = true
+	}
+	return pageIds
+}
+
+// meanFeatures returns the sums divided by the total weight as a single page, which Aggregate keeps as is.
+func (state *UserState) meanFeatures(processor string) []PageFeature {
+	weight := state.Weights[processor]
+	if weight <= 0 {
+		return nil
+	}
+	mean := make(Feature)
+	for _, score := range state.Sums[processor] {
+		if mean[score.Level] == nil {
+			mean[score.Level] = make(map[string]float64)
+		}
+		mean[score.Level][score.Name] = score.Score / weight
+	}
+	return []PageFeature{{Page: nil, Feature: mean}}
+}
+
+func setUserStateToMongo(ctx context.Context, state *UserState, conf *common.Config) error {
+	state.UpdateTime = time.Now().Unix()
+	return pageStore.Replace(ctx, conf.IncrConf.Collection, state.Id, *state)
+}
+
+func getUserStateFromMongo(ctx context.Context, key uint64, conf *common.Config) (*UserState, error) {
+	raw, findErr := pageStore.Find(ctx, conf.IncrConf.Collection, strconv.FormatUint(key, 10))
+	if findErr != nil {
+		return nil, findErr
+	}
+
+	value := NewUserState(key)
+	parseErr := bson.Unmarshal(raw, value)
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	if value.Pages == nil {
+		value.Pages = make(map[string]map[string]*PageState)
+	}
+	if value.Sums == nil {
+		value.Sums = make(map[string][]StateScore)
+	}
+	if value.Weights == nil {
+		value.Weights = make(map[string]float64)
+	}
+	return value, nil
+}
+
+// updatePageRefs counts the pages added to a user state and discounts the removed ones, so the pages liked by
+// nobody else are found by _id instead of scanning the states. It returns the removed pages no state contains any more.
+// The caller holds the lock of the user and has written the state.
+func updatePageRefs(ctx context.Context, before map[string]bool, after map[string]bool, conf *common.Config) []string {
+	unreferenced := make([]string, 0)
+	for pageId := range after {
+		if before[pageId] {
+			continue
+		}
+		_, incrErr := pageStore.Incr(ctx, conf.IncrConf.PageRefCollection, pageId, "users", 1)
+		if incrErr != nil {
+			glog.Warningf("count page users with error: %+v, page: %s", incrErr, pageId)
+		}
+	}
+	for pageId := range before {
+		if after[pageId] {
+			continue
+		}
+		users, incrErr := pageStore.Incr(ctx, conf.IncrConf.PageRefCollection, pageId, "users", -1)
+		if incrErr != nil {
+			glog.Warningf("count page users with error: %+v, page: %s", incrErr, pageId)
+			continue
+		}
+		if users < 0 {
+			// 计数之前写入的state，不能确定没有其他用户
+			glog.V(2).Infof("page %s was not counted, users: %d", pageId, users)
+			continue
+		}
+		if users == 0 {
+			unreferenced = append(unreferenced, pageId)
+		}
+	}
+	sort.Strings(unreferenced)
+	return unreferenced
+}
@@ -0,0 +1,211 @@
+package remote
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ParticleMedia/fb_page_server/common"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+const keywordService = "channel"
+const defaultMaxGetLength = 4096
+const maxKeywordResponseSize = 16 * 1024 * 1024
+
+type KeywordRequest struct {
+	Url        string `json:"url"`
+	SegTitle   string `json:"seg_title"`
+	SegContent string `json:"seg_content"`
+	//有空格，有大写
+	KwsCandidateNext []string `json:"kws_candidate_next"`
+}
+
+type KeywordScore struct {
+	Keyword string  `json:"keyword"`
+	Score   float64 `json:"score"`
+}
+
+type KeywordResponse struct {
+	Keywords []KeywordScore `json:"keyword"`
+	Vector   []float64      `json:"vector"`
+}
+
+// KeywordClient calls the keyword service, with GET ?q= by default as the service was built for,
+// or POST for conf.Method post and for requests whose url would be longer than conf.MaxGetLength.
+type KeywordClient struct {
+	uri          string
+	method       string
+	contentType  string
+	maxGetLength int
+	// the vector is checked to have the dimension of the channel vectors, 0 to skip
+	dimension int
+	client    *http.Client
+}
+
+type keywordClientKey struct {
+	uri          string
+	method       string
+	contentType  string
+	maxGetLength int
+	dimension    int
+	http         common.HttpClientConfig
+}
+
+var keywordClientLock sync.Mutex
+var keywordClients = make(map[keywordClientKey]*KeywordClient)
+
+// GetKeywordClient returns the client of conf, clients are kept so the connections are reused across pages.
+func GetKeywordClient(conf *common.ChannelConfig, dimension int) *KeywordClient {
+	key := keywordClientKey{
+		uri:          conf.Uri,
+		method:       conf.Method,
+		contentType:  conf.ContentType,
+		maxGetLength: conf.MaxGetLength,
+		dimension:    dimension,
+		http:         conf.Http,
+	}
+	keywordClientLock.Lock()
+	defer keywordClientLock.Unlock()
+	client, ok := keywordClients[key]
+	if !ok {
+		client = NewKeywordClient(conf, dimension)
+		keywordClients[key] = client
+	}
+	return client
+}
+
+func NewKeywordClient(conf *common.ChannelConfig, dimension int) *KeywordClient {
+	method := http.MethodGet
+	if strings.ToUpper(conf.Method) == http.MethodPost {
+		method = http.MethodPost
+	}
+	maxGetLength := conf.MaxGetLength
+	if maxGetLength <= 0 {
+		maxGetLength = defaultMaxGetLength
+	}
+	contentType := conf.ContentType
+	if len(contentType) == 0 {
+		contentType = "application/json"
+	}
+	return &KeywordClient{
+		uri:          conf.Uri,
+		method:       method,
+		contentType:  contentType,
+		maxGetLength: maxGetLength,
+		dimension:    dimension,
+		client:       newHttpClient(&conf.Http),
+	}
+}
+
+// Extract returns the validated keywords and vector of the request.
+func (c *KeywordClient) Extract(ctx context.Context, req *KeywordRequest) (*KeywordResponse, error) {
+	body, encodeErr := json.Marshal(req)
+	if encodeErr != nil {
+		return nil, encodeErr
+	}
+
+	var respBody []byte
+	callErr := callRemote(ctx, BreakerKeyword, func() error {
+		var req *http.Request
+		var reqErr error
+		getUri := c.uri + "?q=" + url.QueryEscape(string(body))
+		if c.method == http.MethodGet && len(getUri) <= c.maxGetLength {
+			req, reqErr = newRequest(ctx, http.MethodGet, getUri, "", nil)
+		} else {
+			// 长的about放在url里会被服务截断
+			req, reqErr = newRequest(ctx, http.MethodPost, c.uri, c.contentType, body)
+		}
+		if reqErr != nil {
+			return reqErr
+		}
+		resp, respErr := c.client.Do(req)
+		if respErr != nil {
+			return requestError(keywordService, respErr)
+		}
+
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			return statusError(keywordService, resp)
+		}
+
+		var readErr error
+		respBody, readErr = ioutil.ReadAll(io.LimitReader(resp.Body, maxKeywordResponseSize))
+		if readErr != nil {
+			return requestError(keywordService, readErr)
+		}
+		return nil
+	}, isRemoteFailure)
+	if callErr != nil {
+		return nil, callErr
+	}
+	keywordResp, decodeErr := DecodeKeywordResponse(respBody)
+	if decodeErr != nil {
+		return nil, decodeErr
+	}
+	validateErr := keywordResp.Validate(c.dimension)
+	if validateErr != nil {
+		return nil, validateErr
+	}
+	return keywordResp, nil
+}
+
+// keywordResponseBody tells a missing or null field from an empty one
+type keywordResponseBody struct {
+	Keywords *[]KeywordScore `json:"keyword"`
+	Vector   *[]float64      `json:"vector"`
+}
+
+// DecodeKeywordResponse parses a response body, both keyword and vector are required.
+func DecodeKeywordResponse(data []byte) (*KeywordResponse, error) {
+	var body keywordResponseBody
+	parseErr := json.Unmarshal(data, &body)
+	if parseErr != nil {
+		return nil, errors.New(fmt.Sprintf("parse keyword response with error: %+v", parseErr))
+	}
+	if body.Keywords == nil || body.Vector == nil {
+		return nil, errors.New(fmt.Sprintf("parse keyword response with error, has keyword score: %+v, has vector: %+v", body.Keywords != nil, body.Vector != nil))
+	}
+	return &KeywordResponse{
+		Keywords: *body.Keywords,
+		Vector:   *body.Vector,
+	}, nil
+}
+
+// Validate checks the vector has the dimension of the channel vectors unless dimension is 0.
+// Keywords which are empty, urls or not positive are dropped by pageContext rather than failing the response.
+func (r *KeywordResponse) Validate(dimension int) error {
+	if dimension > 0 && len(r.Vector) != dimension {
+		return errors.New(fmt.Sprintf("keyword response vector dimension %d is not channel vector dimension %d", len(r.Vector), dimension))
+	}
+	for _, value := range r.Vector {
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return errors.New("keyword response vector has nan or inf")
+		}
+	}
+	return nil
+}
+
+// pageContext builds the context of rankChannels from the response.
+func (r *KeywordResponse) pageContext(segTitle string, segContent string) *PageContext {
+	keywords := make([]string, 0, len(r.Keywords))
+	scores := make([]float64, 0, len(r.Keywords))
+	for _, keywordScore := range r.Keywords {
+		//有空格，有大写
+		keyword := keywordScore.Keyword
+		if len(keyword) > 0 && !strings.Contains(keyword, "http") && keywordScore.Score > 0 {
+			//无空格，有大写
+			keywords = append(keywords, strings.ReplaceAll(keyword, " ", "^^"))
+			scores = append(scores, keywordScore.Score)
+		}
+	}
+	//无空格，有大写
+	keywords, scores = dedupKeywords(keywords, scores)
+	return NewPageContext(segTitle, segContent, keywords, scores, r.Vector)
+}
@@ -0,0 +1,115 @@
+package remote
+
+import (
+	"strings"
+	"unicode"
+)
+
+// DefaultLanguage is the language of the channel model files in the root of the model dir,
+// and of a page whose language can not be told.
+const DefaultLanguage = "en"
+
+// 拉丁字母语言的高频虚词
+var languageWords = map[string][]string{
+	"en": {"the", "and", "of", "to", "in", "is", "for", "with", "on", "our", "we", "you", "your", "this", "are", "at"},
+	"es": {"el", "la", "los", "las", "de", "del", "y", "en", "con", "para", "por", "que", "es", "una", "un", "nuestro", "nuestra", "somos", "más"},
+	"pt": {"o", "a", "os", "as", "de", "do", "da", "dos", "das", "e", "em", "com", "para", "que", "é", "uma", "um", "não", "nossa", "nosso", "somos", "mais"},
+	"fr": {"le", "la", "les", "de", "des", "du", "et", "en", "avec", "pour", "que", "est", "une", "un", "nous", "notre", "vous", "plus"},
+	"de": {"der", "die", "das", "und", "ist", "mit", "für", "von", "den", "dem", "ein", "eine", "wir", "unser", "nicht", "auf"},
+	"it": {"il", "lo", "la", "gli", "le", "di", "del", "della", "e", "è", "con", "per", "che", "una", "un", "nostro", "nostra", "siamo", "più"},
+}
+
+// letters only used by some of the languages
+var languageLetters = map[rune][]string{
+	'ñ': {"es"}, '¿': {"es"}, '¡': {"es"},
+	'ã': {"pt"}, 'õ': {"pt"}, 'ç': {"pt", "fr"},
+	'ß': {"de"}, 'ä': {"de"}, 'ö': {"de"}, 'ü': {"de"},
+	'œ': {"fr"}, 'ê': {"fr", "pt"}, 'è': {"fr", "it"}, 'ì': {"it"}, 'ò': {"it"},
+}
+
+// the evidence needed for a latin language other than DefaultLanguage
+const minLanguageScore = 2
+
+// ties are broken in this order
+var latinLanguages = []string{"en", "es", "pt", "fr", "de", "it"}
+
+// DetectLanguage returns the ISO 639-1 code of text, by the script of its letters,
+// or for latin letters by the function words and special letters of each language. DefaultLanguage if unknown.
+func DetectLanguage(text string) string {
+	letters, han, kana, hangul, cyrillic, arabic, thai := 0, 0, 0, 0, 0, 0, 0
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters += 1
+		switch {
+		case unicode.Is(unicode.Han, r):
+			han += 1
+		case unicode.Is(unicode.Hiragana, r) || unicode.Is(unicode.Katakana, r):
+			kana += 1
+		case unicode.Is(unicode.Hangul, r):
+			hangul += 1
+		case unicode.Is(unicode.Cyrillic, r):
+			cyrillic += 1
+		case unicode.Is(unicode.Arabic, r):
+			arabic += 1
+		case unicode.Is(unicode.Thai, r):
+			thai += 1
+		}
+	}
+	if letters == 0 {
+		return DefaultLanguage
+	}
+	// 英文品牌名混在其他文字里很常见，超过30%即认为是该文字
+	dominant := func(count int) bool {
+		return count*10 >= letters*3
+	}
+	switch {
+	case kana > 0 && dominant(kana+han):
+		return "ja"
+	case dominant(han):
+		return "zh"
+	case dominant(hangul):
+		return "ko"
+	case dominant(cyrillic):
+		return "ru"
+	case dominant(arabic):
+		return "ar"
+	case dominant(thai):
+		return "th"
+	}
+	return detectLatinLanguage(text)
+}
+
+func detectLatinLanguage(text string) string {
+	scores := make(map[string]int)
+	for _, token := range Tokenize(text) {
+		word := strings.ToLower(token.Text)
+		for lang, words := range languageWords {
+			for _, w := range words {
+				if w == word {
+					scores[lang] += 1
+					break
+				}
+			}
+		}
+	}
+	// ¿ and ¡ are not in the tokens
+	for _, r := range strings.ToLower(text) {
+		for _, lang := range languageLetters[r] {
+			scores[lang] += 2
+		}
+	}
+
+	best, bestScore := DefaultLanguage, 0
+	for _, lang := range latinLanguages {
+		if scores[lang] > bestScore {
+			best, bestScore = lang, scores[lang]
+		}
+	}
+	// 英文名称里常有单个外语词，e.g. Los Angeles
+	if bestScore < minLanguageScore {
+		return DefaultLanguage
+	}
+	return best
+}
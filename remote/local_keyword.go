@@ -0,0 +1,248 @@
+package remote
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/ParticleMedia/fb_page_server/common"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// total document count line of keyword_df.txt
+const dfTotalKey = "__total__"
+
+// LocalKeywordModel replaces the keyword service when it is down: the candidates are scored by tf-idf
+// and the page vector is the average of the word embeddings, in the space of the channel vectors.
+type LocalKeywordModel struct {
+	docCount   float64
+	docFreq    map[string]float64
+	embeddings map[string][]float64
+}
+
+// loadLocalKeywordModel reads keyword_df.txt (word or phrase \t document frequency, and __total__ \t document count)
+// and word.vector (word \t vector) of dir, nil if either file does not exist.
+func loadLocalKeywordModel(dir string, dimension int) (*LocalKeywordModel, error) {
+	dfFilePath := filepath.Join(dir, "keyword_df.txt")
+	vectorFilePath := filepath.Join(dir, "word.vector")
+	if _, statErr := os.Stat(dfFilePath); os.IsNotExist(statErr) {
+		return nil, nil
+	}
+	if _, statErr := os.Stat(vectorFilePath); os.IsNotExist(statErr) {
+		return nil, nil
+	}
+
+	m := &LocalKeywordModel{
+		docFreq:    make(map[string]float64),
+		embeddings: make(map[string][]float64),
+	}
+	dfErr := readTabFile(dfFilePath, func(splits []string, line string) error {
+		if len(splits) < 2 {
+			return errors.New(fmt.Sprintf("parse keyword df fail, line: %s", line))
+		}
+		df, floatErr := strconv.ParseFloat(strings.TrimSpace(splits[1]), 64)
+		if floatErr != nil {
+			return errors.New(fmt.Sprintf("parse keyword df fail, line: %s", line))
+		}
+		if splits[0] == dfTotalKey {
+			m.docCount = df
+		} else {
+			m.docFreq[strings.Join(tokenWords(Tokenize(splits[0]), true), " ")] = df
+		}
+		return nil
+	})
+	if dfErr != nil {
+		return nil, dfErr
+	}
+	if m.docCount <= 0 {
+		return nil, errors.New(fmt.Sprintf("no %s line in %s", dfTotalKey, dfFilePath))
+	}
+
+	vectorErr := readTabFile(vectorFilePath, func(splits []string, line string) error {
+		vector := make([]float64, 0, len(splits)-1)
+		for i := 1; i < len(splits); i++ {
+			floatValue, floatErr := strconv.ParseFloat(splits[i], 64)
+			if floatErr != nil {
+				return errors.New(fmt.Sprintf("parse to vector fail, line: %s", line))
+			}
+			vector = append(vector, floatValue)
+		}
+		if len(vector) != dimension {
+			return errors.New(fmt.Sprintf("word vector dimension %d is not channel vector dimension %d, line: %s", len(vector), dimension, line))
+		}
+		m.embeddings[NormalizeText(splits[0])] = vector
+		return nil
+	})
+	if vectorErr != nil {
+		return nil, vectorErr
+	}
+	return m, nil
+}
+
+func readTabFile(path string, fn func(splits []string, line string) error) error {
+	file, openErr := os.Open(path)
+	if openErr != nil {
+		return openErr
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(line) == 0 {
+			continue
+		}
+		fnErr := fn(strings.Split(line, "\t"), line)
+		if fnErr != nil {
+			return fnErr
+		}
+	}
+	return scanner.Err()
+}
+
+// idf of a phrase not in the df file is the idf of its rarest known word, a phrase is at most as frequent as its words.
+func (m *LocalKeywordModel) idf(words []string) float64 {
+	df, ok := m.docFreq[strings.Join(words, " ")]
+	if !ok {
+		df = m.docCount
+		for _, word := range words {
+			if wordDf, wordOk := m.docFreq[word]; wordOk && wordDf < df {
+				df = wordDf
+			}
+		}
+	}
+	return math.Log((m.docCount+1)/(df+1)) + 1
+}
+
+// keywords scores the candidates by tf-idf on the title and content, title counts twice.
+// Candidates starting or ending with a stop word are skipped, the scores are divided by the highest one.
+func (m *LocalKeywordModel) keywords(titleWords []string, contentWords []string, candidates []string, stopWords map[string]bool, maxKeywords int) ([]string, []float64) {
+	scores := make(map[string]float64)
+	for _, candidate := range candidates {
+		//有空格，无大写
+		words := tokenWords(Tokenize(strings.ReplaceAll(candidate, "^^", " ")), true)
+		if len(words) == 0 || stopWords[words[0]] || stopWords[words[len(words)-1]] {
+			continue
+		}
+		tf := 2*countPhrase(titleWords, words) + countPhrase(contentWords, words)
+		if tf == 0 {
+			continue
+		}
+		scores[candidate] = float64(tf) * m.idf(words)
+	}
+
+	keywords, keywordScores := sortMap(scores)
+	if maxKeywords > 0 && len(keywords) > maxKeywords {
+		keywords, keywordScores = keywords[:maxKeywords], keywordScores[:maxKeywords]
+	}
+	if len(keywordScores) == 0 || keywordScores[0] <= 0 {
+		return nil, nil
+	}
+	// 先取出最高分，循环中keywordScores[0]会被改写
+	maxScore := keywordScores[0]
+	for i := range keywordScores {
+		keywordScores[i] /= maxScore
+	}
+	return keywords, keywordScores
+}
+
+func countPhrase(words []string, phrase []string) int {
+	count := 0
+	for offset := 0; offset+len(phrase) <= len(words); offset++ {
+		matched := true
+		for i, word := range phrase {
+			if words[offset+i] != word {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			count += 1
+		}
+	}
+	return count
+}
+
+// vector averages the embeddings of the words of the page, weighted by idf so common words count less.
+func (m *LocalKeywordModel) vector(words []string) []float64 {
+	var sum []float64
+	weights := 0.0
+	for _, word := range words {
+		embedding, ok := m.embeddings[word]
+		if !ok {
+			continue
+		}
+		if sum == nil {
+			sum = make([]float64, len(embedding))
+		}
+		weight := m.idf([]string{word})
+		for i, value := range embedding {
+			sum[i] += value * weight
+		}
+		weights += weight
+	}
+	if weights == 0 {
+		return []float64{}
+	}
+	for i := range sum {
+		sum[i] /= weights
+	}
+	return sum
+}
+
+// localPageContext builds the context of rankChannels like the keyword service would, with the local keyword model of
+// the language or else of m. It returns the model the vector belongs to, nil if no model has local keyword files.
+func (m *ChannelModel) localPageContext(lang string, segTitle string, segContent string, candidates []string, conf *common.LocalKeywordConfig) (*PageContext, *ChannelModel) {
+	model := m.forLanguage(lang)
+	if model.localKeyword == nil {
+		model = m
+	}
+	if model.localKeyword == nil {
+		return nil, nil
+	}
+
+	titleWords := tokenWords(Tokenize(segTitle), true)
+	contentWords := tokenWords(Tokenize(segContent), true)
+	keywords, scores := model.localKeyword.keywords(titleWords, contentWords, candidates, model.stopWords, conf.MaxKeywords)
+	// 与keyword服务一致，无空格，有大写
+	keywords, scores = dedupKeywords(keywords, scores)
+	vector := model.localKeyword.vector(append(titleWords, contentWords...))
+	return NewPageContext(segTitle, segContent, keywords, scores, vector), model
+}
+
+// getChannelFromLocalKeyword classifies the page with the local keyword model, nil if it is disabled or not loaded.
+// explain, unless nil, is filled from the local keywords.
+func getChannelFromLocalKeyword(page *common.FBPage, lang string, conf *common.Config, explain *ChannelExplain) map[string]float64 {
+	if !conf.ChnConf.LocalFallback.Enable || channelModel == nil {
+		return nil
+	}
+	segTitle := page.Name
+	segContent := page.Content()
+	candidates := getKwsCandidate(segTitle, segContent, page.Categories())
+	// 按候选词排序，保证同分关键词的顺序稳定
+	sort.Strings(candidates)
+	pageContext, model := channelModel.localPageContext(lang, segTitle, segContent, candidates, &conf.ChnConf.LocalFallback)
+	if pageContext == nil {
+		return nil
+	}
+
+	ratio := conf.ChnConf.LocalFallback.ScoreRatio
+	if ratio <= 0 {
+		ratio = 1
+	}
+	channels, scores := model.classifyChannels(pageContext)
+	if explain != nil {
+		explain.KeywordSource = "local"
+		explain.fill(pageContext, channels, scores)
+	}
+	channelScores := make(map[string]float64)
+	for i := range channels {
+		channelScores[channels[i]] = scores[i] * ratio
+	}
+	return channelScores
+}
@@ -0,0 +1,36 @@
+package remote
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestLocalKeywordScoresNormalized(t *testing.T) {
+	model := &LocalKeywordModel{
+		docCount: 100,
+		docFreq:  map[string]float64{"music": 9, "band": 9},
+	}
+	titleWords := []string{"music", "band"}
+	contentWords := []string{"music", "music", "band"}
+	keywords, scores := model.keywords(titleWords, contentWords, []string{"music", "band"}, nil, 0)
+
+	if !reflect.DeepEqual(keywords, []string{"music", "band"}) {
+		t.Fatalf("keywords: %v", keywords)
+	}
+	// tf 4 and 3 with the same idf
+	want := []float64{1, 0.75}
+	for i := range want {
+		if math.Abs(scores[i]-want[i]) > 1e-9 {
+			t.Errorf("score of %s: %v, want %v", keywords[i], scores[i], want[i])
+		}
+	}
+}
+
+func TestLocalKeywordNoScore(t *testing.T) {
+	model := &LocalKeywordModel{docCount: 100, docFreq: map[string]float64{}}
+	keywords, scores := model.keywords([]string{"music"}, nil, []string{"band"}, nil, 0)
+	if len(keywords) != 0 || len(scores) != 0 {
+		t.Errorf("keywords: %v, scores: %v", keywords, scores)
+	}
+}
@@ -0,0 +1,124 @@
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ParticleMedia/fb_page_server/common"
+	user_profile_pb "github.com/ParticleMedia/fb_page_server/proto"
+	"github.com/golang/glog"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"math"
+	"time"
+)
+
+// mergeTime is the time of the last merged write of a profile, ups keeps no timestamp of its own.
+type mergeTime struct {
+	Id         string `bson:"_id"`
+	UpdateTime int64  `bson:"update_time"`
+}
+
+func mergeTimeKey(profile string, key uint64) string {
+	return fmt.Sprintf("%s_%d", profile, key)
+}
+
+// mergeWithUps reads the current ups value of the processor and merges the new feature into it.
+// The caller holds lockUser(key) until the merged value is written, so no other write of the user interleaves.
+func mergeWithUps(ctx context.Context, processor Processor, key uint64, feature Feature, conf *common.Config) (string, user_profile_pb.ProfileValueType, error) {
+	mergeConf := processor.Config().Merge
+	profile := processor.Config().Profile
+	oldValue, getErr := GetFromUps(ctx, key, profile, &conf.UpsConf)
+	if getErr != nil {
+		return "", user_profile_pb.ProfileValueType_UNKNOW, getErr
+	}
+
+	merged := feature
+	if len(oldValue) != 0 {
+		oldFeature, decodeErr := decodeFeature(processor, oldValue)
+		if decodeErr != nil {
+			// 无法解析的旧值不覆盖
+			return "", user_profile_pb.ProfileValueType_UNKNOW, errors.New(fmt.Sprintf("decode %s from ups with error: %+v, key: %d", profile, decodeErr, key))
+		}
+		decay := mergeDecay(ctx, profile, key, mergeConf, time.Now())
+		merged = mergeFeatures(oldFeature, feature, mergeConf, decay)
+	}
+
+	total := aggregateFeatures([]PageFeature{{Page: nil, Feature: merged}}, processor.Config().Aggregation, nil)
+	return encodeFeature(processor, total)
+}
+
+// mergeDecay returns 0.5^(age/decay_half_life) of the old ups value, 1 if the decay is disabled or the age unknown.
+func mergeDecay(ctx context.Context, profile string, key uint64, conf *common.MergeConfig, now time.Time) float64 {
+	if conf.DecayHalfLife <= 0 {
+		return 1.0
+	}
+	raw, findErr := pageStore.Find(ctx, conf.Collection, mergeTimeKey(profile, key))
+	if findErr != nil {
+		if findErr != mongo.ErrNoDocuments {
+			glog.Warningf("find merge time of %s with error: %+v, key: %d", profile, findErr, key)
+		}
+		return 1.0
+	}
+	var last mergeTime
+	parseErr := bson.Unmarshal(raw, &last)
+	if parseErr != nil || last.UpdateTime <= 0 {
+		return 1.0
+	}
+	ageDays := now.Sub(time.Unix(last.UpdateTime, 0)).Hours() / 24
+	if ageDays <= 0 {
+		return 1.0
+	}
+	return math.Pow(0.5, ageDays/conf.DecayHalfLife)
+}
+
+// saveMergeTime records the time of a merged write, called after the value is written to ups.
+func saveMergeTime(ctx context.Context, profile string, key uint64, conf *common.MergeConfig) {
+	if conf.DecayHalfLife <= 0 {
+		return
+	}
+	id := mergeTimeKey(profile, key)
+	setErr := pageStore.Replace(ctx, conf.Collection, id, mergeTime{Id: id, UpdateTime: time.Now().Unix()})
+	if setErr != nil {
+		glog.Warningf("save merge time of %s with error: %+v, key: %d", profile, setErr, key)
+	}
+}
+
+// deleteMergeTime removes the time of the last merge of a deleted profile. It runs whenever merge has a collection,
+// an earlier config may have left one.
+func deleteMergeTime(ctx context.Context, profile string, key uint64, conf *common.MergeConfig) error {
+	if len(conf.Collection) == 0 {
+		return nil
+	}
+	delErr := pageStore.Delete(ctx, conf.Collection, mergeTimeKey(profile, key))
+	if delErr != nil && delErr != mongo.ErrNoDocuments {
+		return delErr
+	}
+	return nil
+}
+
+// mergeFeatures computes old_weight * decay * old + new_weight * new and drops the scores under min_score.
+func mergeFeatures(oldFeature Feature, newFeature Feature, conf *common.MergeConfig, decay float64) Feature {
+	merged := make(Feature)
+	addScores := func(feature Feature, weight float64) {
+		for level, scores := range feature {
+			if merged[level] == nil {
+				merged[level] = make(map[string]float64)
+			}
+			for name, score := range scores {
+				merged[level][name] += weight * score
+			}
+		}
+	}
+	addScores(oldFeature, conf.OldWeight*decay)
+	addScores(newFeature, conf.NewWeight)
+
+	for _, scores := range merged {
+		for name, score := range scores {
+			if score < conf.MinScore {
+				delete(scores, name)
+			}
+		}
+	}
+	return merged
+}
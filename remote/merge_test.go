@@ -0,0 +1,60 @@
+package remote
+
+import (
+	"context"
+	"github.com/ParticleMedia/fb_page_server/common"
+	"github.com/ParticleMedia/fb_page_server/internal/testutil/fake"
+	user_profile_pb "github.com/ParticleMedia/fb_page_server/proto"
+	"math"
+	"net"
+	"testing"
+)
+
+func TestMergeFeaturesDecay(t *testing.T) {
+	conf := &common.MergeConfig{OldWeight: 0.5, NewWeight: 0.5, MinScore: 0.01}
+	oldFeature := Feature{"first_cat": {"Music": 0.8, "Sports": 0.02}}
+	newFeature := Feature{"first_cat": {"Music": 0.2}}
+
+	// 旧值过了一个半衰期
+	merged := mergeFeatures(oldFeature, newFeature, conf, 0.5)
+	if math.Abs(merged["first_cat"]["Music"]-0.3) > 1e-9 {
+		t.Errorf("Music: %v, want 0.3", merged["first_cat"]["Music"])
+	}
+	if _, ok := merged["first_cat"]["Sports"]; ok {
+		t.Errorf("Sports under min_score is kept: %v", merged["first_cat"]["Sports"])
+	}
+}
+
+// TestMergeWithUpsUndecodable keeps an ups value the processor can not read instead of overwriting it.
+func TestMergeWithUpsUndecodable(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ups, upsErr := fake.NewUserProfileServer("")
+	if upsErr != nil {
+		t.Fatalf("create fake ups with error: %+v", upsErr)
+	}
+	listener, listenErr := net.Listen("tcp", "127.0.0.1:0")
+	if listenErr != nil {
+		t.Fatalf("listen fake ups with error: %+v", listenErr)
+	}
+	go ups.ServeListener(ctx, listener, "")
+
+	conf := &common.Config{}
+	conf.UpsConf = common.UserProfileConfig{Addr: listener.Addr().String(), Timeout: 1000}
+	conf.TcatConf.Profile = "fb_page_tcat"
+	conf.TcatConf.Merge = common.MergeConfig{Enable: true, OldWeight: 0.5, NewWeight: 0.5}
+	old := &user_profile_pb.ProfileValue{
+		Type:  user_profile_pb.ProfileValueType_STRING,
+		Value: &user_profile_pb.ProfileValue_StrValue{StrValue: "Sports,Music"},
+	}
+	ups.Set(ctx, &user_profile_pb.SetRequest{Profile: &user_profile_pb.UserProfile{
+		Uid:         1001,
+		ProfileList: []*user_profile_pb.ProfileItem{{Id: &user_profile_pb.ProfileIdentity{Name: "fb_page_tcat"}, Value: old}},
+	}})
+
+	processor := &textCategoryProcessor{conf: conf}
+	value, _, mergeErr := mergeWithUps(ctx, processor, 1001, Feature{firstCatLevel: {"Sports": 0.9}}, conf)
+	if mergeErr == nil {
+		t.Errorf("merged into an undecodable value: %s", value)
+	}
+}
@@ -2,15 +2,36 @@ package remote
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/ParticleMedia/fb_page_server/common"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"time"
 )
 
+// PageStore keeps the page caches and user states, one document per _id in each collection.
+// Find returns mongo.ErrNoDocuments when the document does not exist.
+type PageStore interface {
+	Find(ctx context.Context, collection string, key string) (bson.Raw, error)
+	// Replace inserts the document or replaces the existing one
+	Replace(ctx context.Context, collection string, key string, value interface{}) error
+	Delete(ctx context.Context, collection string, key string) error
+	// Incr adds delta to the integer field of the document, creating it if missing, and returns the new value
+	Incr(ctx context.Context, collection string, key string, field string, delta int64) (int64, error)
+	// Count returns the documents of the collection, estimated from the metadata so it does not scan
+	Count(ctx context.Context, collection string) (int64, error)
+}
+
 var mongoClient *mongo.Client
-var collectionMap map[string]*mongo.Collection
+var mongoDatabase *mongo.Database
+var pageStore PageStore
+
+type mongoStore struct {
+	collectionMap map[string]*mongo.Collection
+	timeout       time.Duration
+}
 
 func BuildMongoCollections(conf *common.MongoConfig) error {
 	timeout := time.Duration(conf.Timeout) * time.Millisecond
@@ -24,14 +45,220 @@ func BuildMongoCollections(conf *common.MongoConfig) error {
 	}
 
 	mongoClient = client
-	collectionMap = make(map[string]*mongo.Collection)
+	mongoDatabase = mongoClient.Database(conf.Database)
+	collectionMap := make(map[string]*mongo.Collection)
 	for _, name := range conf.Collection {
-		collectionMap[name] = mongoClient.Database(conf.Database).Collection(name)
+		collectionMap[name] = mongoDatabase.Collection(name)
+	}
+	pageStore = &mongoStore{
+		collectionMap: collectionMap,
+		timeout:       timeout,
 	}
 	return err
 }
 
+// SetPageStore replaces the mongo collections, e.g. with an in-memory store.
+func SetPageStore(store PageStore) {
+	pageStore = store
+}
+
+// noCacheStore finds nothing and keeps nothing, so pages are always computed by the remote services.
+type noCacheStore struct{}
+
+func (noCacheStore) Find(ctx context.Context, collection string, key string) (bson.Raw, error) {
+	return nil, mongo.ErrNoDocuments
+}
+
+func (noCacheStore) Replace(ctx context.Context, collection string, key string, value interface{}) error {
+	return nil
+}
+
+func (noCacheStore) Delete(ctx context.Context, collection string, key string) error {
+	return nil
+}
+
+func (noCacheStore) Incr(ctx context.Context, collection string, key string, field string, delta int64) (int64, error) {
+	return delta, nil
+}
+
+func (noCacheStore) Count(ctx context.Context, collection string) (int64, error) {
+	return 0, nil
+}
+
+// DisablePageCache bypasses the page caches without connecting to mongo, e.g. to debug a classification.
+func DisablePageCache() {
+	pageStore = noCacheStore{}
+}
+
+// readOnlyStore finds in store and drops the writes like noCacheStore.
+// An empty key finds nothing, pages without an id would all share the _id "".
+type readOnlyStore struct {
+	store PageStore
+}
+
+func (s readOnlyStore) Find(ctx context.Context, collection string, key string) (bson.Raw, error) {
+	if len(key) == 0 {
+		return nil, mongo.ErrNoDocuments
+	}
+	return s.store.Find(ctx, collection, key)
+}
+
+func (readOnlyStore) Replace(ctx context.Context, collection string, key string, value interface{}) error {
+	return nil
+}
+
+func (readOnlyStore) Delete(ctx context.Context, collection string, key string) error {
+	return nil
+}
+
+func (readOnlyStore) Incr(ctx context.Context, collection string, key string, field string, delta int64) (int64, error) {
+	return delta, nil
+}
+
+func (s readOnlyStore) Count(ctx context.Context, collection string) (int64, error) {
+	return s.store.Count(ctx, collection)
+}
+
+// ReadOnlyPageCache keeps finding pages in the current store but never writes it,
+// e.g. so an ad-hoc classification does not fill the production caches.
+func ReadOnlyPageCache() {
+	pageStore = readOnlyStore{store: pageStore}
+}
+
+// ScanMongo calls fn with every document of a collection of mongo.database in _id order,
+// starting after afterId if it is not nil, until fn returns an error.
+func ScanMongo(ctx context.Context, collection string, afterId *bson.RawValue, fn func(raw bson.Raw) error) error {
+	if mongoDatabase == nil {
+		return errors.New("mongo is not connected")
+	}
+	filter := bson.M{}
+	if afterId != nil {
+		filter["_id"] = bson.M{"$gt": *afterId}
+	}
+	cursor, findErr := mongoDatabase.Collection(collection).Find(ctx, filter, options.Find().SetSort(bson.M{"_id": 1}))
+	if findErr != nil {
+		return findErr
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		fnErr := fn(cursor.Current)
+		if fnErr != nil {
+			return fnErr
+		}
+	}
+	return cursor.Err()
+}
+
 func MongoDisconnect() error {
+	if mongoClient == nil {
+		return nil
+	}
 	disConnErr := mongoClient.Disconnect(context.Background())
 	return disConnErr
 }
+
+func (s *mongoStore) collection(name string) (*mongo.Collection, error) {
+	collection, ok := s.collectionMap[name]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("mongo collection not configured: %s", name))
+	}
+	return collection, nil
+}
+
+// isMongoFailure does not count a missing document as a failure of the breaker.
+func isMongoFailure(err error) bool {
+	return err != mongo.ErrNoDocuments
+}
+
+func (s *mongoStore) Find(ctx context.Context, collection string, key string) (bson.Raw, error) {
+	coll, collErr := s.collection(collection)
+	if collErr != nil {
+		return nil, collErr
+	}
+	callCtx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	var raw bson.Raw
+	callErr := GetBreaker(BreakerMongo).Call(ctx, func() error {
+		result := coll.FindOne(callCtx, bson.M{"_id": key})
+		if result.Err() != nil {
+			return result.Err()
+		}
+		var decodeErr error
+		raw, decodeErr = result.DecodeBytes()
+		return decodeErr
+	}, isMongoFailure)
+	return raw, callErr
+}
+
+func (s *mongoStore) Replace(ctx context.Context, collection string, key string, value interface{}) error {
+	coll, collErr := s.collection(collection)
+	if collErr != nil {
+		return collErr
+	}
+	callCtx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	return GetBreaker(BreakerMongo).Call(ctx, func() error {
+		_, replaceErr := coll.ReplaceOne(callCtx, bson.M{"_id": key}, value, options.Replace().SetUpsert(true))
+		return replaceErr
+	}, isMongoFailure)
+}
+
+func (s *mongoStore) Delete(ctx context.Context, collection string, key string) error {
+	coll, collErr := s.collection(collection)
+	if collErr != nil {
+		return collErr
+	}
+	callCtx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	return GetBreaker(BreakerMongo).Call(ctx, func() error {
+		_, delErr := coll.DeleteOne(callCtx, bson.M{"_id": key})
+		return delErr
+	}, isMongoFailure)
+}
+
+func (s *mongoStore) Incr(ctx context.Context, collection string, key string, field string, delta int64) (int64, error) {
+	coll, collErr := s.collection(collection)
+	if collErr != nil {
+		return 0, collErr
+	}
+	callCtx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	var value int64
+	callErr := GetBreaker(BreakerMongo).Call(ctx, func() error {
+		update := bson.M{"$inc": bson.M{field: delta}}
+		opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+		raw, decodeErr := coll.FindOneAndUpdate(callCtx, bson.M{"_id": key}, update, opts).DecodeBytes()
+		if decodeErr != nil {
+			return decodeErr
+		}
+		var ok bool
+		value, ok = raw.Lookup(field).Int64OK()
+		if !ok {
+			return errors.New(fmt.Sprintf("field %s of %s/%s is not an integer", field, collection, key))
+		}
+		return nil
+	}, isMongoFailure)
+	return value, callErr
+}
+
+func (s *mongoStore) Count(ctx context.Context, collection string) (int64, error) {
+	coll, collErr := s.collection(collection)
+	if collErr != nil {
+		return 0, collErr
+	}
+	callCtx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	var count int64
+	callErr := GetBreaker(BreakerMongo).Call(ctx, func() error {
+		var countErr error
+		count, countErr = coll.EstimatedDocumentCount(callCtx)
+		return countErr
+	}, isMongoFailure)
+	return count, callErr
+}
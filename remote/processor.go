@@ -0,0 +1,192 @@
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ParticleMedia/fb_page_server/common"
+	user_profile_pb "github.com/ParticleMedia/fb_page_server/proto"
+	"github.com/golang/glog"
+	"sort"
+	"time"
+)
+
+// Feature holds the scores of one page or one user, grouped by level (e.g. first_cat) and then by name.
+type Feature map[string]map[string]float64
+
+// Processor computes a feature for every liked page, the features are aggregated into one UPS profile by its Config.
+type Processor interface {
+	Name() string
+	Config() *ProcessorConfig
+	Levels() []string
+	Compute(ctx context.Context, page *common.FBPage) (Feature, error)
+	Encode(feature Feature) (string, error)
+	Decode(value string) (Feature, error)
+}
+
+// ProcessorConfig is the part of the config every processor has: the ups profile, the mongo collection
+// caching the results of the pages, and how the pages are aggregated, encoded and merged with ups.
+type ProcessorConfig struct {
+	Profile     string
+	Collection  string
+	Aggregation *common.AggregationConfig
+	Output      *common.OutputConfig
+	Merge       *common.MergeConfig
+}
+
+type ProcessorFactory func(conf *common.Config) Processor
+
+var processorFactories = make(map[string]ProcessorFactory)
+
+// 未配置processors时只启用原有的两个profile，新注册的processor需要显式配置
+var defaultProcessors = []string{"text_category", "channel"}
+var enabledProcessors []Processor
+
+func RegisterProcessor(name string, factory ProcessorFactory) {
+	processorFactories[name] = factory
+}
+
+func RegisteredProcessors() []string {
+	names := make([]string, 0, len(processorFactories))
+	for name := range processorFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func BuildProcessors(conf *common.Config) ([]Processor, error) {
+	names := conf.Processors
+	if len(names) == 0 {
+		names = defaultProcessors
+	}
+	processors := make([]Processor, 0, len(names))
+	for _, name := range names {
+		factory, ok := processorFactories[name]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("unknown processor: %s, registered: %v", name, RegisteredProcessors()))
+		}
+		processor := factory(conf)
+		outputErr := processor.Config().Output.Validate()
+		if outputErr != nil {
+			return nil, errors.New(fmt.Sprintf("processor %s with error: %+v", name, outputErr))
+		}
+		processors = append(processors, processor)
+	}
+	return processors, nil
+}
+
+func InitProcessors(conf *common.Config) error {
+	processors, buildErr := BuildProcessors(conf)
+	if buildErr != nil {
+		return buildErr
+	}
+	enabledProcessors = processors
+	return nil
+}
+
+func EnabledProcessors() []Processor {
+	return enabledProcessors
+}
+
+func RunProcessor(ctx context.Context, processor Processor, profile *common.FBProfile, conf *common.Config) ([]PageFeature, error) {
+	start := time.Now()
+	defer func() {
+		glog.V(2).Infof("processor %s cost %v, key: %d", processor.Name(), time.Since(start), profile.Id)
+	}()
+
+	features, failedCnt := ComputeFeatures(ctx, processor, profile.Pages)
+	if ctx.Err() != nil {
+		// 超时或停止时不写入部分结果
+		return features, ctx.Err()
+	}
+	// 合并ups时读写之间不能有其他写入
+	unlock := lockUser(profile.Id)
+	defer unlock()
+	if len(features) == 0 && failedCnt == 0 {
+		// 没有page出错且都没有结果，旧的profile不再有效；有出错时保留旧的profile
+		return features, DeleteProfiles(ctx, profile.Id, []Processor{processor}, conf)
+	}
+	return features, WriteFeatures(ctx, processor, profile.Id, features, conf)
+}
+
+// BatchProcessor is implemented by the processors whose remote service computes several pages per request,
+// Prefetch is called with all pages of a profile before Compute, which is called with the ctx it returns.
+type BatchProcessor interface {
+	Prefetch(ctx context.Context, pages []common.FBPage) context.Context
+}
+
+// ComputeFeatures returns the non-empty features and the count of pages failed to compute.
+func ComputeFeatures(ctx context.Context, processor Processor, pages []common.FBPage) ([]PageFeature, int) {
+	batchProcessor, ok := processor.(BatchProcessor)
+	if ok {
+		ctx = batchProcessor.Prefetch(ctx, pages)
+	}
+	failedCnt := 0
+	features := make([]PageFeature, 0, len(pages))
+	for i := range pages {
+		if ctx.Err() != nil {
+			failedCnt += len(pages) - i
+			break
+		}
+		feature, computeErr := processor.Compute(ctx, &pages[i])
+		if computeErr != nil {
+			glog.V(3).Infof("processor %s compute page %s with error: %+v", processor.Name(), pages[i].Id, computeErr)
+			failedCnt += 1
+			continue
+		}
+		if feature.IsEmpty() {
+			continue
+		}
+		features = append(features, PageFeature{Page: &pages[i], Feature: feature})
+	}
+	return features, failedCnt
+}
+
+// WriteFeatures aggregates the features and writes them to ups, or deletes the profile if nothing is left,
+// the caller holds lockUser(key).
+func WriteFeatures(ctx context.Context, processor Processor, key uint64, features []PageFeature, conf *common.Config) error {
+	if len(features) == 0 {
+		return DeleteProfiles(ctx, key, []Processor{processor}, conf)
+	}
+
+	aggConf := processor.Config().Aggregation
+	var popularity *pagePopularity
+	if aggConf.Popularity {
+		popularity = loadPagePopularity(ctx, featurePageIds(features), conf)
+	}
+	total := aggregateFeatures(features, aggConf, popularity)
+	if total.IsEmpty() {
+		// 例如所有score都低于阈值, 旧的profile不再有效
+		return DeleteProfiles(ctx, key, []Processor{processor}, conf)
+	}
+
+	var value string
+	var valueType user_profile_pb.ProfileValueType
+	var encodeErr error
+	if processor.Config().Merge.Enable {
+		value, valueType, encodeErr = mergeWithUps(ctx, processor, key, total, conf)
+	} else {
+		value, valueType, encodeErr = encodeFeature(processor, total)
+	}
+	if encodeErr != nil {
+		return encodeErr
+	}
+
+	profile := processor.Config().Profile
+	glog.Infof("ready to write to ups, profile: %s, key: %d, value: %s", profile, key, value)
+	writeErr := writeProfile(ctx, key, value, valueType, profile, conf)
+	if writeErr == nil && processor.Config().Merge.Enable {
+		saveMergeTime(ctx, profile, key, processor.Config().Merge)
+	}
+	return writeErr
+}
+
+func (feature Feature) IsEmpty() bool {
+	for _, scores := range feature {
+		if len(scores) != 0 {
+			return false
+		}
+	}
+	return true
+}
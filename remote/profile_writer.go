@@ -0,0 +1,115 @@
+package remote
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"github.com/ParticleMedia/fb_page_server/common"
+	user_profile_pb "github.com/ParticleMedia/fb_page_server/proto"
+	"os"
+	"sync"
+	"time"
+)
+
+// ProfileWriter receives the encoded profiles instead of ups, e.g. to write a backfill to a file.
+type ProfileWriter interface {
+	Write(key uint64, value string, valueType user_profile_pb.ProfileValueType, profile string) error
+	Delete(key uint64, profiles []string) error
+}
+
+// nil writes to ups
+var profileWriter ProfileWriter
+
+func SetProfileWriter(writer ProfileWriter) {
+	profileWriter = writer
+}
+
+func writeProfile(ctx context.Context, key uint64, value string, valueType user_profile_pb.ProfileValueType, profile string, conf *common.Config) error {
+	if profileWriter != nil {
+		return profileWriter.Write(key, value, valueType, profile)
+	}
+	return WriteToUps(ctx, key, value, valueType, profile, &conf.UpsConf)
+}
+
+func deleteProfiles(ctx context.Context, key uint64, profiles []string, conf *common.Config) error {
+	if profileWriter != nil {
+		return profileWriter.Delete(key, profiles)
+	}
+	return DeleteFromUps(ctx, key, profiles, &conf.UpsConf)
+}
+
+// ProfileRecord is one line written by FileProfileWriter.
+type ProfileRecord struct {
+	Op       string   `json:"op"`
+	Uid      uint64   `json:"uid"`
+	Profiles []string `json:"profiles"`
+	Type     string   `json:"type,omitempty"`
+	Value    string   `json:"value,omitempty"`
+	Time     int64    `json:"time"`
+}
+
+// FileProfileWriter writes every set and delete as a json line.
+type FileProfileWriter struct {
+	lock   sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+}
+
+func NewFileProfileWriter(path string) (*FileProfileWriter, error) {
+	file, openErr := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if openErr != nil {
+		return nil, openErr
+	}
+	return &FileProfileWriter{
+		file:   file,
+		writer: bufio.NewWriter(file),
+	}, nil
+}
+
+func (w *FileProfileWriter) Write(key uint64, value string, valueType user_profile_pb.ProfileValueType, profile string) error {
+	return w.write(&ProfileRecord{
+		Op:       "set",
+		Uid:      key,
+		Profiles: []string{profile},
+		Type:     valueType.String(),
+		Value:    value,
+		Time:     time.Now().Unix(),
+	})
+}
+
+func (w *FileProfileWriter) Delete(key uint64, profiles []string) error {
+	return w.write(&ProfileRecord{
+		Op:       "delete",
+		Uid:      key,
+		Profiles: profiles,
+		Time:     time.Now().Unix(),
+	})
+}
+
+func (w *FileProfileWriter) write(record *ProfileRecord) error {
+	data, encodeErr := json.Marshal(record)
+	if encodeErr != nil {
+		return encodeErr
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	_, writeErr := w.writer.Write(append(data, '\n'))
+	return writeErr
+}
+
+// Flush writes the buffered records, call it before a checkpoint is saved.
+func (w *FileProfileWriter) Flush() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.writer.Flush()
+}
+
+func (w *FileProfileWriter) Close() error {
+	flushErr := w.Flush()
+	closeErr := w.file.Close()
+	if flushErr != nil {
+		return flushErr
+	}
+	return closeErr
+}
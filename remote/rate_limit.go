@@ -0,0 +1,168 @@
+package remote
+
+import (
+	"context"
+	"github.com/ParticleMedia/fb_page_server/common"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Limiter is shared by all workers calling one remote service: a token bucket for the rate,
+// and slots for the concurrent calls. A nil Limiter never blocks.
+type Limiter struct {
+	name   string
+	bucket *common.TokenBucket
+	slots  chan struct{}
+
+	waiting  int64
+	inFlight int64
+	acquired int64
+	// ns
+	waitTotal int64
+	waitMax   int64
+}
+
+type LimiterStats struct {
+	Name     string  `json:"name"`
+	Waiting  int64   `json:"waiting"`
+	InFlight int64   `json:"in_flight"`
+	Acquired int64   `json:"acquired"`
+	WaitSecs float64 `json:"wait_seconds"`
+	// the longest wait since start
+	WaitMaxSecs float64 `json:"wait_max_seconds"`
+}
+
+func NewLimiter(name string, conf common.RateLimitConfig) *Limiter {
+	limiter := &Limiter{name: name}
+	if conf.Rate > 0 {
+		burst := conf.Burst
+		if burst <= 0 {
+			burst = 1
+		}
+		limiter.bucket = common.NewTokenBucket(conf.Rate, burst)
+	}
+	if conf.MaxConcurrency > 0 {
+		limiter.slots = make(chan struct{}, conf.MaxConcurrency)
+	}
+	return limiter
+}
+
+// Acquire blocks until the call is allowed or ctx is done, release is called when the call is done.
+func (l *Limiter) Acquire(ctx context.Context) (release func(), err error) {
+	if l == nil {
+		return func() {}, ctx.Err()
+	}
+	start := time.Now()
+	atomic.AddInt64(&l.waiting, 1)
+	defer atomic.AddInt64(&l.waiting, -1)
+	// 先取令牌再占并发槽, 等令牌时不占槽
+	waitErr := l.bucket.WaitContext(ctx)
+	if waitErr != nil {
+		return nil, waitErr
+	}
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		case <-ctx.Done():
+			l.bucket.Restore()
+			return nil, ctx.Err()
+		}
+	}
+
+	wait := int64(time.Since(start))
+	atomic.AddInt64(&l.waitTotal, wait)
+	for {
+		waitMax := atomic.LoadInt64(&l.waitMax)
+		if wait <= waitMax || atomic.CompareAndSwapInt64(&l.waitMax, waitMax, wait) {
+			break
+		}
+	}
+	atomic.AddInt64(&l.acquired, 1)
+	atomic.AddInt64(&l.inFlight, 1)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			atomic.AddInt64(&l.inFlight, -1)
+			if l.slots != nil {
+				<-l.slots
+			}
+		})
+	}, nil
+}
+
+func (l *Limiter) Stats() LimiterStats {
+	return LimiterStats{
+		Name:        l.name,
+		Waiting:     atomic.LoadInt64(&l.waiting),
+		InFlight:    atomic.LoadInt64(&l.inFlight),
+		Acquired:    atomic.LoadInt64(&l.acquired),
+		WaitSecs:    time.Duration(atomic.LoadInt64(&l.waitTotal)).Seconds(),
+		WaitMaxSecs: time.Duration(atomic.LoadInt64(&l.waitMax)).Seconds(),
+	}
+}
+
+var limiterLock sync.RWMutex
+var limiters = make(map[string]*Limiter)
+
+// InitLimiters replaces the limiters of the services with a limit in conf, named as the breakers.
+func InitLimiters(conf *common.RateLimitsConfig) {
+	newLimiters := make(map[string]*Limiter)
+	for name, limitConf := range map[string]common.RateLimitConfig{
+		BreakerTextCategory: conf.TextCategory,
+		BreakerKeyword:      conf.Keyword,
+		BreakerTopicModel:   conf.TopicModel,
+	} {
+		if limitConf.Rate > 0 || limitConf.MaxConcurrency > 0 {
+			newLimiters[name] = NewLimiter(name, limitConf)
+		}
+	}
+	limiterLock.Lock()
+	limiters = newLimiters
+	limiterLock.Unlock()
+}
+
+// GetLimiter returns nil if the service of name has no limit.
+func GetLimiter(name string) *Limiter {
+	limiterLock.RLock()
+	defer limiterLock.RUnlock()
+	return limiters[name]
+}
+
+func AllLimiterStats() []LimiterStats {
+	limiterLock.RLock()
+	defer limiterLock.RUnlock()
+	stats := make([]LimiterStats, 0, len(limiters))
+	for _, limiter := range limiters {
+		stats = append(stats, limiter.Stats())
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Name < stats[j].Name
+	})
+	return stats
+}
+
+// callRemote calls fn through the breaker and then the limiter of the service name,
+// an open breaker returns at once instead of queueing. Only fn is timed for the slow calls of the breaker,
+// and the errors after ctx is cancelled are not failures of the service, a deadline overrun is.
+func callRemote(ctx context.Context, name string, fn func() error, failed func(err error) bool) error {
+	breaker := GetBreaker(name)
+	allowErr := breaker.Allow()
+	if allowErr != nil {
+		return allowErr
+	}
+	release, acquireErr := GetLimiter(name).Acquire(ctx)
+	if acquireErr != nil {
+		// 排队时超时或取消，没有调用
+		breaker.cancel()
+		return acquireErr
+	}
+	defer release()
+
+	start := time.Now()
+	err := fn()
+	breaker.finish(ctx, err != nil && failed(err), time.Since(start))
+	return err
+}
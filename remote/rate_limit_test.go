@@ -0,0 +1,134 @@
+package remote
+
+import (
+	"context"
+	"github.com/ParticleMedia/fb_page_server/common"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLimiterConcurrency(t *testing.T) {
+	limiter := NewLimiter("test", common.RateLimitConfig{MaxConcurrency: 2})
+	var running, maxRunning int64
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, acquireErr := limiter.Acquire(context.Background())
+			if acquireErr != nil {
+				t.Errorf("acquire with error: %+v", acquireErr)
+				return
+			}
+			defer release()
+			current := atomic.AddInt64(&running, 1)
+			for {
+				max := atomic.LoadInt64(&maxRunning)
+				if current <= max || atomic.CompareAndSwapInt64(&maxRunning, max, current) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt64(&running, -1)
+		}()
+	}
+	wg.Wait()
+	if maxRunning != 2 {
+		t.Errorf("max concurrent calls: %d, want 2", maxRunning)
+	}
+	if stats := limiter.Stats(); stats.Acquired != 6 || stats.InFlight != 0 || stats.Waiting != 0 {
+		t.Errorf("stats: %+v", stats)
+	}
+}
+
+// TestLimiterTokenBeforeSlot does not hold a slot while waiting for a token.
+func TestLimiterTokenBeforeSlot(t *testing.T) {
+	limiter := NewLimiter("test", common.RateLimitConfig{Rate: 1, Burst: 1, MaxConcurrency: 2})
+	release, acquireErr := limiter.Acquire(context.Background())
+	if acquireErr != nil {
+		t.Fatalf("acquire with error: %+v", acquireErr)
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		_, waitErr := limiter.Acquire(ctx)
+		done <- waitErr
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if len(limiter.slots) != 1 {
+		t.Errorf("slots taken while waiting for a token: %d, want 1", len(limiter.slots))
+	}
+	if waitErr := <-done; waitErr != context.DeadlineExceeded {
+		t.Errorf("wait for a token: %+v, want deadline exceeded", waitErr)
+	}
+	if len(limiter.slots) != 1 {
+		t.Errorf("slots taken after the wait is cancelled: %d, want 1", len(limiter.slots))
+	}
+}
+
+// TestLimiterCancelQueued gives back the token of a call cancelled while queued for a slot.
+func TestLimiterCancelQueued(t *testing.T) {
+	limiter := NewLimiter("test", common.RateLimitConfig{Rate: 0.1, Burst: 2, MaxConcurrency: 1})
+	release, acquireErr := limiter.Acquire(context.Background())
+	if acquireErr != nil {
+		t.Fatalf("acquire with error: %+v", acquireErr)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, queuedErr := limiter.Acquire(ctx); queuedErr != context.DeadlineExceeded {
+		t.Errorf("queued acquire: %+v, want deadline exceeded", queuedErr)
+	}
+	if stats := limiter.Stats(); stats.Waiting != 0 || stats.InFlight != 1 {
+		t.Errorf("stats after the queued call is cancelled: %+v", stats)
+	}
+
+	// the token of the cancelled call is back, so the next call only waits for the slot
+	release()
+	nextCtx, nextCancel := context.WithTimeout(context.Background(), time.Second)
+	defer nextCancel()
+	nextRelease, nextErr := limiter.Acquire(nextCtx)
+	if nextErr != nil {
+		t.Fatalf("acquire after a cancelled call with error: %+v", nextErr)
+	}
+	nextRelease()
+}
+
+// TestCallRemoteCancelQueued neither calls fn nor keeps the half open probe of a call cancelled in the queue.
+func TestCallRemoteCancelQueued(t *testing.T) {
+	InitBreakers(&common.BreakersConfig{
+		TextCategory: common.BreakerConfig{Enable: true, MinRequests: 1, ErrorRate: 0.5, OpenTime: 30, HalfOpenProbes: 1},
+	})
+	InitLimiters(&common.RateLimitsConfig{TextCategory: common.RateLimitConfig{MaxConcurrency: 1}})
+	defer InitBreakers(&common.BreakersConfig{})
+	defer InitLimiters(&common.RateLimitsConfig{})
+
+	breaker := GetBreaker(BreakerTextCategory)
+	breaker.Allow()
+	breaker.Record(true, time.Millisecond)
+	elapseOpenTime(breaker)
+
+	release, acquireErr := GetLimiter(BreakerTextCategory).Acquire(context.Background())
+	if acquireErr != nil {
+		t.Fatalf("acquire with error: %+v", acquireErr)
+	}
+	defer release()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	called := false
+	callErr := callRemote(ctx, BreakerTextCategory, func() error {
+		called = true
+		return nil
+	}, isRemoteFailure)
+	if callErr != context.DeadlineExceeded || called {
+		t.Errorf("queued call: %+v, called: %v", callErr, called)
+	}
+	if allowErr := breaker.Allow(); allowErr != nil {
+		t.Errorf("probe of the queued call not given back: %+v", allowErr)
+	}
+}
@@ -1,16 +1,11 @@
 package remote
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"github.com/ParticleMedia/fb_page_server/common"
 	"github.com/golang/glog"
 	"go.mongodb.org/mongo-driver/bson"
-	"io/ioutil"
-	"net/http"
-	"strings"
-	"time"
 )
 
 type PageTcat struct {
@@ -28,91 +23,168 @@ type TextCategory struct {
 	ThirdCats  map[string]float64 `json:"third_cat"`
 }
 
-func ProcessTextCateGory(profile *common.FBProfile, conf *common.Config) error {
-	pageCnt := 0
-	totalFirstCats := make(map[string]float64)
-	totalSecondCats := make(map[string]float64)
-	totalThirdCats := make(map[string]float64)
-	for _, page := range profile.Pages {
-		result, tcatErr := getTextCategory(&page, conf)
-		if tcatErr != nil || result == nil {
-			continue
+const (
+	firstCatLevel  = "first_cat"
+	secondCatLevel = "second_cat"
+	thirdCatLevel  = "third_cat"
+)
+
+type textCategoryProcessor struct {
+	conf *common.Config
+}
+
+func init() {
+	RegisterProcessor("text_category", func(conf *common.Config) Processor {
+		return &textCategoryProcessor{conf: conf}
+	})
+}
+
+func (p *textCategoryProcessor) Name() string {
+	return "text_category"
+}
+
+func (p *textCategoryProcessor) Config() *ProcessorConfig {
+	return &ProcessorConfig{
+		Profile:     p.conf.TcatConf.Profile,
+		Collection:  p.conf.TcatConf.Collection,
+		Aggregation: &p.conf.TcatConf.Aggregation,
+		Output:      &p.conf.TcatConf.Output,
+		Merge:       &p.conf.TcatConf.Merge,
+	}
+}
+
+func (p *textCategoryProcessor) Levels() []string {
+	return []string{firstCatLevel, secondCatLevel, thirdCatLevel}
+}
+
+func (p *textCategoryProcessor) Compute(ctx context.Context, page *common.FBPage) (Feature, error) {
+	result, tcatErr := getTextCategory(ctx, page, p.conf)
+	if tcatErr != nil || result == nil {
+		return nil, tcatErr
+	}
+	return Feature{
+		firstCatLevel:  result.Tcats.FirstCats,
+		secondCatLevel: result.Tcats.SecondCats,
+		thirdCatLevel:  result.Tcats.ThirdCats,
+	}, nil
+}
+
+// prefetchedTextCategoryKey is the ctx key of the categories classified by Prefetch, page id -> category.
+type prefetchedTextCategoryKey struct{}
+
+// Prefetch classifies the uncached pages batch_size per request. The results are saved to mongo and kept in
+// the returned ctx, so Compute finds them even if mongo fails. A failed batch is only logged,
+// Compute then classifies the pages one by one.
+func (p *textCategoryProcessor) Prefetch(ctx context.Context, pages []common.FBPage) context.Context {
+	client := GetTextCategoryClient(&p.conf.TcatConf)
+	batchSize := p.conf.TcatConf.BatchSize
+	if !client.SupportBatch() || batchSize <= 1 {
+		return ctx
+	}
+
+	prefetched := make(map[string]*TextCategoryBody)
+	reqs := make([]*TextCategoryRequest, 0, batchSize)
+	flush := func() {
+		if len(reqs) == 0 {
+			return
 		}
-		if len(result.Tcats.FirstCats) == 0 && len(result.Tcats.SecondCats) == 0 && len(result.Tcats.ThirdCats) == 0 {
-			continue
+		results, batchErr := client.ClassifyBatch(ctx, reqs)
+		if batchErr != nil {
+			glog.Warningf("text category batch of %d pages with error: %+v", len(reqs), batchErr)
 		}
-		pageCnt += 1
-		for cat, score := range result.Tcats.FirstCats {
-			_, ok := totalFirstCats[cat]
-			if ok {
-				totalFirstCats[cat] += score
-			} else {
-				totalFirstCats[cat] = score
-			}
+		for id, tcat := range results {
+			prefetched[id] = tcat
+			saveTextCategory(ctx, id, tcat, p.conf)
 		}
-		for cat, score := range result.Tcats.SecondCats {
-			_, ok := totalSecondCats[cat]
-			if ok {
-				totalSecondCats[cat] += score
-			} else {
-				totalSecondCats[cat] = score
-			}
+		reqs = reqs[:0]
+	}
+	for i := range pages {
+		if ctx.Err() != nil {
+			return ctx
 		}
-		for cat, score := range result.Tcats.ThirdCats {
-			_, ok := totalThirdCats[cat]
-			if ok {
-				totalThirdCats[cat] += score
-			} else {
-				totalThirdCats[cat] = score
-			}
+		if getCachedTextCategory(ctx, pages[i].Id, p.conf) != nil {
+			continue
+		}
+		reqs = append(reqs, NewTextCategoryRequest(&pages[i]))
+		if len(reqs) >= batchSize {
+			flush()
 		}
 	}
-
-	if len(totalFirstCats) == 0 && len(totalSecondCats) == 0 && len(totalThirdCats) == 0 {
-		return nil
+	flush()
+	if len(prefetched) == 0 {
+		return ctx
 	}
+	return context.WithValue(ctx, prefetchedTextCategoryKey{}, prefetched)
+}
 
-	for cat, score := range totalFirstCats {
-		totalFirstCats[cat] = score / float64(pageCnt)
+func (p *textCategoryProcessor) Encode(feature Feature) (string, error) {
+	totalTextCategoryBody := TextCategoryBody{
+		Tcats: TextCategory{
+			FirstCats:  levelScores(feature, firstCatLevel),
+			SecondCats: levelScores(feature, secondCatLevel),
+			ThirdCats:  levelScores(feature, thirdCatLevel),
+		},
 	}
-	for cat, score := range totalSecondCats {
-		totalSecondCats[cat] = score / float64(pageCnt)
+	value, encodeErr := json.Marshal(totalTextCategoryBody)
+	if encodeErr != nil {
+		return "", encodeErr
 	}
-	for cat, score := range totalThirdCats {
-		totalThirdCats[cat] = score / float64(pageCnt)
+	return string(value), nil
+}
+
+// levelScores returns {} instead of nil for a level without score, so the output is the same for full and incremental updates.
+func levelScores(feature Feature, level string) map[string]float64 {
+	scores, ok := feature[level]
+	if !ok || scores == nil {
+		return make(map[string]float64)
 	}
+	return scores
+}
 
-	totalTextCategory := TextCategory{
-		FirstCats: totalFirstCats,
-		SecondCats: totalSecondCats,
-		ThirdCats: totalThirdCats,
+func (p *textCategoryProcessor) Decode(value string) (Feature, error) {
+	var tcat TextCategoryBody
+	parseErr := json.Unmarshal([]byte(value), &tcat)
+	if parseErr != nil {
+		return nil, parseErr
 	}
+	return Feature{
+		firstCatLevel:  tcat.Tcats.FirstCats,
+		secondCatLevel: tcat.Tcats.SecondCats,
+		thirdCatLevel:  tcat.Tcats.ThirdCats,
+	}, nil
+}
 
-	totalTextCategoryBody := TextCategoryBody{
-		Tcats: totalTextCategory,
+func getTextCategory(ctx context.Context, page *common.FBPage, conf *common.Config) (*TextCategoryBody, error) {
+	prefetched, _ := ctx.Value(prefetchedTextCategoryKey{}).(map[string]*TextCategoryBody)
+	if tcat, ok := prefetched[page.Id]; ok && len(page.Id) != 0 {
+		return tcat, nil
 	}
-	value, encodeErr := json.Marshal(totalTextCategoryBody)
-	if encodeErr != nil {
-		return encodeErr
+	cached := getCachedTextCategory(ctx, page.Id, conf)
+	if cached != nil {
+		return cached, nil
 	}
 
-	glog.Infof("ready to write to ups, profile: %s, key: %d, value: %s", conf.TcatConf.Profile, profile.Id, string(value))
-	WriteToUps(uint64(profile.Id), string(value), conf.TcatConf.Profile, &conf.UpsConf)
-	return nil
+	tcat, classifyErr := GetTextCategoryClient(&conf.TcatConf).Classify(ctx, NewTextCategoryRequest(page))
+	if classifyErr != nil {
+		return nil, classifyErr
+	}
+	saveTextCategory(ctx, page.Id, tcat, conf)
+	return tcat, nil
 }
 
-func getTextCategory(page *common.FBPage, conf *common.Config) (*TextCategoryBody, error) {
-	pageTcat, getErr := getTextCategoryFromMongo(page.Id, conf)
+// getCachedTextCategory returns nil if the page is not in mongo or has no category.
+func getCachedTextCategory(ctx context.Context, pageId string, conf *common.Config) *TextCategoryBody {
+	pageTcat, getErr := getTextCategoryFromMongo(ctx, pageId, conf)
 	if getErr == nil && pageTcat != nil && pageTcat.Tcat != nil {
-		firstCats, ok := pageTcat.Tcat["first_cat"]
+		firstCats, ok := pageTcat.Tcat[firstCatLevel]
 		if !ok {
 			firstCats = make(map[string]float64)
 		}
-		secondCats, ok := pageTcat.Tcat["second_cat"]
+		secondCats, ok := pageTcat.Tcat[secondCatLevel]
 		if !ok {
 			secondCats = make(map[string]float64)
 		}
-		thirdCats, ok := pageTcat.Tcat["third_cat"]
+		thirdCats, ok := pageTcat.Tcat[thirdCatLevel]
 		if !ok {
 			thirdCats = make(map[string]float64)
 		}
@@ -125,95 +197,35 @@ func getTextCategory(page *common.FBPage, conf *common.Config) (*TextCategoryBod
 			tcat := TextCategoryBody{
 				Tcats: tcats,
 			}
-			return &tcat, nil
+			return &tcat
 		}
 	}
+	return nil
+}
 
-	bodyMap := map[string]string{
-		"id": page.Id,
-		"seg_title": page.Name,
-		"seg_content": strings.ReplaceAll(page.About, "\n", ""),
-	}
-	body, encodeErr := json.Marshal(bodyMap)
-	if encodeErr != nil {
-		return nil, encodeErr
-	}
-
-	resp, respErr := http.Post(conf.TcatConf.Uri, conf.TcatConf.ContentType, bytes.NewBuffer(body))
-	if respErr != nil {
-		return nil, respErr
-	}
-
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		return nil, nil
-	}
-
-	respBody, readErr := ioutil.ReadAll(resp.Body)
-	if readErr != nil {
-		return nil, readErr
-	}
-
-	var tcat TextCategoryBody
-	parseErr := json.Unmarshal(respBody, &tcat)
-	if parseErr != nil {
-		return nil, parseErr
-	}
-
+func saveTextCategory(ctx context.Context, pageId string, tcat *TextCategoryBody, conf *common.Config) {
 	tcats := make(map[string]map[string]float64)
-	tcats["first_cat"] = tcat.Tcats.FirstCats
-	tcats["second_cat"] = tcat.Tcats.SecondCats
-	tcats["third_cat"] = tcat.Tcats.ThirdCats
-	pageTcat = &PageTcat{
-		Id: page.Id,
+	tcats[firstCatLevel] = tcat.Tcats.FirstCats
+	tcats[secondCatLevel] = tcat.Tcats.SecondCats
+	tcats[thirdCatLevel] = tcat.Tcats.ThirdCats
+	pageTcat := &PageTcat{
+		Id: pageId,
 		Tcat: tcats,
 	}
-	setErr := setTextCategoryToMongo(pageTcat.Id, pageTcat, conf)
+	setErr := setTextCategoryToMongo(ctx, pageTcat.Id, pageTcat, conf)
 	if setErr != nil {
-		glog.Warning("set tcat to mongo with error: %v, value: %+v", setErr, *pageTcat)
+		glog.Warningf("set tcat to mongo with error: %v, value: %+v", setErr, *pageTcat)
 	}
-
-	return &tcat, nil
 }
 
-func setTextCategoryToMongo(key string, value *PageTcat, conf *common.Config) error {
-	timeout := time.Duration(conf.MongoConf.Timeout) * time.Millisecond
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-
-	_, insertErr := collectionMap[conf.TcatConf.Collection].InsertOne(ctx, *value)
-	if insertErr != nil {
-		// replace when exist
-		replaceErr := replaceTextCategoryToMongo(key, value, conf)
-		return replaceErr
-	}
-	return nil
-}
-
-func replaceTextCategoryToMongo(key string, value *PageTcat, conf *common.Config) (error) {
-	timeout := time.Duration(conf.MongoConf.Timeout) * time.Millisecond
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-
-	filter := bson.M{"_id": key}
-	_, replaceErr := collectionMap[conf.TcatConf.Collection].ReplaceOne(ctx, filter, *value)
-	return replaceErr
+func setTextCategoryToMongo(ctx context.Context, key string, value *PageTcat, conf *common.Config) error {
+	return pageStore.Replace(ctx, conf.TcatConf.Collection, key, *value)
 }
 
-func getTextCategoryFromMongo(key string, conf *common.Config) (*PageTcat, error) {
-	timeout := time.Duration(conf.MongoConf.Timeout) * time.Millisecond
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-
-	filter := bson.M{"_id": key}
-	result := collectionMap[conf.TcatConf.Collection].FindOne(ctx, filter)
-	if result.Err() != nil {
-		return nil, result.Err()
-	}
-
-	raw, decodeErr := result.DecodeBytes()
-	if decodeErr != nil {
-		return nil, decodeErr
+func getTextCategoryFromMongo(ctx context.Context, key string, conf *common.Config) (*PageTcat, error) {
+	raw, findErr := pageStore.Find(ctx, conf.TcatConf.Collection, key)
+	if findErr != nil {
+		return nil, findErr
 	}
 
 	var value PageTcat
@@ -0,0 +1,181 @@
+package remote
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ParticleMedia/fb_page_server/common"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const textCategoryService = "text category"
+const maxTextCategoryResponseSize = 16 * 1024 * 1024
+
+type TextCategoryRequest struct {
+	Id         string `json:"id"`
+	SegTitle   string `json:"seg_title"`
+	SegContent string `json:"seg_content"`
+	// facebook categories joined by ,
+	Category string `json:"category"`
+}
+
+func NewTextCategoryRequest(page *common.FBPage) *TextCategoryRequest {
+	return &TextCategoryRequest{
+		Id:         page.Id,
+		SegTitle:   page.Name,
+		SegContent: page.Content(),
+		Category:   strings.Join(page.Categories(), ","),
+	}
+}
+
+type textCategoryBatchRequest struct {
+	Pages []*TextCategoryRequest `json:"pages"`
+}
+
+type textCategoryBatchResult struct {
+	Id    string        `json:"id"`
+	Tcats *TextCategory `json:"text_category"`
+}
+
+type textCategoryBatchResponse struct {
+	Results []textCategoryBatchResult `json:"results"`
+}
+
+// TextCategoryClient calls the text category dnn, one page per request on uri,
+// or several pages per request on batchUri: {"pages": [request]} -> {"results": [{"id", "text_category"}]}.
+type TextCategoryClient struct {
+	uri         string
+	batchUri    string
+	contentType string
+	client      *http.Client
+}
+
+type textCategoryClientKey struct {
+	uri         string
+	batchUri    string
+	contentType string
+	http        common.HttpClientConfig
+}
+
+var textCategoryClientLock sync.Mutex
+var textCategoryClients = make(map[textCategoryClientKey]*TextCategoryClient)
+
+// GetTextCategoryClient returns the client of conf, clients are kept so the connections are reused across calls.
+func GetTextCategoryClient(conf *common.TextCategoryConfig) *TextCategoryClient {
+	key := textCategoryClientKey{
+		uri:         conf.Uri,
+		batchUri:    conf.BatchUri,
+		contentType: conf.ContentType,
+		http:        conf.Http,
+	}
+	textCategoryClientLock.Lock()
+	defer textCategoryClientLock.Unlock()
+	client, ok := textCategoryClients[key]
+	if !ok {
+		client = NewTextCategoryClient(conf)
+		textCategoryClients[key] = client
+	}
+	return client
+}
+
+func NewTextCategoryClient(conf *common.TextCategoryConfig) *TextCategoryClient {
+	contentType := conf.ContentType
+	if len(contentType) == 0 {
+		contentType = "application/json"
+	}
+	return &TextCategoryClient{
+		uri:         conf.Uri,
+		batchUri:    conf.BatchUri,
+		contentType: contentType,
+		client:      newHttpClient(&conf.Http),
+	}
+}
+
+func (c *TextCategoryClient) SupportBatch() bool {
+	return len(c.batchUri) != 0
+}
+
+// Classify returns the text category of one page, errors are RemoteError.
+func (c *TextCategoryClient) Classify(ctx context.Context, req *TextCategoryRequest) (*TextCategoryBody, error) {
+	respBody, postErr := c.post(ctx, c.uri, req)
+	if postErr != nil {
+		return nil, postErr
+	}
+	var tcat TextCategoryBody
+	parseErr := json.Unmarshal(respBody, &tcat)
+	if parseErr != nil {
+		return nil, &RemoteError{Service: textCategoryService, Kind: RemoteBadResponse, Err: parseErr}
+	}
+	return &tcat, nil
+}
+
+// ClassifyBatch returns the text category by page id, pages missing in the response are not in the result.
+func (c *TextCategoryClient) ClassifyBatch(ctx context.Context, reqs []*TextCategoryRequest) (map[string]*TextCategoryBody, error) {
+	if !c.SupportBatch() {
+		return nil, errors.New("text category batch uri is not configured")
+	}
+	respBody, postErr := c.post(ctx, c.batchUri, &textCategoryBatchRequest{Pages: reqs})
+	if postErr != nil {
+		return nil, postErr
+	}
+	var batchResp textCategoryBatchResponse
+	parseErr := json.Unmarshal(respBody, &batchResp)
+	if parseErr != nil {
+		return nil, &RemoteError{Service: textCategoryService, Kind: RemoteBadResponse, Err: parseErr}
+	}
+
+	result := make(map[string]*TextCategoryBody, len(batchResp.Results))
+	for _, item := range batchResp.Results {
+		if item.Tcats == nil {
+			continue
+		}
+		result[item.Id] = &TextCategoryBody{Tcats: *item.Tcats}
+	}
+	if len(result) != len(reqs) {
+		return result, &RemoteError{
+			Service: textCategoryService,
+			Kind:    RemoteBadResponse,
+			Err:     errors.New(fmt.Sprintf("%d of %d pages in the batch response", len(result), len(reqs))),
+		}
+	}
+	return result, nil
+}
+
+func (c *TextCategoryClient) post(ctx context.Context, uri string, req interface{}) ([]byte, error) {
+	body, encodeErr := json.Marshal(req)
+	if encodeErr != nil {
+		return nil, encodeErr
+	}
+
+	var respBody []byte
+	callErr := callRemote(ctx, BreakerTextCategory, func() error {
+		req, reqErr := newRequest(ctx, http.MethodPost, uri, c.contentType, body)
+		if reqErr != nil {
+			return reqErr
+		}
+		resp, respErr := c.client.Do(req)
+		if respErr != nil {
+			return requestError(textCategoryService, respErr)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			return statusError(textCategoryService, resp)
+		}
+
+		var readErr error
+		respBody, readErr = ioutil.ReadAll(io.LimitReader(resp.Body, maxTextCategoryResponseSize))
+		if readErr != nil {
+			return requestError(textCategoryService, readErr)
+		}
+		return nil
+	}, isRemoteFailure)
+	if callErr != nil {
+		return nil, callErr
+	}
+	return respBody, nil
+}
@@ -0,0 +1,79 @@
+package remote
+
+import (
+	"context"
+	"errors"
+	"github.com/ParticleMedia/fb_page_server/common"
+	"github.com/ParticleMedia/fb_page_server/internal/testutil/fake"
+	"go.mongodb.org/mongo-driver/bson"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// downStore is a page store whose mongo is down
+type downStore struct{}
+
+var errStoreDown = errors.New("store down")
+
+func (downStore) Find(ctx context.Context, collection string, key string) (bson.Raw, error) {
+	return nil, errStoreDown
+}
+
+func (downStore) Replace(ctx context.Context, collection string, key string, value interface{}) error {
+	return errStoreDown
+}
+
+func (downStore) Delete(ctx context.Context, collection string, key string) error {
+	return errStoreDown
+}
+
+func (downStore) Incr(ctx context.Context, collection string, key string, field string, delta int64) (int64, error) {
+	return 0, errStoreDown
+}
+
+func (downStore) Count(ctx context.Context, collection string) (int64, error) {
+	return 0, errStoreDown
+}
+
+// TestPrefetchWithoutStore computes the pages from the batch results when they can not be saved to mongo.
+func TestPrefetchWithoutStore(t *testing.T) {
+	tcat := fake.NewTextCategoryServer(nil, []fake.TextCategoryRule{
+		{Pattern: "basketball", FirstCats: map[string]float64{"Sports": 0.8}},
+		{Pattern: "jazz", FirstCats: map[string]float64{"Music": 0.6}},
+		{Pattern: "pizza", FirstCats: map[string]float64{"Food": 0.4}},
+	})
+	tcatMux := http.NewServeMux()
+	tcatMux.Handle("/", tcat)
+	tcatMux.HandleFunc("/batch", tcat.ServeBatch)
+	tcatServer := httptest.NewServer(tcatMux)
+	defer tcatServer.Close()
+
+	conf := &common.Config{}
+	conf.TcatConf.Uri = tcatServer.URL
+	conf.TcatConf.BatchUri = tcatServer.URL + "/batch"
+	conf.TcatConf.BatchSize = 2
+	conf.TcatConf.Collection = "page_tcat"
+	oldStore := pageStore
+	defer SetPageStore(oldStore)
+	SetPageStore(downStore{})
+
+	pages := []common.FBPage{
+		{Id: "901", Name: "Bulls Basketball"},
+		{Id: "902", Name: "Blue Note", About: "Jazz club"},
+		{Id: "903", Name: "Pizza Corner"},
+	}
+	features, failedCnt := ComputeFeatures(context.Background(), &textCategoryProcessor{conf: conf}, pages)
+	if failedCnt != 0 || len(features) != 3 {
+		t.Fatalf("features: %d, failed: %d, want 3 and 0", len(features), failedCnt)
+	}
+	for i, want := range []string{"Sports", "Music", "Food"} {
+		if features[i].Feature[firstCatLevel][want] == 0 {
+			t.Errorf("page %s: %v, want %s", features[i].Page.Id, features[i].Feature, want)
+		}
+	}
+	// 2 batches, no page classified again
+	if tcat.Requests() != 2 {
+		t.Errorf("requests: %d, want 2", tcat.Requests())
+	}
+}
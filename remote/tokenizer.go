@@ -0,0 +1,239 @@
+package remote
+
+import (
+	"golang.org/x/text/unicode/norm"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type TokenKind int
+
+const (
+	TokenWord TokenKind = iota
+	TokenNumber
+	TokenHashtag
+	TokenUrl
+	// two characters of a chinese or japanese run, which has no spaces between words
+	TokenCJK
+)
+
+// Token is one word of a page text or a channel name.
+type Token struct {
+	// as in the text, the keyword service takes the original case
+	Text string
+	// lower case without accents, what the channel rules compare
+	Norm string
+	Kind TokenKind
+}
+
+// Tokenize splits text on unicode spaces, punctuation and symbols (emoji included).
+// Apostrophes inside a word and dots or commas inside a number are kept, e.g. don't, 3.14.
+// A url is one token, a hashtag is split on its camel case, e.g. #ItalianFood is Italian and Food.
+// A run of chinese or japanese characters is split into overlapping bigrams, e.g. 北京烤鸭 is 北京, 京烤 and 烤鸭.
+func Tokenize(text string) []Token {
+	tokens := make([]Token, 0)
+	for _, chunk := range strings.FieldsFunc(text, unicode.IsSpace) {
+		if isUrl(chunk) {
+			tokens = append(tokens, Token{Text: chunk, Norm: strings.ToLower(chunk), Kind: TokenUrl})
+			continue
+		}
+		hashtag := strings.HasPrefix(chunk, "#") || strings.HasPrefix(chunk, "＃")
+		for _, word := range splitWords(chunk) {
+			if isCJKWord(word) {
+				for _, gram := range cjkBigrams(word) {
+					tokens = append(tokens, Token{Text: gram, Norm: NormalizeText(gram), Kind: TokenCJK})
+				}
+				continue
+			}
+			if !hashtag {
+				tokens = append(tokens, newToken(word, TokenWord))
+				continue
+			}
+			for _, part := range splitCamelCase(word) {
+				tokens = append(tokens, newToken(part, TokenHashtag))
+			}
+		}
+	}
+	return tokens
+}
+
+func newToken(word string, kind TokenKind) Token {
+	// 1,000 is a number
+	if isNumber(strings.ReplaceAll(word, ",", "")) {
+		kind = TokenNumber
+	}
+	return Token{Text: word, Norm: NormalizeText(word), Kind: kind}
+}
+
+// NormalizeText lower cases text and removes the accents, e.g. Café is cafe.
+func NormalizeText(text string) string {
+	decomposed := norm.NFD.String(text)
+	var builder strings.Builder
+	builder.Grow(len(decomposed))
+	for _, r := range decomposed {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		builder.WriteRune(unicode.ToLower(r))
+	}
+	return norm.NFC.String(builder.String())
+}
+
+func isUrl(chunk string) bool {
+	lower := strings.ToLower(chunk)
+	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://") || strings.HasPrefix(lower, "www.")
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsNumber(r) || unicode.IsMark(r)
+}
+
+func splitWords(chunk string) []string {
+	runes := []rune(chunk)
+	words := make([]string, 0)
+	start := -1
+	for i, r := range runes {
+		if isWordRune(r) {
+			if start < 0 {
+				start = i
+			} else if isCJK(r) != isCJK(runes[i-1]) {
+				// 中日文与其他文字之间切分，e.g. 北京烤鸭restaurant
+				words = append(words, string(runes[start:i]))
+				start = i
+			}
+			continue
+		}
+		// 词内的撇号、数字内的小数点和千分位不切分
+		if start >= 0 && i+1 < len(runes) {
+			prev, next := runes[i-1], runes[i+1]
+			if (r == '\'' || r == '’') && unicode.IsLetter(prev) && unicode.IsLetter(next) {
+				continue
+			}
+			if (r == '.' || r == ',') && unicode.IsDigit(prev) && unicode.IsDigit(next) {
+				continue
+			}
+		}
+		if start >= 0 {
+			words = append(words, string(runes[start:i]))
+			start = -1
+		}
+	}
+	if start >= 0 {
+		words = append(words, string(runes[start:]))
+	}
+	return words
+}
+
+func isCJK(r rune) bool {
+	return unicode.Is(unicode.Han, r) || unicode.Is(unicode.Hiragana, r) || unicode.Is(unicode.Katakana, r) || r == 'ー'
+}
+
+func isCJKWord(word string) bool {
+	for _, r := range word {
+		return isCJK(r)
+	}
+	return false
+}
+
+func cjkBigrams(word string) []string {
+	runes := []rune(word)
+	if len(runes) <= 2 {
+		return []string{word}
+	}
+	grams := make([]string, 0, len(runes)-1)
+	for i := 0; i+2 <= len(runes); i++ {
+		grams = append(grams, string(runes[i:i+2]))
+	}
+	return grams
+}
+
+// cjkRuns returns the chinese or japanese runs of text.
+func cjkRuns(text string) []string {
+	runs := make([]string, 0)
+	for _, chunk := range strings.FieldsFunc(text, unicode.IsSpace) {
+		if isUrl(chunk) {
+			continue
+		}
+		for _, word := range splitWords(chunk) {
+			if isCJKWord(word) {
+				runs = append(runs, word)
+			}
+		}
+	}
+	return runs
+}
+
+// cjkCandidates returns every 2 to 4 characters of the chinese or japanese runs of text,
+// the keyword service chooses the words among them as there is no space to split on.
+func cjkCandidates(text string) []string {
+	candidates := make([]string, 0)
+	for _, run := range cjkRuns(text) {
+		runes := []rune(run)
+		for size := 2; size <= 4; size++ {
+			for i := 0; i+size <= len(runes); i++ {
+				candidates = append(candidates, string(runes[i:i+size]))
+			}
+		}
+	}
+	return candidates
+}
+
+// phraseWords returns the original words of the tokens as the segments between urls and chinese or japanese runs,
+// so a phrase never joins the words around them.
+func phraseWords(tokens []Token) [][]string {
+	segments := make([][]string, 0)
+	words := make([]string, 0)
+	for _, token := range tokens {
+		if token.Kind == TokenUrl || token.Kind == TokenCJK {
+			if len(words) != 0 {
+				segments = append(segments, words)
+				words = make([]string, 0)
+			}
+			continue
+		}
+		words = append(words, token.Text)
+	}
+	if len(words) != 0 {
+		segments = append(segments, words)
+	}
+	return segments
+}
+
+// splitCamelCase splits a word starting with an upper case letter before every following upper case letter after a lower case one.
+func splitCamelCase(word string) []string {
+	runes := []rune(word)
+	if len(runes) == 0 || !unicode.IsUpper(runes[0]) {
+		return []string{word}
+	}
+	parts := make([]string, 0)
+	start := 0
+	for i := 1; i < len(runes); i++ {
+		if unicode.IsUpper(runes[i]) && unicode.IsLower(runes[i-1]) {
+			parts = append(parts, string(runes[start:i]))
+			start = i
+		}
+	}
+	return append(parts, string(runes[start:]))
+}
+
+// tokenWords returns the words of the tokens except urls, normalized or in the original case.
+func tokenWords(tokens []Token, normalized bool) []string {
+	words := make([]string, 0, len(tokens))
+	for _, token := range tokens {
+		if token.Kind == TokenUrl {
+			continue
+		}
+		if normalized {
+			words = append(words, token.Norm)
+		} else {
+			words = append(words, token.Text)
+		}
+	}
+	return words
+}
+
+// isTermWord is whether a word is long enough to be counted as a term or in a phrase.
+func isTermWord(word string) bool {
+	return utf8.RuneCountInString(word) >= 2
+}
@@ -0,0 +1,165 @@
+package remote
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/ParticleMedia/fb_page_server/common"
+	"github.com/golang/glog"
+	"go.mongodb.org/mongo-driver/bson"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+type PageTpcm struct {
+	Id   string             `bson:"_id"`
+	Tpcm map[string]float64 `bson:"tpcm"`
+}
+
+// TopicModelBody is the response of topic_model.uri and the json of the ups value, topic -> score.
+type TopicModelBody struct {
+	Topics map[string]float64 `json:"tpcm"`
+}
+
+const topicModelLevel = "tpcm"
+const topicModelService = "topic_model"
+const maxTopicModelResponseSize = 16 * 1024 * 1024
+
+type topicModelProcessor struct {
+	conf   *common.Config
+	client *http.Client
+}
+
+func init() {
+	RegisterProcessor("topic_model", func(conf *common.Config) Processor {
+		return &topicModelProcessor{conf: conf, client: newHttpClient(&conf.TpcmConf.Http)}
+	})
+}
+
+func (p *topicModelProcessor) Name() string {
+	return "topic_model"
+}
+
+func (p *topicModelProcessor) Config() *ProcessorConfig {
+	return &ProcessorConfig{
+		Profile:     p.conf.TpcmConf.Profile,
+		Collection:  p.conf.TpcmConf.Collection,
+		Aggregation: &p.conf.TpcmConf.Aggregation,
+		Output:      &p.conf.TpcmConf.Output,
+		Merge:       &p.conf.TpcmConf.Merge,
+	}
+}
+
+func (p *topicModelProcessor) Levels() []string {
+	return []string{topicModelLevel}
+}
+
+func (p *topicModelProcessor) Compute(ctx context.Context, page *common.FBPage) (Feature, error) {
+	result, tpcmErr := getTopicModel(ctx, p.client, page, p.conf)
+	if tpcmErr != nil || result == nil || len(result.Topics) == 0 {
+		return nil, tpcmErr
+	}
+	return Feature{topicModelLevel: result.Topics}, nil
+}
+
+func (p *topicModelProcessor) Encode(feature Feature) (string, error) {
+	totalTopicModelBody := TopicModelBody{
+		Topics: feature[topicModelLevel],
+	}
+	value, encodeErr := json.Marshal(totalTopicModelBody)
+	if encodeErr != nil {
+		return "", encodeErr
+	}
+	return string(value), nil
+}
+
+func (p *topicModelProcessor) Decode(value string) (Feature, error) {
+	var tpcm TopicModelBody
+	parseErr := json.Unmarshal([]byte(value), &tpcm)
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	return Feature{topicModelLevel: tpcm.Topics}, nil
+}
+
+// getTopicModel returns the topics of the page from mongo, or from topic_model.uri which is POSTed
+// {"id": page id, "seg_title": page name, "seg_content": page content} and answers 200 with
+// {"tpcm": {"<topic>": score, ...}}, other fields of the response are ignored. This is the contract the processor expects, it is not verified against a deployed service yet,
+// so topic_model ships out of the processors until ops supply the uri.
+func getTopicModel(ctx context.Context, client *http.Client, page *common.FBPage, conf *common.Config) (*TopicModelBody, error) {
+	pageTpcm, getErr := getTopicModelFromMongo(ctx, page.Id, conf)
+	if getErr == nil && pageTpcm != nil && len(pageTpcm.Tpcm) != 0 {
+		return &TopicModelBody{Topics: pageTpcm.Tpcm}, nil
+	}
+
+	bodyMap := map[string]string{
+		"id":          page.Id,
+		"seg_title":   page.Name,
+		"seg_content": page.Content(),
+	}
+	body, encodeErr := json.Marshal(bodyMap)
+	if encodeErr != nil {
+		return nil, encodeErr
+	}
+
+	var respBody []byte
+	callErr := callRemote(ctx, BreakerTopicModel, func() error {
+		req, reqErr := newRequest(ctx, http.MethodPost, conf.TpcmConf.Uri, conf.TpcmConf.ContentType, body)
+		if reqErr != nil {
+			return reqErr
+		}
+		resp, respErr := client.Do(req)
+		if respErr != nil {
+			return requestError(topicModelService, respErr)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			return statusError(topicModelService, resp)
+		}
+
+		var readErr error
+		respBody, readErr = ioutil.ReadAll(io.LimitReader(resp.Body, maxTopicModelResponseSize))
+		if readErr != nil {
+			return requestError(topicModelService, readErr)
+		}
+		return nil
+	}, isRemoteFailure)
+	if callErr != nil {
+		return nil, callErr
+	}
+
+	var tpcm TopicModelBody
+	parseErr := json.Unmarshal(respBody, &tpcm)
+	if parseErr != nil {
+		return nil, &RemoteError{Service: topicModelService, Kind: RemoteBadResponse, Err: parseErr}
+	}
+
+	pageTpcm = &PageTpcm{
+		Id:   page.Id,
+		Tpcm: tpcm.Topics,
+	}
+	setErr := setTopicModelToMongo(ctx, pageTpcm.Id, pageTpcm, conf)
+	if setErr != nil {
+		glog.Warningf("set tpcm to mongo with error: %v, value: %+v", setErr, *pageTpcm)
+	}
+
+	return &tpcm, nil
+}
+
+func setTopicModelToMongo(ctx context.Context, key string, value *PageTpcm, conf *common.Config) error {
+	return pageStore.Replace(ctx, conf.TpcmConf.Collection, key, *value)
+}
+
+func getTopicModelFromMongo(ctx context.Context, key string, conf *common.Config) (*PageTpcm, error) {
+	raw, findErr := pageStore.Find(ctx, conf.TpcmConf.Collection, key)
+	if findErr != nil {
+		return nil, findErr
+	}
+
+	var value PageTpcm
+	parseErr := bson.Unmarshal(raw, &value)
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	return &value, nil
+}
@@ -5,23 +5,15 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/ParticleMedia/fb_page_server/common"
 	user_profile_pb "github.com/ParticleMedia/fb_page_server/proto"
 	"github.com/golang/glog"
 	"google.golang.org/grpc"
-	"math/rand"
 	"strconv"
-	"strings"
 	"time"
 )
 
-var valueType user_profile_pb.ProfileValueType
-
-func SetValueType(conf *common.UserProfileConfig) {
-	intType, _ := user_profile_pb.ProfileValueType_value[strings.ToUpper(conf.Format)]
-	valueType = user_profile_pb.ProfileValueType(intType)
-}
-
 func fromString(data string, valueType user_profile_pb.ProfileValueType) (*user_profile_pb.ProfileValue, error) {
 	if len(data) == 0 {
 		return nil, nil
@@ -87,25 +79,108 @@ func fromString(data string, valueType user_profile_pb.ProfileValueType) (*user_
 	return value, nil
 }
 
-func WriteToUps(key uint64, value string, profile string, conf *common.UserProfileConfig) {
+func toString(value *user_profile_pb.ProfileValue) (string, error) {
+	if value == nil {
+		return "", nil
+	}
+	switch value.Type {
+	case user_profile_pb.ProfileValueType_STRING:
+		return value.GetStrValue(), nil
+	case user_profile_pb.ProfileValueType_RAW_BYTES:
+		return base64.StdEncoding.EncodeToString(value.GetBytesValue()), nil
+	case user_profile_pb.ProfileValueType_INT:
+		return strconv.FormatInt(value.GetIntValue(), 10), nil
+	case user_profile_pb.ProfileValueType_FLOAT:
+		return strconv.FormatFloat(value.GetFloatValue(), 'g', -1, 64), nil
+	case user_profile_pb.ProfileValueType_LIST:
+		data, err := json.Marshal(value.GetListValue().GetList())
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	default:
+		return "", errors.New("unsupported value type")
+	}
+}
+
+// GetFromUps returns the value of profile in the same format WriteToUps takes, or "" when it does not exist.
+func GetFromUps(ctx context.Context, key uint64, profile string, conf *common.UserProfileConfig) (string, error) {
+	breaker := GetBreaker(BreakerUps)
+	allowErr := breaker.Allow()
+	if allowErr != nil {
+		return "", allowErr
+	}
+	start := time.Now()
 	conn, dialErr := grpc.Dial(conf.Addr, grpc.WithInsecure())
 	if dialErr != nil {
+		breaker.Record(true, time.Since(start))
 		glog.Warningf("ups connect to %s with error: %+v", conf.Addr, dialErr)
-		return
+		return "", dialErr
 	}
 	defer conn.Close()
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(conf.Timeout) * time.Millisecond)
+	callCtx, cancel := context.WithTimeout(ctx, time.Duration(conf.Timeout) * time.Millisecond)
 	defer cancel()
 
-	logid := rand.Int63()
+	logid := common.LogId(ctx)
 	c := user_profile_pb.NewUserProfileServiceClient(conn)
+	resp, getErr := c.Get(callCtx, &user_profile_pb.GetRequest{
+		LogId: logid,
+		From: conf.ReqFrom,
+		Uid: key,
+		ProfileList: []*user_profile_pb.ProfileIdentity{
+			{
+				Name: profile,
+				Version: uint32(conf.Version),
+			},
+		},
+		DisableCache: true,
+	})
+	breaker.finish(ctx, getErr != nil, time.Since(start))
+	if getErr != nil {
+		return "", getErr
+	}
+	if resp.Status != 0 {
+		return "", errors.New(fmt.Sprintf("ups get with status: %d, msg: %s", resp.Status, resp.ErrMsg))
+	}
+
+	for _, item := range resp.ProfileList {
+		if item.GetId().GetName() == profile {
+			return toString(item.GetValue())
+		}
+	}
+	return "", nil
+}
+
+func WriteToUps(ctx context.Context, key uint64, value string, valueType user_profile_pb.ProfileValueType, profile string, conf *common.UserProfileConfig) error {
+	// 格式错误与ups无关，在Allow之前检查
 	pbValue, valErr := fromString(value, valueType)
 	if valErr != nil {
-		glog.Warning("ups format with error: %+v, value: %d", valErr, value)
-		return
+		glog.Warningf("ups format with error: %+v, value: %s", valErr, value)
+		return valErr
 	}
-	resp, setErr := c.Set(ctx, &user_profile_pb.SetRequest{
+
+	breaker := GetBreaker(BreakerUps)
+	allowErr := breaker.Allow()
+	if allowErr != nil {
+		glog.Warningf("ups set skipped: %+v, key: %d", allowErr, key)
+		return allowErr
+	}
+	start := time.Now()
+	conn, dialErr := grpc.Dial(conf.Addr, grpc.WithInsecure())
+	if dialErr != nil {
+		breaker.Record(true, time.Since(start))
+		glog.Warningf("ups connect to %s with error: %+v", conf.Addr, dialErr)
+		return dialErr
+	}
+	defer conn.Close()
+
+	callCtx, cancel := context.WithTimeout(ctx, time.Duration(conf.Timeout) * time.Millisecond)
+	defer cancel()
+
+	logid := common.LogId(ctx)
+	c := user_profile_pb.NewUserProfileServiceClient(conn)
+	resp, setErr := c.Set(callCtx, &user_profile_pb.SetRequest{
 		LogId: logid,
 		From: conf.ReqFrom,
 		Profile: &user_profile_pb.UserProfile{
@@ -122,9 +197,67 @@ func WriteToUps(key uint64, value string, profile string, conf *common.UserProfi
 		},
 		DisableCache: conf.DisableCache,
 	})
+	breaker.finish(ctx, setErr != nil, time.Since(start))
 
-	if setErr != nil || resp.Status != 0 {
+	if setErr != nil {
 		glog.Warningf("ups set with error: %v, key: %d", setErr, key)
+		return setErr
+	}
+	if resp.Status != 0 {
+		glog.Warningf("ups set with status: %d, msg: %s, key: %d", resp.Status, resp.ErrMsg, key)
+		return errors.New(resp.ErrMsg)
 	}
+	return nil
 }
 
+
+func DeleteFromUps(ctx context.Context, key uint64, profiles []string, conf *common.UserProfileConfig) error {
+	if len(profiles) == 0 {
+		return nil
+	}
+
+	breaker := GetBreaker(BreakerUps)
+	allowErr := breaker.Allow()
+	if allowErr != nil {
+		return allowErr
+	}
+	start := time.Now()
+	conn, dialErr := grpc.Dial(conf.Addr, grpc.WithInsecure())
+	if dialErr != nil {
+		breaker.Record(true, time.Since(start))
+		glog.Warningf("ups connect to %s with error: %+v", conf.Addr, dialErr)
+		return dialErr
+	}
+	defer conn.Close()
+
+	callCtx, cancel := context.WithTimeout(ctx, time.Duration(conf.Timeout) * time.Millisecond)
+	defer cancel()
+
+	logid := common.LogId(ctx)
+	c := user_profile_pb.NewUserProfileServiceClient(conn)
+	profileList := make([]*user_profile_pb.ProfileIdentity, 0, len(profiles))
+	for _, profile := range profiles {
+		profileList = append(profileList, &user_profile_pb.ProfileIdentity{
+			Name: profile,
+			Version: uint32(conf.Version),
+		})
+	}
+	resp, delErr := c.Delete(callCtx, &user_profile_pb.DeleteRequest{
+		LogId: logid,
+		From: conf.ReqFrom,
+		Uid: key,
+		ProfileList: profileList,
+		DisableCache: conf.DisableCache,
+	})
+	breaker.finish(ctx, delErr != nil, time.Since(start))
+
+	if delErr != nil {
+		glog.Warningf("ups delete with error: %v, key: %d", delErr, key)
+		return delErr
+	}
+	if resp.Status != 0 {
+		glog.Warningf("ups delete with status: %d, msg: %s, key: %d", resp.Status, resp.ErrMsg, key)
+		return errors.New(resp.ErrMsg)
+	}
+	return nil
+}
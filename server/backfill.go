@@ -0,0 +1,467 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ParticleMedia/fb_page_server/common"
+	"github.com/ParticleMedia/fb_page_server/remote"
+	"github.com/golang/glog"
+	"go.mongodb.org/mongo-driver/bson"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BackfillOptions reads the profiles from Input (a json lines file or a dir of them) or from MongoCollection.
+type BackfillOptions struct {
+	Input              string
+	MongoCollection    string
+	Concurrency        int
+	Rate               float64
+	Checkpoint         string
+	CheckpointInterval time.Duration
+	// json lines file the failed profiles are appended to, so they can be backfilled again as input.
+	// Without it the checkpoint stays before the first failed profile.
+	Retry string
+}
+
+type BackfillStats struct {
+	Read      int64 `json:"read"`
+	Processed int64 `json:"processed"`
+	Failed    int64 `json:"failed"`
+}
+
+// BackfillPosition is the last input message before which every message is processed.
+type BackfillPosition struct {
+	File    string          `json:"file,omitempty"`
+	Line    int             `json:"line,omitempty"`
+	MongoId json.RawMessage `json:"mongo_id,omitempty"`
+}
+
+type BackfillCheckpoint struct {
+	Input      string           `json:"input"`
+	Position   BackfillPosition `json:"position"`
+	Stats      BackfillStats    `json:"stats"`
+	UpdateTime int64            `json:"update_time"`
+}
+
+type backfillItem struct {
+	seq      int64
+	value    []byte
+	position BackfillPosition
+}
+
+// backfillTracker keeps the position before which every item is done, items finish out of order.
+// A failed item is never done, the position stays before it so a resumed backfill processes it again.
+type backfillTracker struct {
+	lock     sync.Mutex
+	next     int64
+	done     map[int64]BackfillPosition
+	position BackfillPosition
+	// seq of the first failed item, -1 if none
+	failedSeq int64
+}
+
+func newBackfillTracker(resume *BackfillPosition) *backfillTracker {
+	tracker := &backfillTracker{
+		done:      make(map[int64]BackfillPosition),
+		failedSeq: -1,
+	}
+	if resume != nil {
+		tracker.position = *resume
+	}
+	return tracker
+}
+
+func (t *backfillTracker) finish(item *backfillItem, failed bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if failed && (t.failedSeq < 0 || item.seq < t.failedSeq) {
+		t.failedSeq = item.seq
+	}
+	if t.failedSeq >= 0 && item.seq >= t.failedSeq {
+		// 位置不会再越过失败的item
+		return
+	}
+	t.done[item.seq] = item.position
+	for t.failedSeq < 0 || t.next < t.failedSeq {
+		position, ok := t.done[t.next]
+		if !ok {
+			break
+		}
+		t.position = position
+		delete(t.done, t.next)
+		t.next += 1
+	}
+}
+
+func (t *backfillTracker) current() BackfillPosition {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.position
+}
+
+func (p BackfillPosition) origin() string {
+	if len(p.MongoId) != 0 {
+		return string(p.MongoId)
+	}
+	return fmt.Sprintf("%s:%d", p.File, p.Line)
+}
+
+func (opts *BackfillOptions) inputName() string {
+	if len(opts.MongoCollection) != 0 {
+		return "mongo:" + opts.MongoCollection
+	}
+	return opts.Input
+}
+
+func loadCheckpoint(path string) (*BackfillCheckpoint, error) {
+	data, readErr := ioutil.ReadFile(path)
+	if os.IsNotExist(readErr) {
+		return nil, nil
+	} else if readErr != nil {
+		return nil, readErr
+	}
+	var checkpoint BackfillCheckpoint
+	parseErr := json.Unmarshal(data, &checkpoint)
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	return &checkpoint, nil
+}
+
+func saveCheckpoint(path string, checkpoint *BackfillCheckpoint) error {
+	checkpoint.UpdateTime = time.Now().Unix()
+	data, encodeErr := json.MarshalIndent(checkpoint, "", "  ")
+	if encodeErr != nil {
+		return encodeErr
+	}
+	// write then rename, so a crash never leaves a partial checkpoint
+	tmpPath := path + ".tmp"
+	writeErr := ioutil.WriteFile(tmpPath, data, 0644)
+	if writeErr != nil {
+		return writeErr
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// Backfill recomputes every profile of the input through the same path as the consumer,
+// resuming after the position of the checkpoint file if it exists. stop interrupts it after the processing items.
+// flush is called before every checkpoint is saved, e.g. to flush the output file.
+func Backfill(opts *BackfillOptions, conf *common.Config, stop <-chan os.Signal, flush func() error) (*BackfillStats, error) {
+	if len(opts.Input) == 0 && len(opts.MongoCollection) == 0 {
+		return nil, errors.New("backfill needs an input file, dir or mongo collection")
+	}
+
+	var resume *BackfillPosition
+	stats := &BackfillStats{}
+	if len(opts.Checkpoint) != 0 {
+		checkpoint, loadErr := loadCheckpoint(opts.Checkpoint)
+		if loadErr != nil {
+			return nil, loadErr
+		}
+		if checkpoint != nil {
+			if checkpoint.Input != opts.inputName() {
+				return nil, errors.New(fmt.Sprintf("checkpoint %s is of input %s, not %s", opts.Checkpoint, checkpoint.Input, opts.inputName()))
+			}
+			resume = &checkpoint.Position
+			*stats = checkpoint.Stats
+			glog.Infof("backfill resume from %+v, stats: %+v", checkpoint.Position, checkpoint.Stats)
+		}
+	}
+
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = conf.WorkerCnt
+	}
+	bucket := common.NewTokenBucket(opts.Rate, concurrency)
+	tracker := newBackfillTracker(resume)
+	var retry *backfillRetry
+	if len(opts.Retry) != 0 {
+		var openErr error
+		retry, openErr = openBackfillRetry(opts.Retry)
+		if openErr != nil {
+			return nil, openErr
+		}
+		defer retry.Close()
+	}
+
+	save := func() {
+		if len(opts.Checkpoint) == 0 {
+			return
+		}
+		if flush != nil {
+			flushErr := flush()
+			if flushErr != nil {
+				glog.Warningf("flush backfill output with error: %+v", flushErr)
+				return
+			}
+		}
+		if retry != nil {
+			flushErr := retry.Flush()
+			if flushErr != nil {
+				glog.Warningf("flush backfill retry with error: %+v", flushErr)
+				return
+			}
+		}
+		checkpoint := &BackfillCheckpoint{
+			Input:    opts.inputName(),
+			Position: tracker.current(),
+			Stats: BackfillStats{
+				Read:      atomic.LoadInt64(&stats.Read),
+				Processed: atomic.LoadInt64(&stats.Processed),
+				Failed:    atomic.LoadInt64(&stats.Failed),
+			},
+		}
+		saveErr := saveCheckpoint(opts.Checkpoint, checkpoint)
+		if saveErr != nil {
+			glog.Warningf("save backfill checkpoint with error: %+v", saveErr)
+		}
+	}
+
+	items := make(chan *backfillItem, concurrency)
+	done := make(chan struct{})
+	var readErr error
+	go func() {
+		defer close(items)
+		if len(opts.MongoCollection) != 0 {
+			readErr = readMongoItems(opts.MongoCollection, resume, items, done)
+		} else {
+			readErr = readFileItems(opts.Input, resume, items, done)
+		}
+	}()
+
+	var workerWg = &sync.WaitGroup{}
+	workerWg.Add(concurrency)
+	chWorker := make(chan *backfillItem, concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func(input chan *backfillItem, wg *sync.WaitGroup) {
+			defer wg.Done()
+			for item := range input {
+				// 不随停止取消，已读的item都处理完才保存checkpoint
+				processErr := process(messageContext(context.Background(), item.position.origin()), &item.value, conf)
+				if processErr == nil {
+					atomic.AddInt64(&stats.Processed, 1)
+					tracker.finish(item, false)
+					continue
+				}
+				atomic.AddInt64(&stats.Failed, 1)
+				// 无法解析的profile重试也不会成功，不阻挡checkpoint
+				held := !isInvalidMessage(processErr)
+				if held && retry != nil {
+					retryErr := retry.Write(item.value)
+					if retryErr != nil {
+						glog.Warningf("write %s to backfill retry with error: %+v", item.position.origin(), retryErr)
+					} else {
+						held = false
+					}
+				}
+				tracker.finish(item, held)
+			}
+		}(chWorker, workerWg)
+	}
+
+	interval := opts.CheckpointInterval
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+Loop:
+	for {
+		select {
+		case item, ok := <-items:
+			if !ok {
+				break Loop
+			}
+			bucket.Wait()
+			atomic.AddInt64(&stats.Read, 1)
+			chWorker <- item
+		case <-ticker.C:
+			save()
+			glog.Infof("backfill progress, read: %d, processed: %d, failed: %d", atomic.LoadInt64(&stats.Read),
+				atomic.LoadInt64(&stats.Processed), atomic.LoadInt64(&stats.Failed))
+		case <-stop:
+			glog.Infof("backfill interrupted")
+			break Loop
+		}
+	}
+	close(done)
+	close(chWorker)
+	workerWg.Wait()
+	// unblock the reader if it is still sending
+	for range items {
+	}
+	save()
+	return stats, readErr
+}
+
+// backfillRetry appends the failed profiles as json lines.
+type backfillRetry struct {
+	lock   sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+}
+
+func openBackfillRetry(path string) (*backfillRetry, error) {
+	file, openErr := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if openErr != nil {
+		return nil, openErr
+	}
+	return &backfillRetry{
+		file:   file,
+		writer: bufio.NewWriter(file),
+	}, nil
+}
+
+func (r *backfillRetry) Write(value []byte) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	_, writeErr := r.writer.Write(append(value, '\n'))
+	return writeErr
+}
+
+// Flush writes the buffered profiles, called before a checkpoint is saved.
+func (r *backfillRetry) Flush() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.writer.Flush()
+}
+
+func (r *backfillRetry) Close() error {
+	flushErr := r.Flush()
+	closeErr := r.file.Close()
+	if flushErr != nil {
+		return flushErr
+	}
+	return closeErr
+}
+
+func backfillFiles(input string) ([]string, error) {
+	info, statErr := os.Stat(input)
+	if statErr != nil {
+		return nil, statErr
+	}
+	if !info.IsDir() {
+		return []string{input}, nil
+	}
+	infos, listErr := ioutil.ReadDir(input)
+	if listErr != nil {
+		return nil, listErr
+	}
+	paths := make([]string, 0, len(infos))
+	for _, info := range infos {
+		if info.Mode().IsRegular() && !strings.HasPrefix(info.Name(), ".") {
+			paths = append(paths, filepath.Join(input, info.Name()))
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+func readFileItems(input string, resume *BackfillPosition, items chan<- *backfillItem, done <-chan struct{}) error {
+	paths, listErr := backfillFiles(input)
+	if listErr != nil {
+		return listErr
+	}
+	var seq int64 = 0
+	for _, path := range paths {
+		skipLines := 0
+		if resume != nil && len(resume.File) != 0 {
+			if path < resume.File {
+				continue
+			} else if path == resume.File {
+				skipLines = resume.Line
+			}
+		}
+
+		file, openErr := os.Open(path)
+		if openErr != nil {
+			return openErr
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+		lineNo := 0
+		for scanner.Scan() {
+			lineNo += 1
+			line := scanner.Bytes()
+			if lineNo <= skipLines || len(strings.TrimSpace(string(line))) == 0 {
+				continue
+			}
+			value := make([]byte, len(line))
+			copy(value, line)
+			item := &backfillItem{
+				seq:      seq,
+				value:    value,
+				position: BackfillPosition{File: path, Line: lineNo},
+			}
+			select {
+			case items <- item:
+				seq += 1
+			case <-done:
+				file.Close()
+				return nil
+			}
+		}
+		scanErr := scanner.Err()
+		file.Close()
+		if scanErr != nil {
+			return errors.New(fmt.Sprintf("read %s with error: %+v", path, scanErr))
+		}
+	}
+	return nil
+}
+
+var errBackfillStopped = errors.New("backfill stopped")
+
+func readMongoItems(collection string, resume *BackfillPosition, items chan<- *backfillItem, done <-chan struct{}) error {
+	var afterId *bson.RawValue
+	if resume != nil && len(resume.MongoId) != 0 {
+		var doc bson.Raw
+		parseErr := bson.UnmarshalExtJSON(resume.MongoId, true, &doc)
+		if parseErr != nil {
+			return parseErr
+		}
+		id := doc.Lookup("_id")
+		afterId = &id
+	}
+
+	var seq int64 = 0
+	scanErr := remote.ScanMongo(context.Background(), collection, afterId, func(raw bson.Raw) error {
+		// relaxed extended json of a profile document is the json FBProfile parses
+		value, encodeErr := bson.MarshalExtJSON(raw, false, false)
+		if encodeErr != nil {
+			return encodeErr
+		}
+		id, idErr := bson.MarshalExtJSON(bson.D{{Key: "_id", Value: raw.Lookup("_id")}}, true, false)
+		if idErr != nil {
+			return idErr
+		}
+		item := &backfillItem{
+			seq:      seq,
+			value:    value,
+			position: BackfillPosition{MongoId: json.RawMessage(id)},
+		}
+		select {
+		case items <- item:
+			seq += 1
+			return nil
+		case <-done:
+			return errBackfillStopped
+		}
+	})
+	if scanErr == errBackfillStopped {
+		return nil
+	}
+	return scanErr
+}
@@ -0,0 +1,27 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestBackfillTrackerHoldsFailed(t *testing.T) {
+	items := make([]*backfillItem, 6)
+	for i := range items {
+		items[i] = &backfillItem{seq: int64(i), position: BackfillPosition{File: "dump", Line: i + 1}}
+	}
+	tracker := newBackfillTracker(nil)
+
+	// items finish out of order, 3 fails after 4 is done
+	tracker.finish(items[1], false)
+	tracker.finish(items[0], false)
+	if line := tracker.current().Line; line != 2 {
+		t.Fatalf("position line: %d, want 2", line)
+	}
+	tracker.finish(items[4], false)
+	tracker.finish(items[3], true)
+	tracker.finish(items[5], false)
+	tracker.finish(items[2], false)
+	if line := tracker.current().Line; line != 3 {
+		t.Errorf("position line: %d, want 3 before the failed item", line)
+	}
+}
@@ -1,13 +1,18 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/ParticleMedia/fb_page_server/common"
 	"github.com/ParticleMedia/fb_page_server/remote"
 	cluster "github.com/bsm/sarama-cluster"
 	"github.com/golang/glog"
+	"math/rand"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"time"
 )
@@ -29,95 +34,229 @@ func InitClusterConfig(conf *common.KafkaConfig) {
 	}
 }
 
-func process(data *[]byte, conf *common.Config) error {
+// messageContext carries the trace of one message, the uid is filled when the message is parsed.
+func messageContext(ctx context.Context, origin string) context.Context {
+	return common.WithTrace(ctx, &common.Trace{LogId: rand.Int63(), Origin: origin})
+}
+
+// invalidMessageError is a message which can never be processed, e.g. bad json, it is dropped instead of retried.
+type invalidMessageError struct {
+	err error
+}
+
+func (e *invalidMessageError) Error() string {
+	return e.err.Error()
+}
+
+func (e *invalidMessageError) Unwrap() error {
+	return e.err
+}
+
+func isInvalidMessage(err error) bool {
+	var invalidErr *invalidMessageError
+	return errors.As(err, &invalidErr)
+}
+
+// process applies the per profile deadline of conf on ctx, every remote call of the message is cancelled with ctx.
+// It returns an invalidMessageError for messages which can not be parsed, and an error if any processor,
+// the user state or an event failed, so the message is processed again rather than counted as done.
+func process(ctx context.Context, data *[]byte, conf *common.Config) error {
+	if conf.ProfileTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(conf.ProfileTimeout)*time.Millisecond)
+		defer cancel()
+	}
+	if common.IsEvent(*data) {
+		return processEvent(ctx, data, conf)
+	}
+
 	var profile common.FBProfile
 	parseErr := json.Unmarshal(*data, &profile)
 	if parseErr != nil {
 		glog.Warningf("parse FBProfile with error: %+v, data: %s", parseErr, *data)
-		return parseErr
+		return &invalidMessageError{err: parseErr}
+	}
+	validErr := profile.Validate()
+	if validErr != nil {
+		glog.Warningf("validate FBProfile with error: %+v, data: %s", validErr, *data)
+		return &invalidMessageError{err: validErr}
+	}
+	trace := common.TraceFrom(ctx)
+	if trace != nil {
+		trace.Uid = profile.Id
 	}
 
+	processors := remote.EnabledProcessors()
 	var processWg = &sync.WaitGroup{}
-	processWg.Add(2)
-
-	go func(wg *sync.WaitGroup) {
-		defer wg.Done()
-		tcatErr := remote.ProcessTextCateGory(&profile, conf)
-		if tcatErr != nil {
-			glog.Warningf("process text_category with error: %+v, FBProfile: %+v", tcatErr, profile)
-		}
-	}(processWg)
+	processWg.Add(len(processors))
 
-	go func(wg *sync.WaitGroup) {
-		defer wg.Done()
-		chnErr := remote.ProcessChannel(&profile, conf)
-		if chnErr != nil {
-			glog.Warningf("process channel with error: %+v, FBProfile: %+v", chnErr, profile)
-		}
-	}(processWg)
+	var featuresLock sync.Mutex
+	features := make(map[string][]remote.PageFeature)
+	failures := make([]string, 0)
+	for _, processor := range processors {
+		go func(wg *sync.WaitGroup, processor remote.Processor) {
+			defer wg.Done()
+			pageFeatures, processErr := remote.RunProcessor(ctx, processor, &profile, conf)
+			if processErr != nil {
+				glog.Warningf("process %s with error: %+v, logid: %d, FBProfile: %+v", processor.Name(), processErr, common.LogId(ctx), profile)
+			}
+			featuresLock.Lock()
+			features[processor.Name()] = pageFeatures
+			if processErr != nil {
+				failures = append(failures, fmt.Sprintf("%s: %+v", processor.Name(), processErr))
+			}
+			featuresLock.Unlock()
+		}(processWg, processor)
+	}
 
 	processWg.Wait()
+	if ctx.Err() != nil {
+		// 部分processor没算完，不重建user state
+		glog.Warningf("process FBProfile with error: %+v, logid: %d, key: %d", ctx.Err(), common.LogId(ctx), profile.Id)
+		return ctx.Err()
+	}
+
+	stateErr := remote.RebuildUserState(ctx, profile.Id, features, conf)
+	if stateErr != nil {
+		glog.Warningf("rebuild user state with error: %+v, key: %d", stateErr, profile.Id)
+		failures = append(failures, fmt.Sprintf("user state: %+v", stateErr))
+	}
+	if len(failures) != 0 {
+		return errors.New(fmt.Sprintf("process FBProfile %d with error: %s", profile.Id, strings.Join(failures, "; ")))
+	}
 	return nil
 }
 
+func processEvent(ctx context.Context, data *[]byte, conf *common.Config) error {
+	var event common.FBEvent
+	parseErr := json.Unmarshal(*data, &event)
+	if parseErr != nil {
+		glog.Warningf("parse FBEvent with error: %+v, data: %s", parseErr, *data)
+		return &invalidMessageError{err: parseErr}
+	}
+	validErr := event.Validate()
+	if validErr != nil {
+		glog.Warningf("validate FBEvent with error: %+v, data: %s", validErr, *data)
+		return &invalidMessageError{err: validErr}
+	}
+	trace := common.TraceFrom(ctx)
+	if trace != nil {
+		trace.Uid = event.Id
+	}
+
+	if event.Event == common.FBEventDeauthorize {
+		deleteErr := remote.DeleteUser(ctx, event.Id, conf)
+		if deleteErr != nil {
+			glog.Warningf("delete user with error: %+v, data: %s", deleteErr, *data)
+		}
+		return deleteErr
+	}
+
+	if !conf.IncrConf.Enable {
+		// 未开启增量时like/unlike无法处理，重试也不会成功
+		glog.V(1).Infof("skip FBEvent as incremental is not enabled, data: %s", *data)
+		return &invalidMessageError{err: errors.New("incremental is not enabled")}
+	}
+	eventErr := remote.ProcessEvent(ctx, &event, conf)
+	if eventErr != nil {
+		glog.Warningf("process FBEvent with error: %+v, data: %s", eventErr, *data)
+	}
+	return eventErr
+}
+
+// messageData maps a kafka tombstone, a message keyed by uid without value, to the deauthorize event of the uid.
+func messageData(msg *Message) []byte {
+	if len(msg.Value) != 0 || len(msg.Key) == 0 {
+		return msg.Value
+	}
+	data, _ := json.Marshal(map[string]string{"_id": string(msg.Key), "event": common.FBEventDeauthorize})
+	return data
+}
+
 func Consume()  {
 	defer common.Wg.Done()
 
-	// init consumer
-	kafkaConf := common.FBConfig.KafkaConf
-	consumer, createErr := cluster.NewConsumer(kafkaConf.Addr, kafkaConf.GroupId, kafkaConf.Topic, clusterConf)
+	// init source
+	source, createErr := NewSource(common.FBConfig)
 	if createErr != nil {
-		glog.Warningf("create kafka consumer with error: %+v", createErr)
+		glog.Warningf("create %s source with error: %+v", common.FBConfig.SourceConf.Type, createErr)
 		return
 	}
-	defer consumer.Close()
+	defer source.Close()
 
 	// trap SIGINT to trigger a shutdown
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, os.Interrupt)
 
-	// consume errors
-	go func() {
-		for consumeErr := range consumer.Errors() {
-			glog.Warningf("consumer with error: %+v", consumeErr)
-		}
-	}()
+	Run(source, signals, common.FBConfig)
+}
 
-	// consume notifications
-	go func() {
-		for ntf := range consumer.Notifications() {
-			glog.Infof("kafka rebalanced: %+v", ntf)
-		}
-	}()
+// Run processes the messages of source with worker_cnt workers,
+// and returns when the source is exhausted or stop receives, after every received message is processed.
+// After stop the messages in process have shutdown_timeout before their remote calls are cancelled.
+func Run(source Source, stop <-chan os.Signal, conf *common.Config) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	workerCnt := common.FBConfig.WorkerCnt
+	workerCnt := conf.WorkerCnt
 	var consumeWg = &sync.WaitGroup{}
 	consumeWg.Add(workerCnt)
-	chWorker := make(chan *[]byte, workerCnt)
+	chWorker := make(chan *Message, workerCnt)
 	for i := 0; i < workerCnt; i++ {
-		go func(input chan *[]byte, wg *sync.WaitGroup) {
+		go func(input chan *Message, wg *sync.WaitGroup) {
 			defer wg.Done()
-			for data := range input {
-				process(data, common.FBConfig)
+			for msg := range input {
+				data := messageData(msg)
+				processErr := process(messageContext(ctx, msg.Origin), &data, conf)
+				if ctx.Err() != nil {
+					// 停止时被取消的消息不ack，重启后重新处理
+					glog.V(1).Infof("message from %s cancelled by shutdown", msg.Origin)
+					continue
+				}
+				if processErr != nil && !isInvalidMessage(processErr) {
+					// 处理失败的消息不ack，重启或rebalance后重新处理
+					glog.Warningf("message from %s not acked: %+v", msg.Origin, processErr)
+					continue
+				}
+				if processErr != nil {
+					glog.V(1).Infof("drop message from %s", msg.Origin)
+				}
+				source.Ack(msg)
 			}
 		} (chWorker, consumeWg)
 	}
 
 	// consume messages, watch signals
+	stopped := false
 Loop:
 	for {
 		select {
-		case msg, ok := <-consumer.Messages():
-			if ok {
-				chWorker <- &msg.Value
-				// mark message as processed
-				consumer.MarkOffset(msg, "")
+		case msg, ok := <-source.Messages():
+			if !ok {
+				break Loop
 			}
-		case <-signals:
+			chWorker <- msg
+		case <-stop:
+			stopped = true
 			break Loop
 		}
 	}
 
 	close(chWorker)
-	consumeWg.Wait()
+	workersDone := make(chan struct{})
+	go func() {
+		consumeWg.Wait()
+		close(workersDone)
+	}()
+	if !stopped || conf.ShutdownTimeout <= 0 {
+		<-workersDone
+		return
+	}
+	select {
+	case <-workersDone:
+	case <-time.After(time.Duration(conf.ShutdownTimeout) * time.Millisecond):
+		glog.Warningf("messages still in process after shutdown timeout %d ms, cancel them", conf.ShutdownTimeout)
+		cancel()
+		<-workersDone
+	}
 }
@@ -0,0 +1,38 @@
+package server_test
+
+import (
+	"encoding/json"
+	"flag"
+	"github.com/ParticleMedia/fb_page_server/internal/testutil/harness"
+	"testing"
+)
+
+var printUps = flag.Bool("print_ups", false, "log the ups writes of every case, e.g. to fill expect_ups")
+
+// TestE2e feeds the fixture cases of testdata/e2e through the consumer against in-process fakes,
+// no kafka, mongo or network needed, e.g. `go test ./server -run 'TestE2e/deauthorize'`.
+func TestE2e(t *testing.T) {
+	h := harness.New("../testdata/e2e")
+	cases, loadErr := h.LoadCases()
+	if loadErr != nil {
+		t.Fatalf("load cases with error: %+v", loadErr)
+	}
+	if len(cases) == 0 {
+		t.Fatal("no case found in ../testdata/e2e/cases")
+	}
+
+	// the remote package keeps global state, the cases must not run in parallel
+	for _, c := range cases {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			result := h.Run(c)
+			for _, failure := range result.Failures {
+				t.Error(failure)
+			}
+			if *printUps || t.Failed() {
+				data, _ := json.MarshalIndent(result.Ups, "", "  ")
+				t.Logf("ups writes: %s", data)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ParticleMedia/fb_page_server/common"
+	"github.com/ParticleMedia/fb_page_server/remote"
+	"github.com/golang/glog"
+	"net/http"
+)
+
+type HealthStatus struct {
+	// ok, or degraded when a breaker is not closed and the pages are served from the caches
+	Status   string                `json:"status"`
+	Breakers []remote.BreakerStats `json:"breakers"`
+	Limiters []remote.LimiterStats `json:"limiters"`
+}
+
+func currentHealth() *HealthStatus {
+	health := &HealthStatus{
+		Status:   "ok",
+		Breakers: remote.AllBreakerStats(),
+		Limiters: remote.AllLimiterStats(),
+	}
+	for _, stats := range health.Breakers {
+		if stats.State != remote.BreakerClosed {
+			health.Status = "degraded"
+		}
+	}
+	return health
+}
+
+func serveHealth(w http.ResponseWriter, r *http.Request) {
+	data, encodeErr := json.Marshal(currentHealth())
+	if encodeErr != nil {
+		http.Error(w, encodeErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+var breakerStateValue = map[remote.BreakerState]int{
+	remote.BreakerClosed:   0,
+	remote.BreakerHalfOpen: 1,
+	remote.BreakerOpen:     2,
+}
+
+// serveMetrics writes the breaker and limiter stats in the prometheus text format.
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# TYPE fb_page_breaker_state gauge")
+	for _, stats := range remote.AllBreakerStats() {
+		fmt.Fprintf(w, "fb_page_breaker_state{name=%q} %d\n", stats.Name, breakerStateValue[stats.State])
+	}
+	for _, counter := range []string{"requests", "failures", "slow", "rejected", "opened"} {
+		fmt.Fprintf(w, "# TYPE fb_page_breaker_%s_total counter\n", counter)
+		for _, stats := range remote.AllBreakerStats() {
+			value := map[string]int64{
+				"requests": stats.Requests,
+				"failures": stats.Failures,
+				"slow":     stats.Slow,
+				"rejected": stats.Rejected,
+				"opened":   stats.Opened,
+			}[counter]
+			fmt.Fprintf(w, "fb_page_breaker_%s_total{name=%q} %d\n", counter, stats.Name, value)
+		}
+	}
+
+	limiterStats := remote.AllLimiterStats()
+	fmt.Fprintln(w, "# TYPE fb_page_limiter_waiting gauge")
+	for _, stats := range limiterStats {
+		fmt.Fprintf(w, "fb_page_limiter_waiting{name=%q} %d\n", stats.Name, stats.Waiting)
+	}
+	fmt.Fprintln(w, "# TYPE fb_page_limiter_in_flight gauge")
+	for _, stats := range limiterStats {
+		fmt.Fprintf(w, "fb_page_limiter_in_flight{name=%q} %d\n", stats.Name, stats.InFlight)
+	}
+	fmt.Fprintln(w, "# TYPE fb_page_limiter_acquired_total counter")
+	for _, stats := range limiterStats {
+		fmt.Fprintf(w, "fb_page_limiter_acquired_total{name=%q} %d\n", stats.Name, stats.Acquired)
+	}
+	fmt.Fprintln(w, "# TYPE fb_page_limiter_wait_seconds_total counter")
+	for _, stats := range limiterStats {
+		fmt.Fprintf(w, "fb_page_limiter_wait_seconds_total{name=%q} %g\n", stats.Name, stats.WaitSecs)
+	}
+	fmt.Fprintln(w, "# TYPE fb_page_limiter_wait_max_seconds gauge")
+	for _, stats := range limiterStats {
+		fmt.Fprintf(w, "fb_page_limiter_wait_max_seconds{name=%q} %g\n", stats.Name, stats.WaitMaxSecs)
+	}
+}
+
+// StartHealthServer serves /health and /metrics in the background, nothing if conf.Addr is empty.
+func StartHealthServer(conf *common.HealthConfig) {
+	if len(conf.Addr) == 0 {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", serveHealth)
+	mux.HandleFunc("/metrics", serveMetrics)
+	go func() {
+		glog.Infof("health server listen on %s", conf.Addr)
+		serveErr := http.ListenAndServe(conf.Addr, mux)
+		if serveErr != nil {
+			glog.Warningf("health server with error: %+v", serveErr)
+		}
+	}()
+}
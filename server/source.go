@@ -0,0 +1,423 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/ParticleMedia/fb_page_server/common"
+	"github.com/Shopify/sarama"
+	cluster "github.com/bsm/sarama-cluster"
+	"github.com/golang/glog"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SourceKafka = "kafka"
+	SourceFile  = "file"
+	SourceDir   = "dir"
+	SourceStdin = "stdin"
+)
+
+// files in a watched dir are renamed with doneSuffix once read and acked, or failedSuffix if the read broke off,
+// files being written should end with tmpSuffix
+const (
+	doneSuffix   = ".done"
+	failedSuffix = ".failed"
+	tmpSuffix    = ".tmp"
+)
+
+// Message is one FBProfile or FBEvent, origin tells where it comes from, e.g. topic/partition/offset or file:line.
+// Key is the kafka key, a message with a key and no value is a tombstone of the uid in the key.
+type Message struct {
+	Key    []byte
+	Value  []byte
+	Origin string
+	kafka  *sarama.ConsumerMessage
+	file   *dirFile
+}
+
+// Source delivers the messages processed by Run. Messages is closed when the source is exhausted,
+// Ack is called once a worker has processed a message, from the workers concurrently and out of order.
+// Messages which fail or whose processing is cancelled by a shutdown are not acked, so they are delivered again;
+// for kafka an unacked message holds back the committed offset of its partition until a restart or rebalance,
+// for a dir it keeps its file from being renamed, so the whole file is read again after a restart.
+type Source interface {
+	Messages() <-chan *Message
+	Ack(msg *Message)
+	Close() error
+}
+
+// KafkaConsumer is the part of *cluster.Consumer used by the kafka source, so the pipeline can run against an in-process fake.
+type KafkaConsumer interface {
+	Messages() <-chan *sarama.ConsumerMessage
+	Errors() <-chan error
+	Notifications() <-chan *cluster.Notification
+	MarkOffset(msg *sarama.ConsumerMessage, metadata string)
+}
+
+// NewSource creates the source of source.type, kafka by default.
+func NewSource(conf *common.Config) (Source, error) {
+	sourceConf := &conf.SourceConf
+	switch sourceConf.Type {
+	case "", SourceKafka:
+		kafkaConf := &conf.KafkaConf
+		consumer, createErr := cluster.NewConsumer(kafkaConf.Addr, kafkaConf.GroupId, kafkaConf.Topic, clusterConf)
+		if createErr != nil {
+			return nil, createErr
+		}
+		return NewKafkaSource(consumer), nil
+	case SourceFile:
+		file, openErr := os.Open(sourceConf.Path)
+		if openErr != nil {
+			return nil, openErr
+		}
+		return NewReaderSource(sourceConf.Path, file), nil
+	case SourceStdin:
+		return NewReaderSource("stdin", ioutil.NopCloser(os.Stdin)), nil
+	case SourceDir:
+		interval := time.Duration(sourceConf.PollInterval) * time.Second
+		if interval <= 0 {
+			interval = 5 * time.Second
+		}
+		return NewDirSource(sourceConf.Path, interval), nil
+	default:
+		return nil, errors.New(fmt.Sprintf("unknown source type: %s", sourceConf.Type))
+	}
+}
+
+type kafkaSource struct {
+	consumer KafkaConsumer
+	messages chan *Message
+
+	lock       sync.Mutex
+	partitions map[kafkaPartitionKey]*kafkaPartition
+}
+
+type kafkaPartitionKey struct {
+	topic     string
+	partition int32
+}
+
+// kafkaPartition keeps the delivered messages of a partition in order, they are acked out of order
+// and an offset is marked only once every message delivered before it is acked.
+type kafkaPartition struct {
+	pending []*sarama.ConsumerMessage
+	acked   map[int64]bool
+}
+
+// NewKafkaSource reads from consumer, and closes it on Close if it is an io.Closer like *cluster.Consumer.
+func NewKafkaSource(consumer KafkaConsumer) Source {
+	source := &kafkaSource{
+		consumer:   consumer,
+		messages:   make(chan *Message),
+		partitions: make(map[kafkaPartitionKey]*kafkaPartition),
+	}
+
+	// consume errors
+	go func() {
+		for consumeErr := range consumer.Errors() {
+			glog.Warningf("consumer with error: %+v", consumeErr)
+		}
+	}()
+
+	// consume notifications
+	go func() {
+		for ntf := range consumer.Notifications() {
+			glog.Infof("kafka rebalanced: %+v", ntf)
+		}
+	}()
+
+	go func() {
+		defer close(source.messages)
+		for msg := range consumer.Messages() {
+			source.deliver(msg)
+			source.messages <- &Message{
+				Key:    msg.Key,
+				Value:  msg.Value,
+				Origin: fmt.Sprintf("%s/%d/%d", msg.Topic, msg.Partition, msg.Offset),
+				kafka:  msg,
+			}
+		}
+	}()
+	return source
+}
+
+func (s *kafkaSource) Messages() <-chan *Message {
+	return s.messages
+}
+
+func (s *kafkaSource) deliver(msg *sarama.ConsumerMessage) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	key := kafkaPartitionKey{topic: msg.Topic, partition: msg.Partition}
+	partition, ok := s.partitions[key]
+	if !ok {
+		partition = &kafkaPartition{acked: make(map[int64]bool)}
+		s.partitions[key] = partition
+	}
+	partition.pending = append(partition.pending, msg)
+}
+
+func (s *kafkaSource) Ack(msg *Message) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	partition, ok := s.partitions[kafkaPartitionKey{topic: msg.kafka.Topic, partition: msg.kafka.Partition}]
+	if !ok {
+		return
+	}
+	partition.acked[msg.kafka.Offset] = true
+	// mark the messages before which every message is processed
+	for len(partition.pending) != 0 && partition.acked[partition.pending[0].Offset] {
+		head := partition.pending[0]
+		s.consumer.MarkOffset(head, "")
+		delete(partition.acked, head.Offset)
+		partition.pending[0] = nil
+		partition.pending = partition.pending[1:]
+	}
+}
+
+func (s *kafkaSource) Close() error {
+	closer, ok := s.consumer.(io.Closer)
+	if !ok {
+		return nil
+	}
+	return closer.Close()
+}
+
+// readerSource reads one message per line, e.g. a json lines file or stdin.
+type readerSource struct {
+	name     string
+	reader   io.ReadCloser
+	messages chan *Message
+	done     chan struct{}
+	once     sync.Once
+}
+
+func NewReaderSource(name string, reader io.ReadCloser) Source {
+	source := &readerSource{
+		name:     name,
+		reader:   reader,
+		messages: make(chan *Message),
+		done:     make(chan struct{}),
+	}
+	go func() {
+		defer close(source.messages)
+		readErr := readLines(name, reader, nil, source.messages, source.done)
+		if readErr != nil {
+			glog.Warningf("read source %s with error: %+v", name, readErr)
+		}
+	}()
+	return source
+}
+
+func (s *readerSource) Messages() <-chan *Message {
+	return s.messages
+}
+
+func (s *readerSource) Ack(msg *Message) {
+}
+
+func (s *readerSource) Close() error {
+	var closeErr error
+	s.once.Do(func() {
+		close(s.done)
+		closeErr = s.reader.Close()
+	})
+	return closeErr
+}
+
+// readLines sends every non-empty line of reader until it ends or done is closed, file is nil unless reader is a dir file.
+func readLines(name string, reader io.Reader, file *dirFile, messages chan<- *Message, done <-chan struct{}) error {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo += 1
+		line := scanner.Bytes()
+		if len(strings.TrimSpace(string(line))) == 0 {
+			continue
+		}
+		// scanner reuses its buffer
+		value := make([]byte, len(line))
+		copy(value, line)
+		msg := &Message{Value: value, Origin: fmt.Sprintf("%s:%d", name, lineNo), file: file}
+		if file != nil {
+			file.deliver()
+		}
+		select {
+		case messages <- msg:
+		case <-done:
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+// dirSource polls a spool dir and reads every new file as json lines. Once read and every line is acked
+// the file is renamed with .done, or with .failed if it could not be read to the end, so it is kept for a look.
+// A file with a line not acked keeps its name and is read again after a restart.
+// Hidden files and files ending with .tmp are skipped, so writers should write to .tmp and rename.
+type dirSource struct {
+	dir      string
+	interval time.Duration
+	messages chan *Message
+	done     chan struct{}
+	once     sync.Once
+
+	lock sync.Mutex
+	// files read in this run and not renamed yet, so they are not read twice
+	seen map[string]bool
+}
+
+// dirFile counts the lines of a file delivered and not acked yet.
+type dirFile struct {
+	path     string
+	lock     sync.Mutex
+	pending  int
+	readDone bool
+	readErr  error
+}
+
+func (f *dirFile) deliver() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.pending += 1
+}
+
+// ack returns true for the last ack of a file read to the end.
+func (f *dirFile) ack() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.pending -= 1
+	return f.readDone && f.pending == 0
+}
+
+// finishRead returns true if every line of the file is acked already.
+func (f *dirFile) finishRead(readErr error) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.readDone = true
+	f.readErr = readErr
+	return f.pending == 0
+}
+
+func NewDirSource(dir string, interval time.Duration) Source {
+	source := &dirSource{
+		dir:      dir,
+		interval: interval,
+		messages: make(chan *Message),
+		done:     make(chan struct{}),
+		seen:     make(map[string]bool),
+	}
+	go source.watch()
+	return source
+}
+
+func (s *dirSource) Messages() <-chan *Message {
+	return s.messages
+}
+
+func (s *dirSource) Ack(msg *Message) {
+	if msg.file != nil && msg.file.ack() {
+		s.rename(msg.file)
+	}
+}
+
+func (s *dirSource) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+	})
+	return nil
+}
+
+func (s *dirSource) watch() {
+	defer close(s.messages)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		for _, path := range s.pendingFiles() {
+			file := &dirFile{path: path}
+			readErr := s.readFile(file)
+			select {
+			case <-s.done:
+				// 未读完的文件保持原名, 重启后重读
+				return
+			default:
+			}
+			if readErr != nil {
+				glog.Warningf("read source file %s with error: %+v", path, readErr)
+			}
+			if file.finishRead(readErr) {
+				s.rename(file)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// rename marks a file read and acked, with .failed if the read broke off: the lines read are processed,
+// the rest of the file is left for a look instead of being read again.
+func (s *dirSource) rename(file *dirFile) {
+	suffix := doneSuffix
+	if file.readErr != nil {
+		suffix = failedSuffix
+	}
+	renameErr := os.Rename(file.path, file.path+suffix)
+	if renameErr != nil {
+		// 改名失败的文件留在seen中，不再重读
+		glog.Warningf("rename source file %s with error: %+v", file.path, renameErr)
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.seen, file.path)
+}
+
+// pendingFiles lists the files not read yet and marks them seen.
+func (s *dirSource) pendingFiles() []string {
+	infos, listErr := ioutil.ReadDir(s.dir)
+	if listErr != nil {
+		glog.Warningf("list source dir %s with error: %+v", s.dir, listErr)
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	paths := make([]string, 0, len(infos))
+	for _, info := range infos {
+		name := info.Name()
+		if !info.Mode().IsRegular() || strings.HasPrefix(name, ".") ||
+			strings.HasSuffix(name, doneSuffix) || strings.HasSuffix(name, failedSuffix) || strings.HasSuffix(name, tmpSuffix) {
+			continue
+		}
+		path := filepath.Join(s.dir, name)
+		if s.seen[path] {
+			continue
+		}
+		s.seen[path] = true
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func (s *dirSource) readFile(file *dirFile) error {
+	reader, openErr := os.Open(file.path)
+	if openErr != nil {
+		return openErr
+	}
+	defer reader.Close()
+	glog.Infof("read source file: %s", file.path)
+	return readLines(file.path, reader, file, s.messages, s.done)
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func waitExists(path string) bool {
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, statErr := os.Stat(path); statErr == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// TestDirSourceRenamesAcked renames a file only once every line of it is acked.
+func TestDirSourceRenamesAcked(t *testing.T) {
+	dir, dirErr := ioutil.TempDir("", "dir_source")
+	if dirErr != nil {
+		t.Fatalf("create dir with error: %+v", dirErr)
+	}
+	defer os.RemoveAll(dir)
+	for name, content := range map[string]string{
+		"a.json": "{\"_id\": 1}\n{\"_id\": 2}\n",
+		"b.json": "{\"_id\": 3}\n\n{\"_id\": 4}\n",
+	} {
+		if writeErr := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); writeErr != nil {
+			t.Fatalf("write %s with error: %+v", name, writeErr)
+		}
+	}
+
+	source := NewDirSource(dir, 10*time.Millisecond)
+	defer source.Close()
+	received := make(map[string]*Message)
+	for len(received) < 4 {
+		select {
+		case msg := <-source.Messages():
+			received[msg.Origin] = msg
+		case <-time.After(2 * time.Second):
+			t.Fatalf("received %d of 4 messages", len(received))
+		}
+	}
+
+	a, b := filepath.Join(dir, "a.json"), filepath.Join(dir, "b.json")
+	source.Ack(received[a+":2"])
+	source.Ack(received[b+":1"])
+	if _, statErr := os.Stat(a); statErr != nil {
+		t.Errorf("a.json renamed with a line not acked")
+	}
+	source.Ack(received[a+":1"])
+	if !waitExists(a + doneSuffix) {
+		t.Errorf("a.json not renamed after every line is acked")
+	}
+	if _, statErr := os.Stat(b); statErr != nil {
+		t.Errorf("b.json renamed with a line not acked")
+	}
+	source.Ack(received[b+":3"])
+	if !waitExists(b + doneSuffix) {
+		t.Errorf("b.json not renamed after every line is acked")
+	}
+}